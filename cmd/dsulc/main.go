@@ -6,7 +6,7 @@ It handles communication with the server via IPC and sends user commands.
 
 Usage:
 
-    dsulc [arguments]
+    dsulc [command] [arguments]
 
 */
 package main
@@ -16,28 +16,63 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/akamensky/argparse"
+	"github.com/hymnis/dsul-go/internal/audit"
+	"github.com/hymnis/dsul-go/internal/cache"
+	"github.com/hymnis/dsul-go/internal/completion"
+	"github.com/hymnis/dsul-go/internal/events"
+	"github.com/hymnis/dsul-go/internal/focus"
+	"github.com/hymnis/dsul-go/internal/history"
 	"github.com/hymnis/dsul-go/internal/ipc"
+	"github.com/hymnis/dsul-go/internal/notify"
+	"github.com/hymnis/dsul-go/internal/output"
 	"github.com/hymnis/dsul-go/internal/settings"
+	"github.com/hymnis/dsul-go/internal/tui"
 )
 
 var (
-	version       string = "0.0.0"
-	sha1          string //lint:ignore U1000 supplied at build time
-	buildTime     string //lint:ignore U1000 supplied at build time
-	verbose       bool   = false
-	debug         bool   = false
-	hardware_info string = ""
+	version       string          = "0.0.0"
+	sha1          string          //lint:ignore U1000 supplied at build time
+	buildTime     string          //lint:ignore U1000 supplied at build time
+	verbose       bool            = false
+	debug         bool            = false
+	requests                      = make(map[uint64]ipc.Request) // sent requests, by ID
+	watch         bool            = false
+	interactive   bool            = false
+	exit_code     int             = exitOK
+	output_format string          = output.Text
+	results       []output.Result // results to show in the output document
+	last_id       uint64          // ID of the last request or local result
+	values_kind   string          // kind of values to complete, if completion values are requested
+	palette       ipc.Palette     // colors, modes, states and brightness limits of the daemon
+)
+
+const completionTimeout = "500ms" // how long to wait for the daemon when completing values, unless a timeout is given
+
+const argumentsStep = "arguments" // history step of values set with arguments (e.g. -c red -m blink), so they're undone together
+
+// Exit codes, one for each reason a request can fail.
+const (
+	exitOK          = 0 // all requests succeeded
+	exitUsage       = 1 // invalid arguments
+	exitError       = 2 // other error (e.g. unsupported protocol version)
+	exitUnreachable = 3 // daemon isn't running or doesn't respond
+	exitAuthFailed  = 4 // authentication failed, or not allowed by the token
+	exitOffline     = 5 // device isn't connected
+	exitInvalid     = 6 // value was rejected by the daemon
+	exitRejected    = 7 // value was rejected by the device
+	exitConfig      = 8 // configuration isn't valid
 )
 
 // main runs the main loop and runners for IPC.
 func main() {
 	// Get settings and cmd_list from arguments
-	cfg := settings.GetSettings()
-	cmd_list := handleArguments(cfg)
+	cfg, cmd_list := handleArguments()
 
 	output_handling := struct {
 		Verbose bool
@@ -47,64 +82,83 @@ func main() {
 		Debug:   debug,
 	}
 
+	if values_kind != "" {
+		showCompletionValues(cfg) // values for shell completion, from daemon, cache or configuration
+		os.Exit(exitOK)
+	}
+
 	// Start runners
-	ipc_message := make(chan ipc.Message)
-	ipc_response := make(chan ipc.Message)
+	ipc_error := make(chan error) // connection errors, from IPC client
+
+	if watch {
+		event_channel := make(chan events.Event)
+		go ipc.WatchRunner(cfg, output_handling, event_channel, ipc_error) // subscribe to events and keep connection open
+		go showEvents(event_channel)                                       // print events until interrupted
+
+		err := <-ipc_error // run until the subscription fails
+		exitWithError(err)
+	}
+
+	if interactive {
+		ipc_request := make(chan ipc.Request, 64) // buffered, as the UI doesn't wait for the connection
+		ipc_response := make(chan ipc.Response)
+		go ipc.ClientRunner(cfg, output_handling, ipc_request, ipc_response, ipc_error) // send IPC requests given and pass on responses
+		err := tui.Runner(cfg, output_handling, ipc_request, ipc_response, ipc_error)   // run UI until the user quits
+		if errors.Is(err, tui.ErrNoTerminal) {
+			log.Println("[dsulc] " + err.Error())
+			os.Exit(exitUsage)
+		} else if err != nil {
+			exitWithError(err)
+		}
+		os.Exit(exitOK)
+	}
+
+	if len(cmd_list) == 0 {
+		showDocument() // only local results, no need to contact the daemon
+		os.Exit(exitOK)
+	}
+
+	ipc_request := make(chan ipc.Request)
+	ipc_response := make(chan ipc.Response)
 	done := make(chan bool)
-	go ipc.ClientRunner(cfg, output_handling, ipc_message, ipc_response, done) // act on IPC message's given and send 'done' signal when all are sent
-	go handleResponse(cfg, ipc_response)                                       // handle responses from IPC daemon
+	go ipc.ClientRunner(cfg, output_handling, ipc_request, ipc_response, ipc_error) // send IPC requests given and pass on responses
+	go handleResponse(cfg, ipc_response, done)                                      // handle responses from IPC daemon and send 'done' signal when all are received
 
-	sendMessages(cmd_list, ipc_message) // send IPC message's (to channel ipc_message)
-	close(ipc_message)                  // close channel once we are done sending messages
+	go func() {
+		sendMessages(cmd_list, ipc_request) // send IPC requests (to channel ipc_request)
+		close(ipc_request)                  // close channel once we are done sending requests
+	}()
 
-	<-done // run until 'done' signal is received
+	// Run until 'done' signal is received, the connection fails or the daemon doesn't respond in time
+	timeout := ipc.GetTimeout(cfg)
+	select {
+	case <-done:
+		showDocument()
+		os.Exit(exit_code)
+	case err := <-ipc_error:
+		exitWithError(err)
+	case <-time.After(timeout):
+		log.Printf("[dsulc] Daemon unreachable: no response within %s\n", timeout)
+		os.Exit(exitUnreachable)
+	}
 }
 
-// handleArguments parses command line arguments and prepares IPC messages (actions) to send.
-func handleArguments(cfg *settings.Config) []ipc.Message {
+// handleArguments parses command line arguments, gets the settings and prepares IPC requests (actions) to send.
+func handleArguments() (*settings.Config, []ipc.Request) {
 	parser := argparse.NewParser("dsulc", "Disturb State USB Light - CLI")
 
 	arg_color := parser.String("c", "color", &argparse.Options{
 		Required: false,
-		Validate: func(args []string) error {
-			for _, color := range args {
-				for _, cfg_color := range cfg.Colors {
-					if cfg_color.Name == color {
-						return nil
-					}
-				}
-			}
-			return errors.New("color given is not supported")
-		},
-		Help: "Set given color"})
+		Help:     "Set given color"})
 	arg_list := parser.Flag("l", "list", &argparse.Options{
 		Required: false,
 		Help:     "List settings and values"})
 	arg_mode := parser.String("m", "mode", &argparse.Options{
 		Required: false,
-		Validate: func(args []string) error {
-			for _, mode := range args {
-				for _, cfg_mode := range cfg.Modes {
-					if cfg_mode.Name == mode {
-						return nil
-					}
-				}
-			}
-			return errors.New("mode given is not supported")
-		},
-		Help: "Set given mode"})
+		Help:     "Set given mode"})
 	arg_brightness := parser.Int("b", "brightness", &argparse.Options{
 		Required: false,
-		Validate: func(args []string) error {
-			for _, mode := range args {
-				if n, err := strconv.Atoi(mode); err != nil || int(n) < cfg.BrightnessMin || int(n) > cfg.BrightnessMax {
-					msg := fmt.Sprintf("Brightness must be between %d and %d.", cfg.BrightnessMin, cfg.BrightnessMax)
-					return errors.New(msg)
-				}
-			}
-			return nil
-		},
-		Help: "Set given brightness"})
+		Help:     "Set given brightness"})
 	arg_dim := parser.Flag("d", "dim", &argparse.Options{
 		Required: false,
 		Help:     "Dim colors"})
@@ -124,7 +178,28 @@ func handleArguments(cfg *settings.Config) []ipc.Message {
 			}
 			return errors.New("password can't be empty")
 		},
-		Help: "Set password"})
+		Help: "Set password (visible to other users, prefer --password-file)"})
+	arg_password_file := parser.String("", "password-file", &argparse.Options{
+		Required: false,
+		Help:     "Read password from given file"})
+	arg_config := parser.String("", "config", &argparse.Options{
+		Required: false,
+		Help:     "Use given config file, instead of the user's config file"})
+	arg_timeout := parser.String("t", "timeout", &argparse.Options{
+		Required: false,
+		Validate: func(args []string) error {
+			for _, timeout := range args {
+				if d, err := time.ParseDuration(timeout); err != nil || d <= 0 {
+					return errors.New("timeout must be given as a positive value, e.g. 5s")
+				}
+			}
+			return nil
+		},
+		Help: "Set how long to wait for the daemon"})
+	arg_output := parser.Selector("o", "output", output.Formats, &argparse.Options{
+		Required: false,
+		Default:  output.Text,
+		Help:     "Set output format"})
 	arg_version := parser.Flag("v", "version", &argparse.Options{
 		Required: false,
 		Help:     "Show version"})
@@ -135,17 +210,222 @@ func handleArguments(cfg *settings.Config) []ipc.Message {
 		Required: false,
 		Help:     "Show debug output"})
 
-	err := parser.Parse(os.Args)
+	validateDuration := func(args []string) error {
+		for _, duration := range args {
+			if d, err := time.ParseDuration(duration); err != nil || d <= 0 {
+				return errors.New("duration must be given as a positive value, e.g. 25m")
+			}
+		}
+		return nil
+	}
+	cmd_set := parser.NewCommand("set", "Set a value: set <color|brightness|mode|dim> <value>")
+	cmd_set_color := cmd_set.NewCommand("color", "Set color: set color <name>")
+	cmd_set_brightness := cmd_set.NewCommand("brightness", "Set brightness: set brightness <value>")
+	cmd_set_mode := cmd_set.NewCommand("mode", "Set mode: set mode <name>")
+	cmd_set_dim := cmd_set.NewCommand("dim", "Dim or un-dim colors: set dim <on|off>")
+
+	cmd_get := parser.NewCommand("get", "Get values from the daemon")
+	cmd_get_state := cmd_get.NewCommand("state", "Show the current color, mode, brightness and dim")
+	cmd_get_information := cmd_get.NewCommand("information", "Show settings and hardware values (same as --list)")
+
+	cmd_list_values := parser.NewCommand("list", "List configured values")
+	cmd_list_colors := cmd_list_values.NewCommand("colors", "List colors")
+	cmd_list_modes := cmd_list_values.NewCommand("modes", "List modes")
+	cmd_list_states := cmd_list_values.NewCommand("states", "List states")
+	cmd_list_all := cmd_list_values.NewCommand("all", "List colors, modes and states")
+
+	cmd_state := parser.NewCommand("state", "Set the color and mode of a configured state: state <name>")
+
+	cmd_device := parser.NewCommand("device", "Show devices")
+	cmd_device_list := cmd_device.NewCommand("list", "List devices handled by the daemon")
+
+	cmd_config := parser.NewCommand("config", "Show or change configuration (of the daemon)")
+	cmd_config_path := cmd_config.NewCommand("path", "Show path of the config file")
+	cmd_config_validate := cmd_config.NewCommand("validate", "Check the config files and environment, showing all problems found")
+	cmd_config_color := cmd_config.NewCommand("color", "Change colors: config color <add|remove|rename> ...")
+	cmd_config_color_add := cmd_config_color.NewCommand("add", "Add a color: config color add <name> <red:green:blue>")
+	cmd_config_color_remove := cmd_config_color.NewCommand("remove", "Remove a color: config color remove <name>")
+	cmd_config_color_rename := cmd_config_color.NewCommand("rename", "Rename a color: config color rename <name> <new name>")
+	cmd_config_state := cmd_config.NewCommand("state", "Change states: config state <set|remove> ...")
+	cmd_config_state_set := cmd_config_state.NewCommand("set", "Add or change a state: config state set <name> <color> <mode>")
+	cmd_config_state_remove := cmd_config_state.NewCommand("remove", "Remove a state: config state remove <name>")
+	cmd_config_brightness_limits := cmd_config.NewCommand("brightness-limits", "Set brightness limits: config brightness-limits <min> <max>")
+
+	cmd_token := parser.NewCommand("token", "Manage tokens (of the daemon): token <create|list|revoke> ...")
+	cmd_token_create := cmd_token.NewCommand("create", "Create a token: token create <name>, the token is only shown once")
+	arg_token_role := cmd_token_create.Selector("", "role", []string{"read", "control", "admin"}, &argparse.Options{
+		Required: false,
+		Default:  "read",
+		Help:     "Set role of the token: read (get values and events), control (also set values, focus timer and notifications) or admin (also change configuration and tokens)"})
+	arg_token_operations := cmd_token_create.String("", "operations", &argparse.Options{
+		Required: false,
+		Help:     "Only allow the token these operations (of its role), separated by commas: get, subscribe, set, focus, notify, config, token or log"})
+	cmd_token_list := cmd_token.NewCommand("list", "List tokens")
+	cmd_token_revoke := cmd_token.NewCommand("revoke", "Revoke a token: token revoke <name>")
+
+	cmd_log := parser.NewCommand("log", "Show the audit log (of the daemon), oldest first")
+	arg_log_since := cmd_log.String("", "since", &argparse.Options{
+		Required: false,
+		Validate: func(args []string) error {
+			for _, since := range args {
+				if _, err := getSince(since, time.Now()); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Help: "Only show entries since given time (e.g. 2026-01-02T15:04:05Z or 2026-01-02) or duration ago (e.g. 2h)"})
+	arg_log_source := cmd_log.Selector("", "source", []string{"ipc", "http", "focus", "notify"}, &argparse.Options{
+		Required: false,
+		Help:     "Only show entries from given source"})
+	arg_log_limit := cmd_log.Int("", "limit", &argparse.Options{
+		Required: false,
+		Help:     "Only show the last given number of entries"})
+
+	cmd_history := parser.NewCommand("history", "Show the states applied to the light, newest first, with the number of steps back")
+	cmd_undo := parser.NewCommand("undo", "Restore the state before the current one")
+	cmd_restore := parser.NewCommand("restore", "Restore a state from the history: restore <steps back>, as shown by history")
+
+	cmd_tui := parser.NewCommand("tui", "Show and control the light in an interactive terminal UI")
+
+	cmd_completion := parser.NewCommand("completion", "Output shell completion script")
+	cmd_completion_bash := cmd_completion.NewCommand("bash", "Output bash completion script")
+	cmd_completion_zsh := cmd_completion.NewCommand("zsh", "Output zsh completion script")
+	cmd_completion_fish := cmd_completion.NewCommand("fish", "Output fish completion script")
+	cmd_completion_values := cmd_completion.NewCommand("values", "Output values used by completion scripts: completion values <colors|modes|states|devices>")
+
+	cmd_focus := parser.NewCommand("focus", "Control the focus timer")
+	cmd_focus_start := cmd_focus.NewCommand("start", "Start focus timer: focus start [duration]")
+	arg_focus_break := cmd_focus_start.String("", "break", &argparse.Options{
+		Required: false,
+		Validate: validateDuration,
+		Help:     "Set break duration"})
+	arg_focus_long_break := cmd_focus_start.String("", "long-break", &argparse.Options{
+		Required: false,
+		Validate: validateDuration,
+		Help:     "Set long break duration"})
+	arg_focus_cycles := cmd_focus_start.Int("", "cycles", &argparse.Options{
+		Required: false,
+		Validate: func(args []string) error {
+			for _, cycles := range args {
+				if n, err := strconv.Atoi(cycles); err != nil || n < 1 {
+					return errors.New("cycles must be 1 or more")
+				}
+			}
+			return nil
+		},
+		Help: "Set number of focus cycles before a long break"})
+	cmd_focus_stop := cmd_focus.NewCommand("stop", "Stop focus timer")
+	cmd_focus_pause := cmd_focus.NewCommand("pause", "Pause focus timer")
+	cmd_focus_resume := cmd_focus.NewCommand("resume", "Resume focus timer")
+	cmd_focus_status := cmd_focus.NewCommand("status", "Show focus timer status")
+
+	cmd_notify := parser.NewCommand("notify", "Show a notification and restore the light afterwards: notify <color>")
+	arg_notify_pattern := cmd_notify.Selector("", "pattern", []string{"flash", "blink"}, &argparse.Options{
+		Required: false,
+		Default:  "flash",
+		Help:     "Set notification pattern"})
+	arg_notify_count := cmd_notify.Int("", "count", &argparse.Options{
+		Required: false,
+		Default:  3,
+		Validate: func(args []string) error {
+			for _, count := range args {
+				if n, err := strconv.Atoi(count); err != nil || n < 1 || n > notify.MaxCount {
+					return fmt.Errorf("count must be between 1 and %d", notify.MaxCount)
+				}
+			}
+			return nil
+		},
+		Help: "Set number of times the pattern is shown"})
+	arg_notify_duration := cmd_notify.String("", "duration", &argparse.Options{
+		Required: false,
+		Validate: validateDuration,
+		Help:     "Show pattern for given duration, instead of a number of times"})
+
+	cmd_watch := parser.NewCommand("watch", "Show state changes until interrupted")
+	arg_watch_json := cmd_watch.Flag("", "json", &argparse.Options{
+		Required: false,
+		Help:     "Show events as JSON lines"})
+
+	args := getArguments(parser, os.Args)
+	set_value := ""
+	if len(args) > 2 && args[1] == "set" {
+		set_value, args = popArgument(args, 3)
+		if set_value != "" && args[2] == "dim" {
+			var err error
+			if set_value, err = parseSwitch(set_value); err != nil {
+				fmt.Print(parser.Usage(err))
+				os.Exit(exitUsage)
+			}
+		}
+	}
+
+	state_name := ""
+	if len(args) > 1 && args[1] == "state" {
+		state_name, args = popArgument(args, 2)
+	}
+
+	if len(args) > 2 && args[1] == "completion" && args[2] == "values" {
+		values_kind, args = popArgument(args, 3)
+		if !isKind(values_kind) {
+			fmt.Print(parser.Usage(errors.New("kind must be one of: " + strings.Join(completion.Kinds, ", "))))
+			os.Exit(exitUsage)
+		}
+	}
+
+	focus_duration := ""
+	if len(args) > 2 && args[1] == "focus" && args[2] == "start" {
+		focus_duration, args = popArgument(args, 3)
+		if focus_duration != "" {
+			if err := validateDuration([]string{focus_duration}); err != nil {
+				fmt.Print(parser.Usage(err))
+				os.Exit(exitUsage)
+			}
+		}
+	}
+
+	notify_color := ""
+	if len(args) > 1 && args[1] == "notify" {
+		notify_color, args = popArgument(args, 2)
+	}
+
+	restore_index := ""
+	if len(args) > 1 && args[1] == "restore" {
+		restore_index, args = popArgument(args, 2)
+	}
+
+	token_name := ""
+	if len(args) > 2 && args[1] == "token" && args[2] != "list" {
+		token_name, args = popArgument(args, 3)
+	}
+
+	config_values := []string{}
+	if len(args) > 2 && args[1] == "config" && args[2] != "path" && args[2] != "validate" {
+		position := 4 // config <color|state> <action> <values>
+		if args[2] == "brightness-limits" {
+			position = 3
+		}
+		for {
+			value, remaining := popArgument(args, position)
+			if value == "" {
+				break
+			}
+			config_values = append(config_values, value)
+			args = remaining
+		}
+	}
+
+	err := parser.Parse(args)
 	if err != nil {
 		// This can also be done by passing -h or --help
 
 		fmt.Print(parser.Usage(err))
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
 	// Handle arguments
 	actions := 0
-	var cmd_list []ipc.Message
+	var cmd_list []ipc.Request
 
 	if *arg_debug {
 		debug = true
@@ -160,131 +440,888 @@ func handleArguments(cfg *settings.Config) []ipc.Message {
 		fmt.Printf("dsulc v%s\n", version)
 		os.Exit(0)
 	}
+	if *arg_config != "" {
+		if verbose {
+			log.Printf("[dsulc] Using config file: %s\n", *arg_config)
+		}
+		settings.SetConfigPath(*arg_config)
+	}
+	if cmd_config_validate.Happened() {
+		output_format = *arg_output
+		validateSettings() // before getting the settings, as they can't be used if they aren't valid
+	}
+	loaded, sources, err := settings.LoadLayers()
+	if err != nil {
+		log.Fatalln("Failed to load the DSUL configuration: ", err)
+	}
+	cfg := &loaded
 	if *arg_network != "" {
 		if verbose {
 			log.Printf("[dsulc] Using network mode. Connecting to: %s (%d)\n", *arg_network, cfg.Network.Port)
 		}
 		cfg.Network.Server = *arg_network
 	}
-	if *arg_password != "" {
+	if err := settings.ApplyCredential(cfg, sources); err != nil {
+		log.Fatalln("Failed to read the DSUL credentials: ", err)
+	}
+	output_format = *arg_output
+	if *arg_timeout != "" {
 		if verbose {
-			log.Print("[dsulc] Using password authentication.\n")
+			log.Printf("[dsulc] Using timeout: %s\n", *arg_timeout)
 		}
+		cfg.Network.Timeout = *arg_timeout
+	}
+	if *arg_password_file != "" {
+		password, err := settings.ReadPasswordFile(*arg_password_file)
+		if err != nil {
+			log.Fatalln("Failed to read the password: ", err)
+		}
+		cfg.Password = password
+		cfg.Token = "" // a password given as argument is used instead of a configured token
+	}
+	if *arg_password != "" {
 		cfg.Password = *arg_password
+		cfg.Token = ""
+	}
+	if verbose && cfg.Token != "" {
+		log.Printf("[dsulc] Using token authentication (%s).\n", sources["token"])
+	} else if verbose && cfg.Password != "" {
+		log.Printf("[dsulc] Using password authentication (%s).\n", sources["password"])
+	}
+
+	// Values are validated against the daemon's palette, listing values may use the cached palette.
+	// A palette cached within its TTL is used to validate values without asking the daemon first, values not found in it
+	// (e.g. a color just added by another client) are checked against the daemon's palette.
+	shows_palette := *arg_list || cmd_get_information.Happened()
+	validates := *arg_color != "" || *arg_mode != "" || *arg_brightness != 0 || set_value != "" || state_name != "" || notify_color != ""
+	palette_cached := false
+	if validates && !shows_palette {
+		palette, palette_cached = cache.LoadRecentPalette(cache.Key(cfg))
+	}
+	if (shows_palette || validates || cmd_list_values.Happened()) && !palette_cached {
+		palette = getPalette(cfg, !shows_palette && !validates)
+	}
+	validate := func(key string, value string) {
+		err := validateValue(key, value)
+		if err != nil && palette_cached {
+			palette, palette_cached = getPalette(cfg, false), false
+			err = validateValue(key, value)
+		}
+		if err != nil {
+			fmt.Print(parser.Usage(err))
+			os.Exit(exitUsage)
+		}
+	}
+	if *arg_brightness != 0 {
+		validate("brightness", strconv.Itoa(*arg_brightness))
 	}
+	for key, value := range map[string]string{"color": *arg_color, "mode": *arg_mode, "state": state_name, "notify": notify_color} {
+		if value != "" {
+			validate(key, value)
+		}
+	}
+
 	if *arg_list {
 		if verbose {
 			log.Print("[dsulc] Request information\n")
 		}
-		cmd_list = append(cmd_list, ipc.Message{Type: "get", Key: "information", Value: "all", Secret: cfg.Password})
+		cmd_list = addRequest(cmd_list, ipc.OpGet, cfg, ipc.GetPayload{Key: "information"})
 		actions += 1
 	}
 	if *arg_mode != "" {
 		if verbose {
 			log.Printf("[dsulc] Set mode: %v\n", *arg_mode)
 		}
-		cmd_list = append(cmd_list, ipc.Message{Type: "set", Key: "mode", Value: *arg_mode, Secret: cfg.Password})
+		cmd_list = addRequest(cmd_list, ipc.OpSet, cfg, ipc.SetPayload{Key: "mode", Value: *arg_mode, Step: argumentsStep})
 		actions += 1
 	}
 	if *arg_brightness > 0 {
 		if verbose {
 			log.Printf("[dsulc] Set brightness: %d\n", *arg_brightness)
 		}
-		cmd_list = append(cmd_list, ipc.Message{Type: "set", Key: "brightness", Value: fmt.Sprint(*arg_brightness), Secret: cfg.Password})
+		cmd_list = addRequest(cmd_list, ipc.OpSet, cfg, ipc.SetPayload{Key: "brightness", Value: fmt.Sprint(*arg_brightness), Step: argumentsStep})
 		actions += 1
 	}
 	if *arg_dim {
 		if verbose {
 			log.Print("[dsulc] Set dim\n")
 		}
-		cmd_list = append(cmd_list, ipc.Message{Type: "set", Key: "dim", Value: "true", Secret: cfg.Password})
+		cmd_list = addRequest(cmd_list, ipc.OpSet, cfg, ipc.SetPayload{Key: "dim", Value: "true", Step: argumentsStep})
 		actions += 1
 	}
 	if *arg_undim {
 		if verbose {
 			log.Print("[dsulc] Set un-dim\n")
 		}
-		cmd_list = append(cmd_list, ipc.Message{Type: "set", Key: "dim", Value: "false", Secret: cfg.Password})
+		cmd_list = addRequest(cmd_list, ipc.OpSet, cfg, ipc.SetPayload{Key: "dim", Value: "false", Step: argumentsStep})
 		actions += 1
 	}
 	if *arg_color != "" {
 		if verbose {
 			log.Printf("[dsulc] Set color: %v\n", *arg_color)
 		}
-		cmd_list = append(cmd_list, ipc.Message{Type: "set", Key: "color", Value: *arg_color, Secret: cfg.Password})
+		cmd_list = addRequest(cmd_list, ipc.OpSet, cfg, ipc.SetPayload{Key: "color", Value: *arg_color, Step: argumentsStep})
+		actions += 1
+	}
+
+	if cmd_set.Happened() {
+		if set_value == "" {
+			fmt.Print(parser.Usage(errors.New("value must be given")))
+			os.Exit(exitUsage)
+		}
+		payload := ipc.SetPayload{Value: set_value}
+		if cmd_set_color.Happened() {
+			payload.Key = "color"
+		} else if cmd_set_brightness.Happened() {
+			payload.Key = "brightness"
+		} else if cmd_set_mode.Happened() {
+			payload.Key = "mode"
+		} else if cmd_set_dim.Happened() {
+			payload.Key = "dim"
+		}
+		validate(payload.Key, payload.Value)
+		if verbose {
+			log.Printf("[dsulc] Set %s: %v\n", payload.Key, payload.Value)
+		}
+		cmd_list = addRequest(cmd_list, ipc.OpSet, cfg, payload)
+		actions += 1
+	}
+
+	if cmd_state.Happened() {
+		if state_name == "" {
+			fmt.Print(parser.Usage(errors.New("state must be given")))
+			os.Exit(exitUsage)
+		}
+		if verbose {
+			log.Printf("[dsulc] Set state: %v\n", state_name)
+		}
+		cmd_list = addRequest(cmd_list, ipc.OpSet, cfg, ipc.SetPayload{Key: "state", Value: state_name})
+		actions += 1
+	}
+
+	if cmd_get.Happened() {
+		payload := ipc.GetPayload{Key: "information"}
+		if cmd_get_state.Happened() {
+			payload.Key = "state"
+		} else if cmd_get_information.Happened() {
+			payload.Key = "information"
+		}
+		if verbose {
+			log.Printf("[dsulc] Request %s\n", payload.Key)
+		}
+		cmd_list = addRequest(cmd_list, ipc.OpGet, cfg, payload)
+		actions += 1
+	}
+
+	if cmd_device_list.Happened() {
+		if verbose {
+			log.Print("[dsulc] Request devices\n")
+		}
+		cmd_list = addRequest(cmd_list, ipc.OpGet, cfg, ipc.GetPayload{Key: "devices"})
+		actions += 1
+	}
+
+	if cmd_list_values.Happened() {
+		kind := "all"
+		if cmd_list_colors.Happened() {
+			kind = "colors"
+		} else if cmd_list_modes.Happened() {
+			kind = "modes"
+		} else if cmd_list_states.Happened() {
+			kind = "states"
+		} else if cmd_list_all.Happened() {
+			kind = "all"
+		}
+		addResult(output.NewList(palette, kind))
+		actions += 1
+	}
+
+	if cmd_config_path.Happened() {
+		addResult(output.Result{Op: "config", Key: "path", OK: true, Path: settings.ConfigPath()})
+		actions += 1
+	}
+
+	config_action := ""
+	if cmd_config_color_add.Happened() {
+		config_action = "color-add"
+	} else if cmd_config_color_remove.Happened() {
+		config_action = "color-remove"
+	} else if cmd_config_color_rename.Happened() {
+		config_action = "color-rename"
+	} else if cmd_config_state_set.Happened() {
+		config_action = "state-set"
+	} else if cmd_config_state_remove.Happened() {
+		config_action = "state-remove"
+	} else if cmd_config_brightness_limits.Happened() {
+		config_action = "brightness-limits"
+	}
+	if config_action != "" {
+		payload, err := newConfigPayload(config_action, config_values)
+		if err != nil {
+			fmt.Print(parser.Usage(err))
+			os.Exit(exitUsage)
+		}
+		if verbose {
+			log.Printf("[dsulc] Change configuration: %s %v\n", config_action, config_values)
+		}
+		cmd_list = addRequest(cmd_list, ipc.OpConfig, cfg, payload)
+		actions += 1
+	}
+
+	if cmd_token.Happened() {
+		payload := ipc.TokenPayload{Action: "list"}
+		if cmd_token_create.Happened() {
+			payload = ipc.TokenPayload{Action: "create", Name: token_name, Role: *arg_token_role}
+			if *arg_token_operations != "" {
+				payload.Operations = strings.Split(*arg_token_operations, ",")
+			}
+		} else if cmd_token_revoke.Happened() {
+			payload = ipc.TokenPayload{Action: "revoke", Name: token_name}
+		} else if cmd_token_list.Happened() {
+			payload.Action = "list"
+		}
+		if payload.Action != "list" && token_name == "" {
+			fmt.Print(parser.Usage(errors.New("name must be given")))
+			os.Exit(exitUsage)
+		}
+		if verbose {
+			log.Printf("[dsulc] Tokens: %+v\n", payload)
+		}
+		cmd_list = addRequest(cmd_list, ipc.OpToken, cfg, payload)
+		actions += 1
+	}
+
+	if cmd_log.Happened() {
+		since, _ := getSince(*arg_log_since, time.Now()) // validated
+		payload := ipc.LogPayload{Since: since, Source: *arg_log_source, Limit: *arg_log_limit}
+		if verbose {
+			log.Printf("[dsulc] Audit log: %+v\n", payload)
+		}
+		cmd_list = addRequest(cmd_list, ipc.OpLog, cfg, payload)
+		actions += 1
+	}
+
+	if cmd_history.Happened() || cmd_undo.Happened() || cmd_restore.Happened() {
+		payload := ipc.HistoryPayload{Action: "list"}
+		if cmd_undo.Happened() {
+			payload.Action = "undo"
+		} else if cmd_restore.Happened() {
+			index, err := strconv.Atoi(restore_index)
+			if err != nil || index < 0 {
+				fmt.Print(parser.Usage(errors.New("steps back must be given as a number (0 or more), as shown by history")))
+				os.Exit(exitUsage)
+			}
+			payload = ipc.HistoryPayload{Action: "restore", Index: index}
+		}
+		if verbose {
+			log.Printf("[dsulc] History: %+v\n", payload)
+		}
+		cmd_list = addRequest(cmd_list, ipc.OpHistory, cfg, payload)
+		actions += 1
+	}
+
+	if cmd_tui.Happened() {
+		if verbose {
+			log.Print("[dsulc] Start terminal UI\n")
+		}
+		interactive = true
+		actions += 1
+	}
+
+	if cmd_completion.Happened() {
+		if cmd_completion_values.Happened() {
+			if *arg_timeout == "" {
+				cfg.Network.Timeout = completionTimeout
+			}
+			return cfg, cmd_list
+		}
+		shell := ""
+		if cmd_completion_bash.Happened() {
+			shell = "bash"
+		} else if cmd_completion_zsh.Happened() {
+			shell = "zsh"
+		} else if cmd_completion_fish.Happened() {
+			shell = "fish"
+		}
+		script, _ := completion.Script(shell)
+		fmt.Print(script)
+		os.Exit(exitOK)
+	}
+
+	if cmd_focus.Happened() {
+		payload := ipc.FocusPayload{}
+		if cmd_focus_start.Happened() {
+			payload = ipc.FocusPayload{Action: "start", Duration: focus_duration, Break: *arg_focus_break, LongBreak: *arg_focus_long_break, Cycles: *arg_focus_cycles}
+		} else if cmd_focus_stop.Happened() {
+			payload.Action = "stop"
+		} else if cmd_focus_pause.Happened() {
+			payload.Action = "pause"
+		} else if cmd_focus_resume.Happened() {
+			payload.Action = "resume"
+		} else if cmd_focus_status.Happened() {
+			payload.Action = "status"
+		}
+		if verbose {
+			log.Printf("[dsulc] Focus timer: %+v\n", payload)
+		}
+		cmd_list = addRequest(cmd_list, ipc.OpFocus, cfg, payload)
+		actions += 1
+	}
+
+	if cmd_notify.Happened() {
+		if notify_color == "" {
+			fmt.Print(parser.Usage(errors.New("color must be given")))
+			os.Exit(exitUsage)
+		}
+		if d, _ := time.ParseDuration(*arg_notify_duration); d > notify.MaxDuration {
+			fmt.Print(parser.Usage(fmt.Errorf("duration can't be longer than %s", notify.MaxDuration)))
+			os.Exit(exitUsage)
+		}
+		payload := ipc.NotifyPayload{Color: notify_color, Pattern: *arg_notify_pattern, Count: *arg_notify_count, Duration: *arg_notify_duration}
+		if verbose {
+			log.Printf("[dsulc] Notify: %+v\n", payload)
+		}
+		cmd_list = addRequest(cmd_list, ipc.OpNotify, cfg, payload)
+		actions += 1
+	}
+
+	if cmd_watch.Happened() {
+		if verbose {
+			log.Print("[dsulc] Watch events\n")
+		}
+		watch = true
+		if *arg_watch_json {
+			output_format = output.JSON
+		}
 		actions += 1
 	}
 
 	// Handle actions
 	if actions == 0 {
 		fmt.Print(parser.Usage(nil))
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
-	return cmd_list
+	return cfg, cmd_list
 }
 
-// sendMessages sends prepared IPC messages to ipc_message channel.
-func sendMessages(cmd_list []ipc.Message, ipc_message chan ipc.Message) {
-	for _, cmd := range cmd_list {
-		ipc_message <- cmd
+// validateSettings shows all problems found in the settings (config files and environment), with their location, and exits.
+// The exit code is exitConfig if any problems were found.
+func validateSettings() {
+	_, err := settings.LoadValidSettings(nil)
+	result := output.Result{Op: "config", Key: "validate", OK: err == nil}
+	for _, problem := range settings.GetProblems(err) {
+		result.Problems = append(result.Problems, output.Problem(problem))
+	}
+	addResult(result)
+	showDocument()
+	if err != nil {
+		os.Exit(exitConfig)
 	}
-	time.Sleep(time.Second * 1) // give server time to respond
+	os.Exit(exitOK)
 }
 
-// handleResponse handles responses from IPC daemon.
-func handleResponse(cfg *settings.Config, ipc_response chan ipc.Message) {
-	//lint:ignore S1000 using select statement on loop to handle incoming data
-	for {
-		select {
-		case response := <-ipc_response:
-			if verbose {
-				log.Printf("[dsulc] IPC Response: %v\n", response.Value)
+// validateValue returns an error if the value isn't in the daemon's palette (or within its brightness limits).
+// Key is one of: color, brightness, mode, dim, state or notify (a color).
+func validateValue(key string, value string) error {
+	switch key {
+	case "color", "notify":
+		for _, color := range palette.Colors {
+			if color.Name == value {
+				return nil
 			}
-			if len(response.Value) > 4 {
-				// Update settings values from hardware limits
+		}
+		return errors.New("color given is not supported")
+	case "brightness":
+		if n, err := strconv.Atoi(value); err != nil || n < palette.BrightnessMin || n > palette.BrightnessMax {
+			return fmt.Errorf("Brightness must be between %d and %d.", palette.BrightnessMin, palette.BrightnessMax)
+		}
+	case "mode":
+		for _, mode := range palette.Modes {
+			if mode == value {
+				return nil
+			}
+		}
+		return errors.New("mode given is not supported")
+	case "state":
+		for _, state := range palette.States {
+			if state.Name == value {
+				return nil
+			}
+		}
+		return errors.New("state given is not configured")
+	}
+	return nil
+}
 
-				hardware_info = response.Value
-				hardware_state := *settings.ParseHardwareInformation(hardware_info)
-				if hardware_state.Brightness_min >= 0 {
-					cfg.BrightnessMin = hardware_state.Brightness_min
-				}
-				if hardware_state.Brightness_max > 0 {
-					cfg.BrightnessMax = hardware_state.Brightness_max
-				}
+// getPalette returns the daemon's palette, and caches it for offline use.
+// If offline use is allowed, the cached palette (or the local configuration) is used when the daemon can't be reached,
+// otherwise the program exits with the error.
+func getPalette(cfg *settings.Config, offline bool) ipc.Palette {
+	request, _ := ipc.NewRequest(1, ipc.OpGet, ipc.GetSecret(cfg), ipc.GetPayload{Key: "palette"})
+	response, err := requestOnce(cfg, request)
+	if err == nil {
+		daemon_palette := ipc.Palette{}
+		if err = response.Decode(&daemon_palette); err == nil {
+			if err := cache.SavePalette(cache.Key(cfg), daemon_palette); err != nil && verbose {
+				log.Println("[dsulc] Unable to cache palette: " + err.Error())
+			}
+			return daemon_palette
+		}
+	}
+
+	var protocol_error *ipc.Error
+	if errors.As(err, &protocol_error) && (protocol_error.Code == ipc.ErrInvalidValue || protocol_error.Code == ipc.ErrForbidden) {
+		offline = true // daemon doesn't know about palettes (or the token can't get it), it still validates the requests itself
+	}
+	if !offline {
+		exitWithError(err)
+	}
+	if cached_palette, ok := cache.LoadPalette(cache.Key(cfg)); ok {
+		if verbose {
+			log.Printf("[dsulc] Using cached palette: %s\n", err)
+		}
+		return cached_palette
+	}
+	if verbose {
+		log.Printf("[dsulc] Using local configuration: %s\n", err)
+	}
+	return ipc.NewPalette(cfg)
+}
+
+// requestOnce sends a single request and returns the response, or why the daemon didn't respond in time.
+// Error responses are returned as an error.
+func requestOnce(cfg *settings.Config, request ipc.Request) (ipc.Response, error) {
+	output_handling := struct {
+		Verbose bool
+		Debug   bool
+	}{
+		Verbose: verbose,
+		Debug:   debug,
+	}
+	ipc_request := make(chan ipc.Request, 1)
+	ipc_response := make(chan ipc.Response)
+	ipc_error := make(chan error, 2)
+	ipc_request <- request
+	close(ipc_request)
+	go ipc.ClientRunner(cfg, output_handling, ipc_request, ipc_response, ipc_error)
+
+	timeout := ipc.GetTimeout(cfg)
+	select {
+	case response := <-ipc_response:
+		if response.Error != nil {
+			return response, response.Error
+		}
+		return response, nil
+	case err := <-ipc_error:
+		return ipc.Response{}, err
+	case <-time.After(timeout):
+		return ipc.Response{}, fmt.Errorf("no response within %s", timeout)
+	}
+}
+
+// parseSwitch returns "true" or "false" for the given on/off (or true/false) value.
+func parseSwitch(value string) (string, error) {
+	switch value {
+	case "on", "true":
+		return "true", nil
+	case "off", "false":
+		return "false", nil
+	}
+	return "", errors.New("value must be on or off")
+}
+
+// isKind returns true if the given kind is one of the kinds of values that can be completed.
+func isKind(kind string) bool {
+	for _, completion_kind := range completion.Kinds {
+		if completion_kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// newConfigPayload returns the payload of a config request, with the values given for the action.
+func newConfigPayload(action string, values []string) (ipc.ConfigPayload, error) {
+	usage := map[string]string{
+		"color-add":         "<name> <red:green:blue>",
+		"color-remove":      "<name>",
+		"color-rename":      "<name> <new name>",
+		"state-set":         "<name> <color> <mode>",
+		"state-remove":      "<name>",
+		"brightness-limits": "<min> <max>",
+	}
+	payload := ipc.ConfigPayload{Action: action}
+	if len(values) != strings.Count(usage[action], "<") {
+		return payload, fmt.Errorf("values must be given: %s", usage[action])
+	}
 
-				showInformation(cfg)
-			} else {
-				// ...
+	switch action {
+	case "color-add":
+		payload.Name, payload.Value = values[0], values[1]
+	case "color-remove", "state-remove":
+		payload.Name = values[0]
+	case "color-rename":
+		payload.Name, payload.NewName = values[0], values[1]
+	case "state-set":
+		payload.Name, payload.Color, payload.Mode = values[0], values[1], values[2]
+	case "brightness-limits":
+		min, err_min := strconv.Atoi(values[0])
+		max, err_max := strconv.Atoi(values[1])
+		if err_min != nil || err_max != nil {
+			return payload, errors.New("brightness limits must be given as numbers")
+		}
+		payload.Min, payload.Max = min, max
+	}
+	return payload, nil
+}
+
+// getArguments returns the arguments with the subcommands and their values first, followed by the flags and their values.
+// Subcommands must be given before any flags to be parsed, this way flags can also be given before them.
+func getArguments(parser *argparse.Parser, args []string) []string {
+	value_flags := map[string]bool{}
+	addValueFlags(&parser.Command, value_flags)
+
+	positionals, flags := []string{args[0]}, []string{}
+	for i := 1; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			positionals = append(positionals, args[i])
+			continue
+		}
+		flags = append(flags, args[i])
+		if value_flags[args[i]] && i+1 < len(args) {
+			i += 1
+			flags = append(flags, args[i])
+		}
+	}
+	return append(positionals, flags...)
+}
+
+// addValueFlags adds the flags of the command, and its subcommands, that take a value (e.g. "-t" and "--timeout").
+func addValueFlags(cmd *argparse.Command, value_flags map[string]bool) {
+	for _, arg := range cmd.GetArgs() {
+		switch arg.GetResult().(type) {
+		case *string, *int, *[]string:
+			if arg.GetSname() != "" {
+				value_flags["-"+arg.GetSname()] = true
 			}
+			value_flags["--"+arg.GetLname()] = true
 		}
 	}
+	for _, sub_cmd := range cmd.GetCommands() {
+		addValueFlags(sub_cmd, value_flags)
+	}
 }
 
-// showInformation reads configuration settings and current hardware values and prints them.
-func showInformation(cfg *settings.Config) {
-	hardware_state := *settings.ParseHardwareInformation(hardware_info)
+// popArgument removes and returns the positional argument at given position, if there is one.
+func popArgument(args []string, position int) (string, []string) {
+	if len(args) > position && !strings.HasPrefix(args[position], "-") {
+		value := args[position]
+		remaining := append([]string{}, args[:position]...)
+		return value, append(remaining, args[position+1:]...)
+	}
+	return "", args
+}
+
+// addRequest adds a request for the given operation and payload to the list of requests.
+func addRequest(cmd_list []ipc.Request, op string, cfg *settings.Config, payload interface{}) []ipc.Request {
+	last_id += 1
+	request, err := ipc.NewRequest(last_id, op, ipc.GetSecret(cfg), payload)
+	if err != nil {
+		log.Fatal("[dsulc] Unable to create request: ", err)
+	}
+	return append(cmd_list, request)
+}
 
-	fmt.Println("[modes]")
-	for _, cfg_mode := range cfg.Modes {
-		fmt.Printf("- %s\n", cfg_mode.Name)
+// addResult shows a result that doesn't need a request (e.g. from the local configuration).
+func addResult(result output.Result) {
+	last_id += 1
+	result.ID = last_id
+	if output_format == output.Text {
+		output.WriteText(os.Stdout, result)
+	} else {
+		results = append(results, result)
 	}
+}
+
+// sendMessages sends prepared IPC requests to ipc_request channel.
+func sendMessages(cmd_list []ipc.Request, ipc_request chan ipc.Request) {
+	for _, request := range cmd_list {
+		requests[request.ID] = request // all requests are added before sending, as responses are handled concurrently
+	}
+	for _, request := range cmd_list {
+		ipc_request <- request
+	}
+}
 
-	fmt.Println("\n[colors]")
-	for _, cfg_color := range cfg.Colors {
-		fmt.Printf("- %s\n", cfg_color.Name)
+// handleResponse handles responses from IPC daemon and sends 'done' signal once all requests have been answered.
+func handleResponse(cfg *settings.Config, ipc_response chan ipc.Response, done chan bool) {
+	for response := range ipc_response {
+		request, ok := requests[response.ID]
+		if !ok {
+			continue // not a response to a sent request
+		}
+		delete(requests, response.ID)
+		if verbose {
+			log.Printf("[dsulc] IPC Response: %d (%s)\n", response.ID, response.Op)
+		}
+
+		showResponse(cfg, request, response)
+		if len(requests) == 0 {
+			done <- true
+			return
+		}
 	}
+}
 
-	fmt.Println("\n[brightness]")
-	fmt.Printf("- min = %v\n", cfg.BrightnessMin)
-	fmt.Printf("- max = %v\n", cfg.BrightnessMax)
+// showResponse shows the result of a request, or why it failed.
+// Results are shown directly in text format, otherwise they are added to the output document.
+func showResponse(cfg *settings.Config, request ipc.Request, response ipc.Response) {
+	result := newResult(request)
 
-	if hardware_state.Version != "" {
-		fmt.Println("\n[hardware values]")
-		fmt.Printf("- version = %v\n", hardware_state.Version)
-		fmt.Printf("- color = %v\n", hardware_state.Current_color)
-		fmt.Printf("- mode = %v\n", hardware_state.Current_mode)
-		fmt.Printf("- brightness = %v\n", hardware_state.Current_brightness)
-		fmt.Printf("- dim = %v\n", hardware_state.Current_dim)
+	if response.Error != nil {
+		result.Error = &output.Error{Code: response.Error.Code, Message: response.Error.Message}
+		log.Printf("[dsulc] %s: failed, %s\n", output.Describe(result), response.Error.Message)
+		if exit_code == exitOK {
+			exit_code = getExitCode(response.Error)
+		}
+	} else if response.Op == ipc.OpFocus {
+		status := focus.Status{}
+		if err := response.Decode(&status); err != nil {
+			log.Println("[dsulc] Focus timer request failed")
+			return
+		}
+		result.OK = true
+		result.Focus = output.NewFocus(status)
+	} else if response.Op == ipc.OpConfig {
+		changed_palette := ipc.Palette{}
+		if err := response.Decode(&changed_palette); err == nil {
+			palette = changed_palette
+			if err := cache.SavePalette(cache.Key(cfg), palette); err != nil && verbose {
+				log.Println("[dsulc] Unable to cache palette: " + err.Error())
+			}
+		}
+		result.OK = true
+	} else if response.Op == ipc.OpToken && result.Key != "revoke" {
+		list := []ipc.TokenInfo{}
+		if result.Key == "create" {
+			info := ipc.TokenInfo{}
+			if err := response.Decode(&info); err != nil {
+				log.Println("[dsulc] Invalid token received")
+				return
+			}
+			list = append(list, info)
+		} else if err := response.Decode(&list); err != nil {
+			log.Println("[dsulc] Invalid token list received")
+			return
+		}
+		result.OK = true
+		result.Tokens = []output.Token{}
+		for _, info := range list {
+			result.Tokens = append(result.Tokens, output.Token(info))
+		}
+	} else if response.Op == ipc.OpLog {
+		entries := []audit.Entry{}
+		if err := response.Decode(&entries); err != nil {
+			log.Println("[dsulc] Invalid audit log received")
+			return
+		}
+		result.OK = true
+		result.Log = entries
+	} else if response.Op == ipc.OpHistory {
+		entries := []history.Entry{}
+		if result.Key == "list" {
+			if err := response.Decode(&entries); err != nil {
+				log.Println("[dsulc] Invalid history received")
+				return
+			}
+		} else {
+			entry := history.Entry{}
+			if err := response.Decode(&entry); err != nil {
+				log.Println("[dsulc] Invalid state received")
+				return
+			}
+			entries = append(entries, entry)
+		}
+		result.OK = true
+		result.History = entries
+	} else if response.Op == ipc.OpGet && result.Key == "devices" {
+		devices := []ipc.Device{}
+		if err := response.Decode(&devices); err != nil {
+			log.Println("[dsulc] Invalid device list received")
+			return
+		}
+		result.OK = true
+		result.Devices = []output.Device{}
+		for _, device := range devices {
+			result.Devices = append(result.Devices, output.Device(device))
+		}
+	} else if response.Op == ipc.OpGet {
+		hardware_state := settings.Hardware{}
+		if err := response.Decode(&hardware_state); err != nil {
+			log.Println("[dsulc] Invalid hardware information received")
+			return
+		}
+		// Limit the palette values to the hardware limits, the configured limits are kept
+		palette.BrightnessMin, palette.BrightnessMax = settings.GetBrightnessLimits(&settings.Config{BrightnessMin: palette.BrightnessMin, BrightnessMax: palette.BrightnessMax}, hardware_state)
+		result.OK = true
+		if result.Key == "state" {
+			result.State = &hardware_state
+		} else {
+			result.Information = output.NewInformation(palette, hardware_state)
+		}
+	} else {
+		result.OK = true
+	}
+
+	if output_format == output.Text {
+		if result.OK {
+			output.WriteText(os.Stdout, result)
+		}
+	} else {
+		results = append(results, result)
+	}
+}
+
+// showDocument writes all results, in request order, in the (machine-readable) output format.
+func showDocument() {
+	if output_format == output.Text {
+		return
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	if err := output.Write(os.Stdout, output_format, output.Document{Version: output.SchemaVersion, Results: results}); err != nil {
+		log.Println("[dsulc] Unable to write output: " + err.Error())
+	}
+}
+
+// newResult returns a result, describing what was requested.
+func newResult(request ipc.Request) output.Result {
+	result := output.Result{ID: request.ID, Op: request.Op}
+	switch request.Op {
+	case ipc.OpSet:
+		payload := ipc.SetPayload{}
+		if request.Decode(&payload) == nil {
+			result.Key, result.Value = payload.Key, payload.Value
+		}
+	case ipc.OpGet:
+		payload := ipc.GetPayload{}
+		if request.Decode(&payload) == nil {
+			result.Key = payload.Key
+		}
+	case ipc.OpFocus:
+		payload := ipc.FocusPayload{}
+		if request.Decode(&payload) == nil {
+			result.Key = payload.Action
+		}
+	case ipc.OpNotify:
+		payload := ipc.NotifyPayload{}
+		if request.Decode(&payload) == nil {
+			result.Value = payload.Color
+		}
+	case ipc.OpToken:
+		payload := ipc.TokenPayload{}
+		if request.Decode(&payload) == nil {
+			result.Key, result.Value = payload.Action, payload.Name
+		}
+	case ipc.OpConfig:
+		payload := ipc.ConfigPayload{}
+		if request.Decode(&payload) == nil {
+			result.Key, result.Value = payload.Action, payload.Name
+			if payload.Action == "brightness-limits" {
+				result.Value = fmt.Sprintf("%d-%d", payload.Min, payload.Max)
+			}
+		}
+	case ipc.OpHistory:
+		payload := ipc.HistoryPayload{}
+		if request.Decode(&payload) == nil {
+			result.Key = payload.Action
+			if payload.Action == "restore" {
+				result.Value = strconv.Itoa(payload.Index)
+			}
+		}
+	case ipc.OpLog:
+		payload := ipc.LogPayload{}
+		if request.Decode(&payload) == nil {
+			result.Key, result.Value = payload.Source, payload.Since
+		}
+	}
+	return result
+}
+
+// getSince returns the time given as a time (RFC 3339), a date or a duration before now, in RFC 3339 format.
+func getSince(value string, now time.Time) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return now.Add(-d).UTC().Format(time.RFC3339), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Format(time.RFC3339), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t.UTC().Format(time.RFC3339), nil
+	}
+	return "", fmt.Errorf("since must be given as a time (e.g. 2026-01-02T15:04:05Z or 2026-01-02) or duration (e.g. 2h), not '%s'", value)
+}
+
+// getExitCode returns the exit code for the given error.
+func getExitCode(err error) int {
+	var protocol_error *ipc.Error
+	if !errors.As(err, &protocol_error) {
+		return exitUnreachable // not an error from the daemon, so it couldn't be reached
+	}
+
+	switch protocol_error.Code {
+	case ipc.ErrAuthFailed, ipc.ErrForbidden:
+		return exitAuthFailed
+	case ipc.ErrDeviceOffline:
+		return exitOffline
+	case ipc.ErrInvalidValue:
+		return exitInvalid
+	case ipc.ErrDeviceRejected:
+		return exitRejected
+	}
+	return exitError
+}
+
+// exitWithError prints the reason of a connection error and exits with the matching exit code.
+func exitWithError(err error) {
+	code := getExitCode(err)
+	if code == exitUnreachable {
+		log.Printf("[dsulc] Daemon unreachable: %s\n", err)
+	} else {
+		log.Printf("[dsulc] Request failed: %s\n", err)
+	}
+	os.Exit(code)
+}
+
+// showCompletionValues prints the names of the requested kind of values, one per line.
+// Values are requested from the daemon, if it responds in time, otherwise they are taken from the cache or configuration.
+func showCompletionValues(cfg *settings.Config) {
+	devices := []ipc.Device{{Port: cfg.Serial.Port}}
+	if values_kind == "devices" {
+		request, _ := ipc.NewRequest(1, ipc.OpGet, ipc.GetSecret(cfg), ipc.GetPayload{Key: "devices"})
+		if response, err := requestOnce(cfg, request); err == nil {
+			_ = response.Decode(&devices)
+		} else if verbose {
+			log.Printf("[dsulc] Using local configuration: %s\n", err)
+		}
+	} else {
+		palette = getPalette(cfg, true)
+	}
+
+	values, _ := completion.Values(values_kind, palette, devices)
+	for _, value := range values {
+		fmt.Println(value)
+	}
+}
+
+// showEvents prints received events, one per line (or document) in the output format.
+func showEvents(event_channel chan events.Event) {
+	for e := range event_channel {
+		if err := output.WriteEvent(os.Stdout, output_format, e); err != nil {
+			log.Println("[dsulc] Unable to write output: " + err.Error())
+		}
 	}
 }
@@ -35,6 +35,72 @@ var _ = Describe("Dsulc", func() {
 			})
 		})
 
+		Context("focus without command", func() {
+			focusSession := runDsulc(dsulcPath, "focus")
+
+			It("prints usage of focus commands to stdout", func() {
+				Eventually(focusSession).Should(gbytes.Say("Control the focus timer"))
+			})
+			It("exits with status code 1", func() {
+				Eventually(focusSession).Should(gexec.Exit(1))
+			})
+		})
+
+		Context("notify without color", func() {
+			notifySession := runDsulc(dsulcPath, "notify")
+
+			It("prints 'color must be given' to stdout", func() {
+				Eventually(notifySession).Should(gbytes.Say("color must be given"))
+			})
+			It("exits with status code 1", func() {
+				Eventually(notifySession).Should(gexec.Exit(1))
+			})
+		})
+
+		Context("set without value", func() {
+			setSession := runDsulc(dsulcPath, "set")
+
+			It("prints usage of set commands to stdout", func() {
+				Eventually(setSession).Should(gbytes.Say("Set a value"))
+			})
+			It("exits with status code 1", func() {
+				Eventually(setSession).Should(gexec.Exit(1))
+			})
+		})
+
+		Context("state without name", func() {
+			stateSession := runDsulc(dsulcPath, "state")
+
+			It("prints 'state must be given' to stdout", func() {
+				Eventually(stateSession).Should(gbytes.Say("state must be given"))
+			})
+			It("exits with status code 1", func() {
+				Eventually(stateSession).Should(gexec.Exit(1))
+			})
+		})
+
+		Context("state without name, after flags", func() {
+			flagsSession := runDsulc(dsulcPath, "--verbose", "-t", "1s", "state")
+
+			It("prints 'state must be given' to stdout", func() {
+				Eventually(flagsSession).Should(gbytes.Say("state must be given"))
+			})
+			It("exits with status code 1", func() {
+				Eventually(flagsSession).Should(gexec.Exit(1))
+			})
+		})
+
+		Context("invalid timeout", func() {
+			timeoutSession := runDsulc(dsulcPath, "--timeout=0s")
+
+			It("prints 'timeout must be given as a positive value' to stdout", func() {
+				Eventually(timeoutSession).Should(gbytes.Say("timeout must be given as a positive value"))
+			})
+			It("exits with status code 1", func() {
+				Eventually(timeoutSession).Should(gexec.Exit(1))
+			})
+		})
+
 	})
 })
 
@@ -45,8 +111,8 @@ func buildDsulc() string {
 	return dsulPath
 }
 
-func runDsulc(path string, args string) *gexec.Session {
-	cmd := exec.Command(path, args)
+func runDsulc(path string, args ...string) *gexec.Session {
+	cmd := exec.Command(path, args...)
 	session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
 	Expect(err).NotTo(HaveOccurred())
 
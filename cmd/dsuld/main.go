@@ -15,11 +15,24 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/akamensky/argparse"
+	"github.com/hymnis/dsul-go/internal/access"
+	"github.com/hymnis/dsul-go/internal/api"
+	"github.com/hymnis/dsul-go/internal/audit"
+	"github.com/hymnis/dsul-go/internal/certs"
+	"github.com/hymnis/dsul-go/internal/events"
+	"github.com/hymnis/dsul-go/internal/focus"
+	"github.com/hymnis/dsul-go/internal/history"
 	"github.com/hymnis/dsul-go/internal/ipc"
+	"github.com/hymnis/dsul-go/internal/notify"
+	"github.com/hymnis/dsul-go/internal/reload"
 	"github.com/hymnis/dsul-go/internal/serial"
 	"github.com/hymnis/dsul-go/internal/settings"
 )
@@ -35,8 +48,7 @@ var (
 // main runs the main loop and runners for serial handling and IPC.
 func main() {
 	// Get settings and arguments
-	cfg := settings.GetSettings()
-	handleArguments(cfg)
+	cfg, arguments := handleArguments()
 
 	output_handling := struct {
 		Verbose bool
@@ -47,16 +59,31 @@ func main() {
 	}
 
 	// Start runners
-	cmd_channel := make(chan string) // commands to serial device
-	rsp_channel := make(chan string) // response from serial device
-	go serial.Runner(cfg, output_handling, cmd_channel, rsp_channel)
-	go ipc.ServerRunner(cfg, output_handling, cmd_channel, rsp_channel)
+	cmd_channel := make(chan serial.Command)           // commands to serial device
+	overlay_channel := make(chan serial.Command)       // commands to serial device, from notification overlays
+	focus_channel := make(chan focus.Command)          // commands to focus timer
+	notify_channel := make(chan notify.Command)        // commands to notification handler
+	event_channel := make(chan events.Event, 64)       // state events, published to subscribers
+	subscriber_channel := make(chan events.Subscriber) // (un)subscription of event streams
+	guard := access.New(cfg)                           // access lists and bans, shared by IPC and HTTP API
+	audit_log := openAuditLog(cfg)                     // records commands, shared by serial, IPC and HTTP API
+	state_history := openHistory(cfg)                  // applied states, recorded by serial and listed by IPC
+	go events.Runner(output_handling, event_channel, subscriber_channel)
+	go serial.Runner(cfg, output_handling, audit_log, state_history, cmd_channel, overlay_channel, event_channel)
+	go focus.Runner(cfg, output_handling, focus_channel, cmd_channel)
+	go notify.Runner(cfg, output_handling, notify_channel, overlay_channel)
+	go ipc.ServerRunner(cfg, output_handling, guard, audit_log, state_history, cmd_channel, focus_channel, notify_channel, subscriber_channel)
+	if cfg.Network.HttpListen {
+		go api.Runner(cfg, output_handling, guard, audit_log, cmd_channel, subscriber_channel)
+	}
+	go reload.Runner(cfg, output_handling, arguments, cmd_channel) // reload settings on change or SIGHUP
 
 	select {} // run until user exits
 }
 
-// handleArguments parses command line arguments and performs actions based on them.
-func handleArguments(cfg *settings.Config) {
+// handleArguments parses command line arguments, gets the settings and performs actions based on them.
+// Returns the settings and the change made by the arguments, so it can be applied to reloaded settings.
+func handleArguments() (*settings.Config, settings.Change) {
 	// Parse arguments
 	parser := argparse.NewParser("dsuld", "Disturb State USB Light - Daemon")
 
@@ -78,6 +105,12 @@ func handleArguments(cfg *settings.Config) {
 	arg_network := parser.Flag("n", "network", &argparse.Options{
 		Required: false,
 		Help:     "Enable network mode"})
+	arg_address := parser.String("", "address", &argparse.Options{
+		Required: false,
+		Help:     "Listen on given IP address in network mode (default: all interfaces)"})
+	arg_http := parser.Flag("", "http", &argparse.Options{
+		Required: false,
+		Help:     "Enable HTTP API"})
 	arg_password := parser.String("p", "password", &argparse.Options{
 		Required: false,
 		Validate: func(args []string) error {
@@ -88,7 +121,13 @@ func handleArguments(cfg *settings.Config) {
 			}
 			return errors.New("password can't be empty")
 		},
-		Help: "Set password"})
+		Help: "Set password (visible to other users, prefer --password-file)"})
+	arg_password_file := parser.String("", "password-file", &argparse.Options{
+		Required: false,
+		Help:     "Read password from given file"})
+	arg_config := parser.String("", "config", &argparse.Options{
+		Required: false,
+		Help:     "Use given config file, instead of the user's config file"})
 	arg_version := parser.Flag("v", "version", &argparse.Options{
 		Required: false,
 		Help:     "Show version"})
@@ -99,6 +138,21 @@ func handleArguments(cfg *settings.Config) {
 		Required: false,
 		Help:     "Show debug output"})
 
+	cmd_config := parser.NewCommand("config", "Show configuration")
+	cmd_config_dump := cmd_config.NewCommand("dump", "Show the effective settings and where each came from")
+	cmd_tls := parser.NewCommand("tls", "Manage TLS certificates")
+	cmd_tls_init := cmd_tls.NewCommand("init", "Create a CA, server certificate and client certificate")
+	arg_tls_directory := cmd_tls_init.String("", "directory", &argparse.Options{
+		Required: false,
+		Help:     "Directory to create the certificates in (default: tls, next to the config file)"})
+	arg_tls_hosts := cmd_tls_init.StringList("", "host", &argparse.Options{
+		Required: false,
+		Help:     "Host name or IP the server certificate is valid for, can be repeated (default: localhost and this host)"})
+	arg_tls_client := cmd_tls_init.String("", "client", &argparse.Options{
+		Required: false,
+		Default:  "client",
+		Help:     "Name of the client certificate"})
+
 	err := parser.Parse(os.Args)
 	if err != nil {
 		// This can also be done by passing -h or --help
@@ -120,28 +174,146 @@ func handleArguments(cfg *settings.Config) {
 		fmt.Printf("dsuld v%s\n", version)
 		os.Exit(0)
 	}
-	if *arg_comport != "" {
+	if *arg_config != "" {
 		if verbose {
-			log.Printf("[dsuld] Set COM port: %v\n", *arg_comport)
+			log.Printf("[dsuld] Using config file: %v\n", *arg_config)
 		}
-		cfg.Serial.Port = *arg_comport
+		settings.SetConfigPath(*arg_config)
 	}
-	if *arg_baudrate > 0 {
-		if verbose {
-			log.Printf("[dsuld] Set COM port baudrate: %d\n", *arg_baudrate)
+	arguments := func(cfg *settings.Config) error {
+		if *arg_comport != "" {
+			cfg.Serial.Port = *arg_comport
+		}
+		if *arg_baudrate > 0 {
+			cfg.Serial.Baudrate = *arg_baudrate
+		}
+		if *arg_network {
+			cfg.Network.Listen = *arg_network
+		}
+		if *arg_address != "" {
+			cfg.Network.Address = *arg_address
 		}
-		cfg.Serial.Baudrate = *arg_baudrate
+		if *arg_http {
+			cfg.Network.HttpListen = *arg_http
+		}
+		if *arg_password != "" {
+			cfg.Password = *arg_password
+		}
+		if *arg_password_file != "" {
+			cfg.PasswordFile = *arg_password_file
+		}
+		return nil
 	}
-	if *arg_network {
-		if verbose {
-			log.Printf("[dsuld] Using network mode. Listening on port: %d\n", cfg.Network.Port)
+	if cmd_config_dump.Happened() {
+		showSettings(arguments)
+		os.Exit(0)
+	}
+	if cmd_tls_init.Happened() {
+		initTLS(*arg_tls_directory, *arg_tls_hosts, *arg_tls_client)
+		os.Exit(0)
+	}
+
+	cfg, err := settings.LoadValidSettings(arguments)
+	if err != nil {
+		log.Println("[dsuld] Invalid configuration, fix these problems and start again:")
+		for _, problem := range settings.GetProblems(err) {
+			log.Printf("[dsuld] - %s\n", problem)
 		}
-		cfg.Network.Listen = *arg_network
+		os.Exit(1)
 	}
-	if *arg_password != "" {
-		if verbose {
+	if verbose {
+		if *arg_comport != "" {
+			log.Printf("[dsuld] Set COM port: %v\n", *arg_comport)
+		}
+		if *arg_baudrate > 0 {
+			log.Printf("[dsuld] Set COM port baudrate: %d\n", *arg_baudrate)
+		}
+		if *arg_network {
+			log.Printf("[dsuld] Using network mode. Listening on: %s\n", net.JoinHostPort(cfg.Network.Address, strconv.Itoa(cfg.Network.Port)))
+		}
+		if *arg_http {
+			log.Printf("[dsuld] Using HTTP API. Listening on: %s:%d\n", cfg.Network.HttpAddress, cfg.Network.HttpPort)
+		}
+		if *arg_password != "" || *arg_password_file != "" {
 			log.Print("[dsuld] Using password authentication.\n")
 		}
-		cfg.Password = *arg_password
+		if cfg.Socket.Path != "" {
+			log.Printf("[dsuld] Using socket: %s\n", cfg.Socket.Path)
+		}
+		if cfg.Network.Listen && cfg.Tls.Enabled {
+			log.Print("[dsuld] Using TLS for network mode.\n")
+		}
+	}
+
+	return &cfg, arguments
+}
+
+// openAuditLog opens the audit log, if it's enabled. The daemon runs without it if it can't be opened.
+func openAuditLog(cfg *settings.Config) *audit.Log {
+	audit_log, err := audit.Open(cfg)
+	if err != nil {
+		log.Printf("[dsuld] Unable to open audit log %s, commands aren't recorded: %v\n", audit.GetPath(cfg), err)
+		return nil
+	}
+	if verbose && audit_log != nil {
+		log.Printf("[dsuld] Using audit log: %s\n", audit_log.Path())
+	}
+	return audit_log
+}
+
+// openHistory loads the state history, if it's enabled.
+func openHistory(cfg *settings.Config) *history.History {
+	state_history := history.Open(cfg)
+	if verbose && state_history != nil {
+		log.Printf("[dsuld] Using state history: %s\n", state_history.Path())
+	}
+	return state_history
+}
+
+// showSettings prints the effective settings, with the config file, environment variable or arguments they came from.
+func showSettings(arguments settings.Change) {
+	cfg, sources, err := settings.LoadLayers()
+	if err == nil {
+		err = settings.ApplyArguments(&cfg, sources, arguments)
+	}
+	if err != nil {
+		log.Fatalln("Failed to load the DSUL configuration: ", err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, setting := range settings.Dump(&cfg, sources) {
+		fmt.Fprintf(writer, "%s\t%s\t(%s)\n", setting.Key, setting.Value, setting.Source)
+	}
+	writer.Flush()
+}
+
+// initTLS creates certificates for network mode and prints the settings to use them.
+func initTLS(directory string, hosts []string, client_name string) {
+	if directory == "" {
+		directory = filepath.Join(filepath.Dir(settings.ConfigPath()), "tls")
+	}
+	if len(hosts) == 0 {
+		hosts = certs.DefaultHosts()
+	}
+	files, err := certs.Init(directory, hosts, client_name)
+	if err != nil {
+		log.Fatalln("Failed to create certificates: ", err)
+	}
+
+	if files.ReusedCA {
+		fmt.Printf("Using existing CA:       %s\n", files.CA)
+	} else {
+		fmt.Printf("Created CA:              %s\n", files.CA)
+	}
+	if files.ServerKept {
+		fmt.Printf("Using server cert:       %s\n", files.Server)
+	} else {
+		fmt.Printf("Created server cert:     %s (%s)\n", files.Server, strings.Join(hosts, ", "))
 	}
+	fmt.Printf("Created client cert:     %s\n", files.Client)
+	fmt.Printf("Server pin:              %s\n", files.ServerPin)
+	fmt.Printf("\nServer settings (dsuld):\n")
+	fmt.Printf("tls:\n  enabled: true\n  cert: %s\n  key: %s\n  clientca: %s\n", files.Server, files.ServerKey, files.CA)
+	fmt.Printf("\nClient settings (dsulc), copy the CA and client files to the client:\n")
+	fmt.Printf("tls:\n  enabled: true\n  ca: %s\n  cert: %s\n  key: %s\n  pin: %s\n", files.CA, files.Client, files.ClientKey, files.ServerPin)
 }
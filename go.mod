@@ -3,18 +3,18 @@ module github.com/hymnis/dsul-go
 go 1.18
 
 require (
+	github.com/Microsoft/go-winio v0.4.16
 	github.com/akamensky/argparse v1.3.1
 	github.com/andlabs/ui v0.0.0-20200610043537-70a69d6ae31e
-	github.com/hymnis/golang-ipc v1.1.3
 	github.com/onsi/ginkgo/v2 v2.9.5
 	github.com/onsi/gomega v1.27.6
-	github.com/tucnak/store v0.0.0-20170905113834-b02ecdcc6dfb
 	go.bug.st/serial v1.3.3
+	golang.org/x/net v0.10.0
+	golang.org/x/sys v0.8.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/BurntSushi/toml v0.3.1 // indirect
-	github.com/Microsoft/go-winio v0.4.16 // indirect
 	github.com/creack/goselect v0.1.2 // indirect
 	github.com/go-logr/logr v1.2.4 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
@@ -22,12 +22,9 @@ require (
 	github.com/google/go-cmp v0.5.9 // indirect
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/kr/pretty v0.1.0 // indirect
-	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
 	golang.org/x/tools v0.9.1 // indirect
 	google.golang.org/protobuf v1.28.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,156 @@
+// DSUL - Disturb State USB Light : Access module
+package access
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+// Peers are checked against the allow and deny lists (access.allow and access.deny, IPs or CIDRs), a peer matching
+// the deny list is never allowed and, if the allow list is set, only peers matching it are allowed.
+// A peer failing to authenticate access.maxfailures times (within access.bantime) is banned for access.bantime.
+// The settings are read on each check, so reloaded settings are used right away.
+
+// Guard holds the failed authentications and bans of peers. A nil guard allows all peers.
+type Guard struct {
+	cfg   *settings.Config
+	lock  sync.Mutex
+	peers map[string]*peer
+	now   func() time.Time
+}
+
+// peer holds the failed authentications of a peer, since the first one, and when its ban ends.
+type peer struct {
+	failures   int
+	first      time.Time
+	ban_expiry time.Time
+}
+
+// New returns a guard using the access settings of the configuration.
+func New(cfg *settings.Config) *Guard {
+	return &Guard{cfg: cfg, peers: map[string]*peer{}, now: time.Now}
+}
+
+// Allowed returns true if the peer (given as an address, e.g. "192.168.1.10:52314") is allowed by the allow and deny lists.
+func (g *Guard) Allowed(address string) bool {
+	if g == nil {
+		return true
+	}
+	cfg := settings.Snapshot(g.cfg)
+	ip := net.ParseIP(GetHost(address))
+	if ip != nil && matches(cfg.Access.Deny, ip) {
+		return false
+	}
+	if len(cfg.Access.Allow) == 0 {
+		return true
+	}
+	return ip != nil && matches(cfg.Access.Allow, ip)
+}
+
+// Banned returns the time left of the peer's ban, if it's banned.
+func (g *Guard) Banned(address string) (time.Duration, bool) {
+	if g == nil {
+		return 0, false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	p, ok := g.peers[GetHost(address)]
+	if !ok || !g.now().Before(p.ban_expiry) {
+		return 0, false
+	}
+	return p.ban_expiry.Sub(g.now()).Round(time.Second), true
+}
+
+// Failed records a failed authentication by the peer. It returns the ban time if the peer is banned because of it.
+func (g *Guard) Failed(address string) (time.Duration, bool) {
+	if g == nil {
+		return 0, false
+	}
+	cfg := settings.Snapshot(g.cfg)
+	if cfg.Access.MaxFailures < 1 {
+		return 0, false
+	}
+	ban_time, err := time.ParseDuration(cfg.Access.BanTime)
+	if err != nil || ban_time <= 0 {
+		return 0, false
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := g.now()
+	g.prune(now, ban_time)
+	host := GetHost(address)
+	p, ok := g.peers[host]
+	if !ok || now.Sub(p.first) > ban_time {
+		p = &peer{first: now}
+		g.peers[host] = p
+	}
+	p.failures += 1
+	if p.failures < cfg.Access.MaxFailures {
+		return 0, false
+	}
+	p.failures = 0
+	p.first = now
+	p.ban_expiry = now.Add(ban_time)
+	return ban_time, true
+}
+
+// Succeeded forgets the failed authentications of the peer, a ban isn't lifted.
+func (g *Guard) Succeeded(address string) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if p, ok := g.peers[GetHost(address)]; ok {
+		p.failures = 0
+	}
+}
+
+// prune forgets peers that aren't banned and haven't failed to authenticate within the ban time.
+func (g *Guard) prune(now time.Time, ban_time time.Duration) {
+	for host, p := range g.peers {
+		if !now.Before(p.ban_expiry) && now.Sub(p.first) > ban_time {
+			delete(g.peers, host)
+		}
+	}
+}
+
+// GetHost returns the host of the address, without the port.
+func GetHost(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// ParseNetwork returns the network of an allow or deny list entry, given as an IP or CIDR.
+func ParseNetwork(entry string) (*net.IPNet, bool) {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, false
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+	}
+	_, network, err := net.ParseCIDR(entry)
+	return network, err == nil
+}
+
+// matches returns true if the IP is in any of the networks in the list.
+func matches(list []string, ip net.IP) bool {
+	for _, entry := range list {
+		if network, ok := ParseNetwork(entry); ok && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
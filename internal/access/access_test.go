@@ -0,0 +1,111 @@
+// DSUL - Disturb State USB Light : Access module tests.
+package access
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		allow   []string
+		deny    []string
+		address string
+		want    bool
+	}{
+		{nil, nil, "203.0.113.7:52314", true},
+		{[]string{"192.168.1.0/24"}, nil, "192.168.1.10:52314", true},
+		{[]string{"192.168.1.0/24"}, nil, "192.168.2.10:52314", false},
+		{[]string{"192.168.1.0/24", "127.0.0.1"}, nil, "127.0.0.1:52314", true},
+		{[]string{"192.168.1.0/24"}, []string{"192.168.1.13"}, "192.168.1.13:52314", false},
+		{nil, []string{"10.0.0.0/8"}, "10.1.2.3:52314", false},
+		{nil, []string{"10.0.0.0/8"}, "[::ffff:10.1.2.3]:52314", false},
+		{[]string{"fd00::/8"}, nil, "[fd00::1]:52314", true},
+		{[]string{"fd00::/8"}, nil, "[::1]:52314", false},
+		{[]string{"192.168.1.0/24"}, nil, "pipe", false},
+	}
+	for _, test := range tests {
+		cfg := settings.Config{Access: settings.Access{Allow: test.allow, Deny: test.deny}}
+		if got := New(&cfg).Allowed(test.address); got != test.want {
+			t.Errorf("Wrong(%v/%v, %s) == %v, want %v", test.allow, test.deny, test.address, got, test.want)
+		}
+	}
+
+	var guard *Guard
+	if !guard.Allowed("203.0.113.7:52314") {
+		t.Errorf("Wrong(nil guard) == false, want true")
+	}
+}
+
+func TestFailed(t *testing.T) {
+	cfg := settings.Config{Access: settings.Access{MaxFailures: 3, BanTime: "10m"}}
+	guard := New(&cfg)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	guard.now = func() time.Time { return now }
+	peer, other := "192.168.1.10:52314", "192.168.1.11:52314"
+
+	tests := []struct {
+		name    string
+		address string
+		elapsed time.Duration // since the previous step
+		success bool
+		want    bool // banned after the step
+	}{
+		{"first failure", peer, 0, false, false},
+		{"second failure", peer, time.Minute, false, false},
+		{"success forgets failures", peer, time.Minute, true, false},
+		{"failure after success", peer, time.Minute, false, false},
+		{"other peer", other, time.Minute, false, false},
+		{"second failure after success", peer, time.Minute, false, false},
+		{"third failure bans", peer, time.Minute, false, true},
+		{"other peer isn't banned", other, 0, false, false},
+		{"ban isn't lifted by success", peer, time.Minute, true, true},
+		{"ban ends", peer, time.Minute * 10, true, false},
+		{"failures outside ban time are forgotten", other, time.Minute * 10, false, false},
+	}
+	for _, test := range tests {
+		now = now.Add(test.elapsed)
+		if test.success {
+			guard.Succeeded(test.address)
+		} else {
+			guard.Failed(test.address)
+		}
+		if _, got := guard.Banned(test.address); got != test.want {
+			t.Errorf("Wrong(%s) == %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// Bans are disabled without max failures
+	cfg.Access.MaxFailures = 0
+	for i := 0; i < 5; i++ {
+		guard.Failed(other)
+	}
+	if _, got := guard.Banned(other); got {
+		t.Errorf("Wrong(max failures 0) == %v, want %v", got, false)
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string // network, empty if not valid
+	}{
+		{"192.168.1.0/24", "192.168.1.0/24"},
+		{"192.168.1.13", "192.168.1.13/32"},
+		{"fd00::/8", "fd00::/8"},
+		{"::1", "::1/128"},
+		{"192.168.1.0/33", ""},
+		{"office", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if network, ok := ParseNetwork(test.entry); ok {
+			got = network.String()
+		}
+		if got != test.want {
+			t.Errorf("Wrong(%q) == %q, want %q", test.entry, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+// DSUL - Disturb State USB Light : API module
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/access"
+	"github.com/hymnis/dsul-go/internal/audit"
+	"github.com/hymnis/dsul-go/internal/events"
+	"github.com/hymnis/dsul-go/internal/serial"
+	"github.com/hymnis/dsul-go/internal/settings"
+	"github.com/hymnis/dsul-go/internal/tokens"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	verbose bool = false
+	debug   bool = false
+)
+
+// State holds the values that can be set through the API. Values that are not given are left as is.
+type State struct {
+	Color      *string `json:"color,omitempty"`
+	Brightness *int    `json:"brightness,omitempty"`
+	Mode       *string `json:"mode,omitempty"`
+	Dim        *bool   `json:"dim,omitempty"`
+}
+
+// Error is returned when a request fails.
+type Error struct {
+	Error string `json:"error"`
+}
+
+// server holds what's needed to handle API requests.
+type server struct {
+	cfg                *settings.Config // shared, read through settings.Snapshot
+	cmd_channel        chan serial.Command
+	subscriber_channel chan events.Subscriber
+	guard              *access.Guard
+	audit_log          *audit.Log
+	steps              uint64 // requests setting values, each one is a step in the state history
+}
+
+// identityKey is the context key of the identity of the client sending a request.
+type identityKey struct{}
+
+// Runner parts //
+
+// Runner starts the HTTP server for the REST API. Peers are checked by the guard.
+// Changes and rejected requests are recorded in the audit log, clients may identify themselves with the X-DSUL-Client header.
+func Runner(cfg *settings.Config, output_handling struct {
+	Verbose bool
+	Debug   bool
+}, guard *access.Guard, audit_log *audit.Log, cmd_channel chan serial.Command, subscriber_channel chan events.Subscriber) {
+	verbose = output_handling.Verbose
+	debug = output_handling.Debug
+
+	s := server{cfg: cfg, cmd_channel: cmd_channel, subscriber_channel: subscriber_channel, guard: guard, audit_log: audit_log}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/api/state", s.authenticate(s.handleState))
+	mux.HandleFunc("/api/colors", s.authenticate(s.handleColors))
+	mux.HandleFunc("/api/modes", s.authenticate(s.handleModes))
+	mux.HandleFunc("/api/events", s.authenticate(s.handleEvents))
+	mux.HandleFunc("/api/events/ws", s.authenticate(websocket.Server{
+		Handshake: s.checkOrigin,
+		Handler:   s.handleEventsSocket,
+	}.ServeHTTP))
+
+	address := net.JoinHostPort(cfg.Network.HttpAddress, strconv.Itoa(cfg.Network.HttpPort))
+	httpd := &http.Server{
+		Addr:              address,
+		Handler:           s.checkPeer(mux),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	if verbose {
+		log.Printf("[api] Listening on: %s\n", address)
+	}
+	if err := httpd.ListenAndServe(); err != nil {
+		log.Println("[api] Error: " + err.Error())
+	}
+}
+
+// checkPeer wraps a handler and only calls it if the peer is allowed (by the allow and deny lists) and isn't banned.
+func (s *server) checkPeer(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.guard.Allowed(r.RemoteAddr) {
+			log.Printf("[api] Request from %s rejected, not allowed by access.allow/access.deny\n", r.RemoteAddr)
+			s.record(r, "forbidden", "not allowed by access.allow/access.deny")
+			writeError(w, http.StatusForbidden, "not allowed")
+			return
+		}
+		if ban_left, banned := s.guard.Banned(r.RemoteAddr); banned {
+			message := fmt.Sprintf("too many failed authentications, try again in %s", ban_left)
+			s.record(r, "auth_failed", message)
+			w.Header().Set("Retry-After", strconv.Itoa(int(ban_left.Seconds())))
+			writeError(w, http.StatusTooManyRequests, message)
+			return
+		}
+		identity := audit.Identity{Peer: r.RemoteAddr, Client: r.Header.Get("X-DSUL-Client")}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+// authenticate wraps a handler and only calls it if the request is authenticated.
+// If a password (or tokens) is set, the password or a token must be given as a bearer token ("Authorization: Bearer <token>")
+// or, for clients that can't set headers (e.g. browsers using EventSource or WebSocket), as the "token" query parameter.
+// Tokens are only allowed the operations of their role: get (GET), set (changing the state) or subscribe (events).
+func (s *server) authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := settings.Snapshot(s.cfg)
+		if cfg.Password != "" || len(cfg.Tokens) > 0 {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" {
+				token = r.URL.Query().Get("token")
+			}
+			identity := getIdentity(r)
+			identity.Auth = "password"
+			if cfg.Password == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Password)) != 1 {
+				cfg_token, err := tokens.Verify(cfg, token)
+				if err != nil {
+					log.Printf("[api] Authentication failed for %s\n", r.RemoteAddr)
+					if ban_time, banned := s.guard.Failed(r.RemoteAddr); banned {
+						log.Printf("[api] Banned %s for %s, after %d failed authentications\n", access.GetHost(r.RemoteAddr), ban_time, cfg.Access.MaxFailures)
+					}
+					s.record(r, "auth_failed", "authentication failed")
+					w.Header().Set("WWW-Authenticate", `Bearer realm="dsul"`)
+					writeError(w, http.StatusUnauthorized, "authentication failed")
+					return
+				}
+				identity.Auth = "token " + cfg_token.Name
+				r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+				if operation := getOperation(r); !tokens.Allows(cfg_token, operation) {
+					log.Printf("[api] Request from %s denied, token '%s' (%s) isn't allowed to: %s\n", r.RemoteAddr, cfg_token.Name, cfg_token.Role, operation)
+					message := fmt.Sprintf("token '%s' (%s) isn't allowed to: %s", cfg_token.Name, cfg_token.Role, operation)
+					s.record(r, "forbidden", message)
+					writeError(w, http.StatusForbidden, message)
+					return
+				}
+			}
+			s.guard.Succeeded(r.RemoteAddr)
+			r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+		}
+		handler(w, r)
+	}
+}
+
+// getIdentity returns the identity of the client sending the request.
+func getIdentity(r *http.Request) audit.Identity {
+	identity, ok := r.Context().Value(identityKey{}).(audit.Identity)
+	if !ok {
+		return audit.Identity{Peer: r.RemoteAddr, Client: r.Header.Get("X-DSUL-Client")}
+	}
+	return identity
+}
+
+// record records a rejected request in the audit log, with the error code (same as in IPC responses) and message.
+// Accepted changes are recorded by the serial module, with the previous value.
+func (s *server) record(r *http.Request, result string, message string) {
+	entry := audit.Entry{Source: "http", Identity: getIdentity(r), Op: getOperation(r), Key: r.Method + " " + r.URL.Path, Result: result, Message: message}
+	s.audit_log.Record(entry)
+}
+
+// getOperation returns the operation a token must allow for the request: subscribe (events), set (changing the state) or get.
+func getOperation(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/api/events") {
+		return "subscribe"
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "set"
+	}
+	return "get"
+}
+
+// handleHealth returns the health of the daemon and if the device responds.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	device := serial.Send(s.cmd_channel, "http", "ping", "") == "ok"
+	if !device {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "device": device})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "device": device})
+}
+
+// handleState returns the current state and hardware information, or sets new values.
+func (s *server) handleState(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.writeState(w)
+	case http.MethodPut, http.MethodPatch, http.MethodPost:
+		// Only JSON is accepted, so web pages can't change the state with a form or a simple (not preflighted) request
+		if media_type, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || media_type != "application/json" {
+			s.record(r, "invalid_request", "content type must be application/json")
+			writeError(w, http.StatusUnsupportedMediaType, "content type must be application/json")
+			return
+		}
+		state := State{}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&state); err != nil {
+			s.record(r, "invalid_request", "invalid request: "+err.Error())
+			writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return
+		}
+		commands, err := getCommands(state, settings.Snapshot(s.cfg))
+		if err != nil {
+			s.record(r, "invalid_value", err.Error())
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		step := fmt.Sprintf("http #%d", atomic.AddUint64(&s.steps, 1))
+		for _, command := range commands {
+			if debug {
+				log.Printf("[api] Set %s: %s\n", command.Key, command.Value)
+			}
+			if serial.SendAs(s.cmd_channel, "http", getIdentity(r), step, command.Key, command.Value) != "ok" {
+				writeError(w, http.StatusBadGateway, fmt.Sprintf("device rejected %s: '%s'", command.Key, command.Value))
+				return
+			}
+		}
+		s.writeState(w)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleColors returns the configured colors.
+func (s *server) handleColors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	colors := []map[string]string{}
+	for _, cfg_color := range settings.Snapshot(s.cfg).Colors {
+		colors = append(colors, map[string]string{"name": cfg_color.Name, "value": cfg_color.Value})
+	}
+	writeJSON(w, http.StatusOK, colors)
+}
+
+// handleModes returns the configured modes.
+func (s *server) handleModes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	modes := []map[string]interface{}{}
+	for _, cfg_mode := range settings.Snapshot(s.cfg).Modes {
+		modes = append(modes, map[string]interface{}{"name": cfg_mode.Name, "value": cfg_mode.Value})
+	}
+	writeJSON(w, http.StatusOK, modes)
+}
+
+// handleEvents sends all events to the client as Server-Sent Events, until it disconnects.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	subscription := events.Subscribe(s.subscriber_channel)
+	defer events.Unsubscribe(s.subscriber_channel, subscription)
+	keepalive := time.NewTicker(time.Second * 30)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case e := <-subscription:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, e)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleEventsSocket sends all events to the client as WebSocket (JSON) messages, until it disconnects.
+func (s *server) handleEventsSocket(ws *websocket.Conn) {
+	subscription := events.Subscribe(s.subscriber_channel)
+	defer events.Unsubscribe(s.subscriber_channel, subscription)
+
+	closed := make(chan bool)
+	go func() {
+		_, _ = io.Copy(io.Discard, ws) // messages from the client are ignored
+		close(closed)
+	}()
+
+	for {
+		select {
+		case e := <-subscription:
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// checkOrigin rejects WebSocket handshakes from web pages on other origins (any page the user visits could otherwise
+// subscribe to the events), unless the origin is in network.httporigins. Clients without an Origin (not browsers) are allowed.
+func (s *server) checkOrigin(_ *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, r.Host) {
+		return nil
+	}
+	for _, allowed := range settings.Snapshot(s.cfg).Network.HttpOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return nil
+		}
+	}
+	log.Printf("[api] WebSocket from %s rejected, origin %s isn't allowed by network.httporigins\n", r.RemoteAddr, origin)
+	s.record(r, "forbidden", "origin isn't allowed: "+origin)
+	return fmt.Errorf("origin isn't allowed: %s", origin)
+}
+
+// writeState requests the hardware information from the device and writes it as a response.
+func (s *server) writeState(w http.ResponseWriter) {
+	hardware_state := settings.ParseHardwareInformation(serial.Send(s.cmd_channel, "http", "information", "all"))
+	if hardware_state.Version == "" {
+		writeError(w, http.StatusBadGateway, "device did not respond")
+		return
+	}
+	writeJSON(w, http.StatusOK, hardware_state)
+}
+
+// getCommands validates the given state and returns the serial commands needed to set it.
+// Commands are returned in the same order as dsulc sends them.
+func getCommands(state State, cfg *settings.Config) ([]serial.Command, error) {
+	var commands []serial.Command
+
+	if state.Mode != nil {
+		if _, ok := serial.GetModeString(getModeValue(*state.Mode, cfg), cfg); !ok {
+			return nil, fmt.Errorf("mode given is not supported: '%s'", *state.Mode)
+		}
+		commands = append(commands, serial.Command{Key: "mode", Value: *state.Mode})
+	}
+	if state.Brightness != nil {
+		value := strconv.Itoa(*state.Brightness)
+		if _, ok := serial.GetBrightnessString(value, cfg); !ok {
+			brightness_min, brightness_max := serial.GetBrightnessLimits(cfg)
+			return nil, fmt.Errorf("brightness must be between %d and %d", brightness_min, brightness_max)
+		}
+		commands = append(commands, serial.Command{Key: "brightness", Value: value})
+	}
+	if state.Dim != nil {
+		commands = append(commands, serial.Command{Key: "dim", Value: strconv.FormatBool(*state.Dim)})
+	}
+	if state.Color != nil {
+		if _, ok := serial.GetColorString(*state.Color, cfg); !ok {
+			return nil, fmt.Errorf("color given is not supported: '%s'", *state.Color)
+		}
+		commands = append(commands, serial.Command{Key: "color", Value: *state.Color})
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("no values given")
+	}
+
+	return commands, nil
+}
+
+// getModeValue returns the value of the configured mode with the given name.
+func getModeValue(name string, cfg *settings.Config) string {
+	for _, cfg_mode := range cfg.Modes {
+		if cfg_mode.Name == name {
+			return strconv.Itoa(cfg_mode.Value)
+		}
+	}
+	return ""
+}
+
+// writeJSON writes the given value as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("[api] Error: " + err.Error())
+	}
+}
+
+// writeError writes an error as a JSON response.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, Error{message})
+}
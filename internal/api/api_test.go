@@ -0,0 +1,222 @@
+// DSUL - Disturb State USB Light : API module tests.
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hymnis/dsul-go/internal/access"
+	"github.com/hymnis/dsul-go/internal/audit"
+	"github.com/hymnis/dsul-go/internal/serial"
+	"github.com/hymnis/dsul-go/internal/settings"
+	"github.com/hymnis/dsul-go/internal/tokens"
+)
+
+// testServer returns a server with a fake device, that answers all commands with "ok".
+func testServer(password string) *server {
+	cfg := settings.Config{
+		Colors:        []settings.Color{{Name: "red", Value: "255:0:0"}},
+		Modes:         []settings.Mode{{Name: "solid", Value: 1}},
+		BrightnessMin: 0,
+		BrightnessMax: 150,
+		Password:      password,
+	}
+	cmd_channel := make(chan serial.Command)
+	go func() {
+		for command := range cmd_channel {
+			if command.Key == "information" {
+				command.Response <- "+v001.002.003ll008lb000:150cc255000000cb100cm001cd0#"
+			} else {
+				command.Response <- "ok"
+			}
+		}
+	}()
+	return &server{cfg: &cfg, cmd_channel: cmd_channel}
+}
+
+func TestGetCommands(t *testing.T) {
+	cfg := testServer("").cfg
+	color, mode, brightness, dim := "red", "solid", 100, true
+	bad_color, bad_mode, bad_brightness := "nope", "nope", 200
+
+	commands, err := getCommands(State{Color: &color, Mode: &mode, Brightness: &brightness, Dim: &dim}, cfg)
+	want := []serial.Command{{Key: "mode", Value: "solid"}, {Key: "brightness", Value: "100"}, {Key: "dim", Value: "true"}, {Key: "color", Value: "red"}}
+	if err != nil || len(commands) != len(want) {
+		t.Fatalf("Wrong commands %v (%v), want %v", commands, err, want)
+	}
+	for i := range want {
+		if commands[i].Key != want[i].Key || commands[i].Value != want[i].Value {
+			t.Errorf("Wrong command %v, want %v", commands[i], want[i])
+		}
+	}
+
+	invalid := []State{{}, {Color: &bad_color}, {Mode: &bad_mode}, {Brightness: &bad_brightness}}
+	for _, state := range invalid {
+		if _, err := getCommands(state, cfg); err == nil {
+			t.Errorf("Wrong(%+v) accepted without error", state)
+		}
+	}
+}
+
+func TestHandleState(t *testing.T) {
+	s := testServer("secret")
+	cases := []struct {
+		method, body, token, content_type string
+		want                              int
+	}{
+		{http.MethodGet, "", "secret", "", http.StatusOK},
+		{http.MethodGet, "", "wrong", "", http.StatusUnauthorized},
+		{http.MethodPut, `{"color": "red", "brightness": 50}`, "secret", "application/json", http.StatusOK},
+		{http.MethodPost, `{"color": "red"}`, "secret", "application/json; charset=utf-8", http.StatusOK},
+		{http.MethodPut, `{"color": "nope"}`, "secret", "application/json", http.StatusBadRequest},
+		{http.MethodPut, `{"shade": "red"}`, "secret", "application/json", http.StatusBadRequest},
+		{http.MethodPost, `{"color": "red"}`, "secret", "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "color=red", "secret", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{http.MethodPut, `{"color": "red"}`, "secret", "", http.StatusUnsupportedMediaType},
+		{http.MethodDelete, "", "secret", "", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(c.method, "/api/state", strings.NewReader(c.body))
+		request.Header.Set("Authorization", "Bearer "+c.token)
+		request.Header.Set("Content-Type", c.content_type)
+		recorder := httptest.NewRecorder()
+		s.authenticate(s.handleState)(recorder, request)
+
+		if recorder.Code != c.want {
+			t.Errorf("Wrong(%s %q) == %d, want %d", c.method, c.body, recorder.Code, c.want)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	s := testServer("")
+	s.cfg.Network.HttpOrigins = []string{"https://dashboard.example.com/"}
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://127.0.0.1:9293", true},
+		{"https://dashboard.example.com", true},
+		{"https://evil.example.com", false},
+		{"http://127.0.0.1:8080", false},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:9293/api/events/ws", nil)
+		if c.origin != "" {
+			request.Header.Set("Origin", c.origin)
+		}
+		if out_value := s.checkOrigin(nil, request) == nil; out_value != c.want {
+			t.Errorf("Wrong(%q) == %v, want %v", c.origin, out_value, c.want)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	s := testServer("")
+	read_token, read_cfg, _ := tokens.New("dashboard", "read", nil)
+	control_token, control_cfg, _ := tokens.New("calendar", "control", nil)
+	s.cfg.Tokens = []settings.Token{read_cfg, control_cfg}
+	cases := []struct {
+		method, body, token string
+		want                int
+	}{
+		{http.MethodGet, "", read_token, http.StatusOK},
+		{http.MethodPut, `{"color": "red"}`, read_token, http.StatusForbidden},
+		{http.MethodGet, "", control_token, http.StatusOK},
+		{http.MethodPut, `{"color": "red"}`, control_token, http.StatusOK},
+		{http.MethodGet, "", "", http.StatusUnauthorized},
+		{http.MethodGet, "", read_token + "0", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(c.method, "/api/state", strings.NewReader(c.body))
+		request.Header.Set("Authorization", "Bearer "+c.token)
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		s.authenticate(s.handleState)(recorder, request)
+
+		if recorder.Code != c.want {
+			t.Errorf("Wrong(%s %q, %q) == %d, want %d", c.method, c.body, c.token, recorder.Code, c.want)
+		}
+	}
+}
+
+func TestCheckPeer(t *testing.T) {
+	s := testServer("secret")
+	s.cfg.Access = settings.Access{Allow: []string{"192.168.1.0/24"}, Deny: []string{"192.168.1.13"}, MaxFailures: 2, BanTime: "15m"}
+	s.guard = access.New(s.cfg)
+	handler := s.checkPeer(s.authenticate(s.handleState))
+	cases := []struct {
+		address, token string
+		want           int
+	}{
+		{"192.168.1.10:52314", "secret", http.StatusOK},
+		{"192.168.2.10:52314", "secret", http.StatusForbidden},
+		{"192.168.1.13:52314", "secret", http.StatusForbidden},
+		{"192.168.1.11:52314", "wrong", http.StatusUnauthorized},
+		{"192.168.1.11:52315", "wrong", http.StatusUnauthorized},
+		{"192.168.1.11:52316", "secret", http.StatusTooManyRequests},
+		{"192.168.1.10:52317", "secret", http.StatusOK},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodGet, "/api/state", nil)
+		request.RemoteAddr = c.address
+		request.Header.Set("Authorization", "Bearer "+c.token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.want {
+			t.Errorf("Wrong(%s, %q) == %d, want %d", c.address, c.token, recorder.Code, c.want)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	s := testServer("secret")
+	s.cfg.Audit = settings.Audit{Enabled: true, Path: filepath.Join(t.TempDir(), "audit.log")}
+	s.audit_log, _ = audit.Open(s.cfg)
+	identities := make(chan audit.Identity, 1)
+	cmd_channel := make(chan serial.Command)
+	go func(device chan serial.Command) {
+		for command := range cmd_channel {
+			if command.Key == "color" {
+				identities <- command.Identity
+			}
+			device <- command
+		}
+	}(s.cmd_channel)
+	s.cmd_channel = cmd_channel
+	handler := s.checkPeer(s.authenticate(s.handleState))
+
+	cases := []struct {
+		body, token string
+	}{
+		{`{"color": "red"}`, "secret"},
+		{`{"color": "red"}`, "wrong"},
+		{`{"color": "nope"}`, "secret"},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodPut, "/api/state", strings.NewReader(c.body))
+		request.RemoteAddr = "192.168.1.10:52314"
+		request.Header.Set("Authorization", "Bearer "+c.token)
+		request.Header.Set("X-DSUL-Client", "calendar-sync")
+		request.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	want := audit.Identity{Peer: "192.168.1.10:52314", Auth: "password", Client: "calendar-sync"}
+	if got := <-identities; got != want {
+		t.Errorf("Wrong(set identity) == %+v, want %+v", got, want)
+	}
+	entries, err := s.audit_log.Read(audit.Filter{})
+	results := []string{}
+	for _, entry := range entries {
+		results = append(results, entry.Result)
+	}
+	if err != nil || strings.Join(results, " ") != "auth_failed invalid_value" {
+		t.Errorf("Wrong(recorded) == %v (%v), want auth_failed and invalid_value", results, err)
+	}
+}
@@ -0,0 +1,218 @@
+// DSUL - Disturb State USB Light : Audit module
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+// The audit log records every command accepted or rejected by the daemon, one JSON entry per line.
+// It's only appended to, and rotated when it grows over audit.maxsize (MB): audit.log is moved to audit.log.1,
+// audit.log.1 to audit.log.2 and so on, keeping audit.maxfiles rotated logs.
+// Rotation settings are read on each entry, so reloaded settings are used right away.
+
+const maxLength = 256 // longest value (or client name) recorded, so clients can't fill the log with large requests
+
+// Identity describes who sent a command. Client is given by the client itself, so it isn't verified.
+type Identity struct {
+	Peer   string `json:"peer,omitempty" yaml:"peer,omitempty"`     // address of the client, or its user on the socket
+	Auth   string `json:"auth,omitempty" yaml:"auth,omitempty"`     // how the client was authenticated, e.g. "token calendar"
+	Client string `json:"client,omitempty" yaml:"client,omitempty"` // e.g. "alice@laptop"
+}
+
+// Entry is a command recorded in the audit log. Result is "ok", or the error code if the command was rejected.
+// Previous is the value before a state change.
+type Entry struct {
+	Time     time.Time `json:"time" yaml:"time"`
+	Source   string    `json:"source" yaml:"source"` // module handling the command: ipc, http, focus or notify
+	Identity `yaml:",inline"`
+	Op       string `json:"op" yaml:"op"`
+	Key      string `json:"key,omitempty" yaml:"key,omitempty"`
+	Value    string `json:"value,omitempty" yaml:"value,omitempty"`
+	Result   string `json:"result" yaml:"result"`
+	Message  string `json:"message,omitempty" yaml:"message,omitempty"`
+	Previous string `json:"previous,omitempty" yaml:"previous,omitempty"`
+}
+
+// Filter selects entries when reading the log. Only the last entries are read if a limit is set.
+type Filter struct {
+	Since  time.Time
+	Source string
+	Limit  int
+}
+
+// Log is an open audit log. A nil log doesn't record anything.
+type Log struct {
+	cfg  *settings.Config
+	path string
+	lock sync.Mutex
+	file *os.File
+	size int64
+	now  func() time.Time
+}
+
+// Open opens the audit log for appending, or returns nil if it isn't enabled.
+func Open(cfg *settings.Config) (*Log, error) {
+	if !cfg.Audit.Enabled {
+		return nil, nil
+	}
+	l := &Log{cfg: cfg, path: GetPath(cfg), now: time.Now}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// GetPath returns the path of the audit log, audit.log next to the config file if it isn't set.
+func GetPath(cfg *settings.Config) string {
+	if cfg.Audit.Path != "" {
+		return cfg.Audit.Path
+	}
+	return filepath.Join(filepath.Dir(settings.ConfigPath()), "audit.log")
+}
+
+// Path returns the path of the log.
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Record appends the entry to the log, rotating it first if it's full.
+func (l *Log) Record(entry Entry) {
+	if l == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = l.now().UTC()
+	}
+	entry.Value, entry.Client = shorten(entry.Value), shorten(entry.Client)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("[audit] Error: " + err.Error())
+		return
+	}
+	data = append(data, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	max_size := int64(settings.Snapshot(l.cfg).Audit.MaxSize) * 1024 * 1024
+	if max_size > 0 && l.size > 0 && l.size+int64(len(data)) > max_size {
+		if err := l.rotate(); err != nil {
+			log.Println("[audit] Unable to rotate log: " + err.Error())
+		}
+	}
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			log.Println("[audit] Unable to open log: " + err.Error())
+			return
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		log.Println("[audit] Unable to write log: " + err.Error())
+	}
+}
+
+// Read returns the entries of the log, and its rotated logs, matching the filter (oldest first).
+func (l *Log) Read(filter Filter) ([]Entry, error) {
+	if l == nil {
+		return nil, fmt.Errorf("audit log isn't enabled")
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entries := []Entry{}
+	for _, path := range l.getFiles() {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			entry := Entry{}
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue // skip lines cut short (e.g. by a full disk)
+			}
+			if entry.Time.Before(filter.Since) || (filter.Source != "" && entry.Source != filter.Source) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+// open opens (or creates) the log for appending.
+func (l *Log) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the log to the first rotated log (and those to the next), removing the oldest, and opens a new log.
+func (l *Log) rotate() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	max_files := settings.Snapshot(l.cfg).Audit.MaxFiles
+	_ = os.Remove(fmt.Sprintf("%s.%d", l.path, max_files))
+	for i := max_files - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if max_files > 0 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// getFiles returns the rotated logs and the log, oldest first.
+func (l *Log) getFiles() []string {
+	files := []string{}
+	for i := settings.Snapshot(l.cfg).Audit.MaxFiles; i >= 1; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", l.path, i))
+	}
+	return append(files, l.path)
+}
+
+// shorten returns the value, shortened to maxLength.
+func shorten(value string) string {
+	if len(value) > maxLength {
+		return value[:maxLength] + "..."
+	}
+	return value
+}
@@ -0,0 +1,112 @@
+// DSUL - Disturb State USB Light : Audit module tests.
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestRecord(t *testing.T) {
+	cfg := settings.Config{Audit: settings.Audit{Enabled: true, Path: filepath.Join(t.TempDir(), "logs", "audit.log"), MaxSize: 10, MaxFiles: 2}}
+	l, err := Open(&cfg)
+	if err != nil {
+		t.Fatalf("Wrong(Open) == %v, want no error", err)
+	}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	l.Record(Entry{Source: "ipc", Identity: Identity{Peer: "192.168.1.10:52314", Auth: "token calendar", Client: "alice@laptop"}, Op: "set", Key: "color", Value: "magenta", Result: "ok", Previous: "0:255:0"})
+	now = now.Add(time.Hour)
+	l.Record(Entry{Source: "http", Op: "set", Key: "PUT /api/state", Result: "auth_failed", Message: "authentication failed"})
+	now = now.Add(time.Hour)
+	l.Record(Entry{Source: "focus", Op: "set", Key: "color", Value: "red", Result: "ok", Previous: "255:0:50"})
+	l.Record(Entry{Source: "ipc", Op: "notify", Value: strings.Repeat("x", 1000), Result: "ok"})
+
+	if info, err := os.Stat(cfg.Audit.Path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Wrong(log mode) == %v (%v), want %v", info.Mode().Perm(), err, os.FileMode(0600))
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string // sources of the entries read
+	}{
+		{"all", Filter{}, []string{"ipc", "http", "focus", "ipc"}},
+		{"since", Filter{Since: now.Add(-time.Hour)}, []string{"http", "focus", "ipc"}},
+		{"source", Filter{Source: "ipc"}, []string{"ipc", "ipc"}},
+		{"limit", Filter{Limit: 2}, []string{"focus", "ipc"}},
+		{"nothing", Filter{Source: "reload"}, []string{}},
+	}
+	for _, test := range tests {
+		entries, err := l.Read(test.filter)
+		got := []string{}
+		for _, entry := range entries {
+			got = append(got, entry.Source)
+		}
+		if err != nil || strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("Wrong(%s) == %v (%v), want %v", test.name, got, err, test.want)
+		}
+	}
+
+	entries, _ := l.Read(Filter{})
+	if entries[0].Client != "alice@laptop" || entries[0].Previous != "0:255:0" || !entries[0].Time.Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("Wrong(first entry) == %+v", entries[0])
+	}
+	if len(entries[3].Value) != maxLength+3 {
+		t.Errorf("Wrong(long value) == %d bytes, want %d", len(entries[3].Value), maxLength+3)
+	}
+
+	var disabled *Log
+	disabled.Record(Entry{Source: "ipc"})
+	if _, err := disabled.Read(Filter{}); err == nil {
+		t.Errorf("Wrong(nil log) read without error")
+	}
+	cfg.Audit.Enabled = false
+	if l, err := Open(&cfg); l != nil || err != nil {
+		t.Errorf("Wrong(disabled) == %v (%v), want nil", l, err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	cfg := settings.Config{Audit: settings.Audit{Enabled: true, Path: path, MaxSize: 1, MaxFiles: 2}}
+	l, err := Open(&cfg)
+	if err != nil {
+		t.Fatalf("Wrong(Open) == %v, want no error", err)
+	}
+
+	for _, value := range []string{"red", "green", "blue", "yellow"} {
+		l.Record(Entry{Source: "ipc", Op: "set", Key: "color", Value: value, Result: "ok"})
+		l.size = 1024 * 1024 // full, so the next entry rotates the log
+	}
+
+	tests := []struct {
+		path string
+		want string // value of the entry in the file, empty if it shouldn't exist
+	}{
+		{path, "yellow"},
+		{path + ".1", "blue"},
+		{path + ".2", "green"},
+		{path + ".3", ""},
+	}
+	for _, test := range tests {
+		data, err := os.ReadFile(test.path)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("Wrong(%s) exists, want it removed", filepath.Base(test.path))
+			}
+		} else if !strings.Contains(string(data), `"value":"`+test.want+`"`) || strings.Count(string(data), "\n") != 1 {
+			t.Errorf("Wrong(%s) == %q (%v), want one entry with %s", filepath.Base(test.path), data, err, test.want)
+		}
+	}
+
+	entries, err := l.Read(Filter{})
+	if err != nil || len(entries) != 3 || entries[0].Value != "green" || entries[2].Value != "yellow" {
+		t.Errorf("Wrong(Read) == %+v (%v), want green, blue and yellow", entries, err)
+	}
+}
@@ -0,0 +1,102 @@
+// DSUL - Disturb State USB Light : Cache module
+package cache
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/ipc"
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+var (
+	applicationName = "dsul"
+	cacheName       = "palette.json"
+	now             = time.Now
+)
+
+// PaletteTTL is how long a cached palette is used to validate values, without asking the daemon for its palette.
+const PaletteTTL = time.Minute
+
+// entry is a cached palette and when it was cached.
+type entry struct {
+	Palette ipc.Palette `json:"palette"`
+	Saved   time.Time   `json:"saved"`
+}
+
+// Key returns the cache key of the daemon that's used: "local" or its network address.
+func Key(cfg *settings.Config) string {
+	if cfg.Network.Server != "" {
+		return net.JoinHostPort(cfg.Network.Server, strconv.Itoa(cfg.Network.Port))
+	}
+	return "local"
+}
+
+// LoadPalette returns the cached palette of the daemon with the given key, if there is one.
+func LoadPalette(key string) (ipc.Palette, bool) {
+	cached, ok := loadPalettes()[key]
+	return cached.Palette, ok
+}
+
+// LoadRecentPalette returns the cached palette of the daemon with the given key, if it was cached within PaletteTTL.
+func LoadRecentPalette(key string) (ipc.Palette, bool) {
+	cached, ok := loadPalettes()[key]
+	if !ok || now().Sub(cached.Saved) > PaletteTTL {
+		return ipc.Palette{}, false
+	}
+	return cached.Palette, true
+}
+
+// SavePalette caches the palette of the daemon with the given key.
+func SavePalette(key string, palette ipc.Palette) error {
+	palettes := loadPalettes()
+	palettes[key] = entry{Palette: palette, Saved: now().UTC()}
+
+	path, err := buildPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(palettes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// loadPalettes returns all cached palettes, by key. Palettes cached without a time (by older versions) are ignored.
+func loadPalettes() map[string]entry {
+	palettes := make(map[string]entry)
+	path, err := buildPath()
+	if err != nil {
+		return palettes
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return palettes
+	}
+	if err := json.Unmarshal(data, &palettes); err != nil {
+		return make(map[string]entry) // ignore a broken cache, it's replaced on the next save
+	}
+	for key, cached := range palettes {
+		if cached.Saved.IsZero() {
+			delete(palettes, key)
+		}
+	}
+	return palettes
+}
+
+// buildPath returns the path to the cache file, in the user's cache directory.
+func buildPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, applicationName, cacheName), nil
+}
@@ -0,0 +1,99 @@
+// DSUL - Disturb State USB Light : Cache module tests.
+package cache
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/ipc"
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		in_value settings.Network
+		want     string
+	}{
+		{settings.Network{Port: 9292}, "local"},
+		{settings.Network{Server: "10.0.0.2", Port: 9292}, "10.0.0.2:9292"},
+		{settings.Network{Server: "::1", Port: 9292}, "[::1]:9292"},
+	}
+
+	for _, test := range tests {
+		if out_value := Key(&settings.Config{Network: test.in_value}); out_value != test.want {
+			t.Errorf("Wrong(%+v) == %q, want %q", test.in_value, out_value, test.want)
+		}
+	}
+}
+
+func TestPalette(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("LocalAppData", dir)
+	local := ipc.Palette{Colors: []ipc.PaletteColor{{Name: "red", Value: "255:0:0"}}, Modes: []string{"solid"}, States: []ipc.PaletteState{}, BrightnessMax: 150}
+	remote := ipc.Palette{Colors: []ipc.PaletteColor{{Name: "warm-white", Value: "255:230:200"}}, Modes: []string{}, States: []ipc.PaletteState{}, BrightnessMax: 100}
+
+	if _, ok := LoadPalette("local"); ok {
+		t.Fatalf("Wrong(local) found palette in empty cache")
+	}
+	if err := SavePalette("local", local); err != nil {
+		t.Fatal(err)
+	}
+	if err := SavePalette("10.0.0.2:9292", remote); err != nil {
+		t.Fatal(err)
+	}
+	if out_value, ok := LoadPalette("local"); !ok || !reflect.DeepEqual(out_value, local) {
+		t.Errorf("Wrong(local) == %+v, want %+v", out_value, local)
+	}
+	if out_value, ok := LoadPalette("10.0.0.2:9292"); !ok || !reflect.DeepEqual(out_value, remote) {
+		t.Errorf("Wrong(10.0.0.2:9292) == %+v, want %+v", out_value, remote)
+	}
+
+	path, _ := buildPath()
+	if err := os.WriteFile(path, []byte("{broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := LoadPalette("local"); ok {
+		t.Errorf("Wrong(local) found palette in broken cache")
+	}
+}
+
+func TestRecentPalette(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("LocalAppData", dir)
+	saved := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	now = func() time.Time { return saved }
+	defer func() { now = time.Now }()
+	local := ipc.Palette{Colors: []ipc.PaletteColor{{Name: "red", Value: "255:0:0"}}, Modes: []string{"solid"}, States: []ipc.PaletteState{}, BrightnessMax: 150}
+	if err := SavePalette("local", local); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		age  time.Duration
+		want bool
+	}{
+		{0, true},
+		{PaletteTTL, true},
+		{PaletteTTL + time.Second, false},
+	}
+	for _, test := range tests {
+		now = func() time.Time { return saved.Add(test.age) }
+		if out_value, ok := LoadRecentPalette("local"); ok != test.want || (ok && !reflect.DeepEqual(out_value, local)) {
+			t.Errorf("Wrong(%v) == %+v (%v), want %v", test.age, out_value, ok, test.want)
+		}
+	}
+
+	path, _ := buildPath()
+	if err := os.WriteFile(path, []byte(`{"local": {"colors": [{"name": "red", "value": "255:0:0"}]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := LoadPalette("local"); ok {
+		t.Errorf("Wrong(local) found palette cached without a time")
+	}
+}
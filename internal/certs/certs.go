@@ -0,0 +1,263 @@
+// DSUL - Disturb State USB Light : Certificates module
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+// TLS is used for network mode, if enabled. The server can require client certificates signed by a CA (tls.clientca),
+// clients verify the server against a CA (tls.ca, or the system's CAs) and/or its pinned public key (tls.pin).
+
+const (
+	caValidity   = time.Hour * 24 * 3650 // 10 years
+	certValidity = time.Hour * 24 * 825  // the longest validity accepted by most clients
+	pinPrefix    = "sha256:"
+)
+
+// Files are the certificates and keys created by Init.
+type Files struct {
+	CA         string
+	CAKey      string
+	Server     string
+	ServerKey  string
+	Client     string
+	ClientKey  string
+	ServerPin  string // pin of the server's public key
+	ReusedCA   bool   // the existing CA was used
+	ServerKept bool   // the existing server certificate was kept
+}
+
+// ServerConfig returns the TLS configuration of the network listener.
+// Client certificates are required, and verified, if a client CA is configured.
+func ServerConfig(cfg *settings.Config) (*tls.Config, error) {
+	if cfg.Tls.Cert == "" || cfg.Tls.Key == "" {
+		return nil, errors.New("tls.cert and tls.key must be set to use TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.Tls.Cert, cfg.Tls.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load server certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.Tls.ClientCA != "" {
+		pool, err := loadPool(cfg.Tls.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientConfig returns the TLS configuration used to connect to the given server.
+// The server is verified against the configured CA (or the system's CAs), unless only a pin is given.
+// If a pin is given, the server's public key must match it.
+func ClientConfig(cfg *settings.Config, server string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: server, MinVersion: tls.VersionTLS12}
+	if cfg.Tls.CA != "" {
+		pool, err := loadPool(cfg.Tls.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if cfg.Tls.Cert != "" && cfg.Tls.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Tls.Cert, cfg.Tls.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.Tls.Pin != "" {
+		pin := strings.ToLower(cfg.Tls.Pin)
+		if cfg.Tls.CA == "" {
+			config.InsecureSkipVerify = true // verified by pin only, e.g. a self-signed certificate
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server didn't send a certificate")
+			}
+			if got := GetPin(state.PeerCertificates[0]); got != pin {
+				return fmt.Errorf("server certificate doesn't match the pinned key (got %s)", got)
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// GetPin returns the pin of the certificate's public key: "sha256:" and the hex encoded SHA-256 of it.
+func GetPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + hex.EncodeToString(sum[:])
+}
+
+// Init creates a CA, a server certificate for the given hosts and a client certificate, in the directory.
+// An existing CA (and server certificate) is used, so more client certificates can be created. Keys are only readable by the user.
+func Init(directory string, hosts []string, client_name string) (Files, error) {
+	files := Files{
+		CA:        filepath.Join(directory, "ca.pem"),
+		CAKey:     filepath.Join(directory, "ca-key.pem"),
+		Server:    filepath.Join(directory, "server.pem"),
+		ServerKey: filepath.Join(directory, "server-key.pem"),
+		Client:    filepath.Join(directory, client_name+".pem"),
+		ClientKey: filepath.Join(directory, client_name+"-key.pem"),
+	}
+	if exists(files.Client) || exists(files.ClientKey) {
+		return files, fmt.Errorf("client certificate already exists: %s", files.Client)
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return files, err
+	}
+
+	var ca *x509.Certificate
+	var ca_key *ecdsa.PrivateKey
+	var err error
+	if exists(files.CA) && exists(files.CAKey) {
+		if ca, ca_key, err = loadPair(files.CA, files.CAKey); err != nil {
+			return files, err
+		}
+		files.ReusedCA = true
+	} else {
+		template := newTemplate("DSUL CA", caValidity)
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		if ca, ca_key, err = createPair(template, nil, nil, files.CA, files.CAKey); err != nil {
+			return files, err
+		}
+	}
+
+	var server *x509.Certificate
+	if exists(files.Server) && exists(files.ServerKey) {
+		if server, _, err = loadPair(files.Server, files.ServerKey); err != nil {
+			return files, err
+		}
+		files.ServerKept = true
+	} else {
+		template := newTemplate("DSUL server", certValidity)
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+		if server, _, err = createPair(template, ca, ca_key, files.Server, files.ServerKey); err != nil {
+			return files, err
+		}
+	}
+	files.ServerPin = GetPin(server)
+
+	template := newTemplate(client_name, certValidity)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	if _, _, err = createPair(template, ca, ca_key, files.Client, files.ClientKey); err != nil {
+		return files, err
+	}
+	return files, nil
+}
+
+// DefaultHosts returns the hosts a server certificate is created for by default: localhost and this host's name.
+func DefaultHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+// newTemplate returns a certificate template with the given common name and validity.
+func newTemplate(name string, validity time.Duration) *x509.Certificate {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"DSUL"}},
+		NotBefore:    time.Now().Add(-time.Hour), // allow for clock differences
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+// createPair creates a key and certificate, signed by the parent (or self-signed), and writes them to the files.
+func createPair(template *x509.Certificate, parent *x509.Certificate, parent_key *ecdsa.PrivateKey, cert_path string, key_path string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent == nil {
+		parent, parent_key = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parent_key)
+	if err != nil {
+		return nil, nil, err
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(key_path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(cert_path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// loadPair reads a certificate and its (EC) key.
+func loadPair(cert_path string, key_path string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(cert_path, key_path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("key isn't an EC key: %s", key_path)
+	}
+	return cert, key, nil
+}
+
+// loadPool returns a certificate pool with the CA certificates in the file.
+func loadPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA: %s", path)
+	}
+	return pool, nil
+}
+
+// exists returns true if the file exists.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,139 @@
+// DSUL - Disturb State USB Light : Certificates module tests.
+package certs
+
+import (
+	"crypto/tls"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestInit(t *testing.T) {
+	directory := t.TempDir()
+	files, err := Init(directory, []string{"localhost", "127.0.0.1"}, "client")
+	if err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	if files.ReusedCA || files.ServerKept {
+		t.Errorf("Init() == reused %v/%v, want new CA and server certificate", files.ReusedCA, files.ServerKept)
+	}
+	for _, path := range []string{files.CAKey, files.ServerKey, files.ClientKey} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat(%q) failed: %v", path, err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("Wrong(%q) == %s, want -rw-------", path, info.Mode().Perm())
+		}
+	}
+
+	// A second client uses the existing CA and server certificate
+	second, err := Init(directory, nil, "laptop")
+	if err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	if !second.ReusedCA || !second.ServerKept || second.ServerPin != files.ServerPin {
+		t.Errorf("Init() == reused %v/%v, pin %s, want existing CA, server certificate and pin %s", second.ReusedCA, second.ServerKept, second.ServerPin, files.ServerPin)
+	}
+	if _, err := Init(directory, nil, "laptop"); err == nil {
+		t.Errorf("Init() with existing client == nil, want error")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	directory := t.TempDir()
+	files, err := Init(directory, []string{"localhost", "127.0.0.1"}, "client")
+	if err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	other, err := Init(t.TempDir(), []string{"127.0.0.1"}, "client")
+	if err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+
+	server_cfg := settings.Config{Tls: settings.Tls{Enabled: true, Cert: files.Server, Key: files.ServerKey, ClientCA: files.CA}}
+	server_config, err := ServerConfig(&server_cfg)
+	if err != nil {
+		t.Fatalf("ServerConfig() failed: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server_config)
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("ok"))
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name string
+		tls  settings.Tls
+		want string // error, if the connection should fail
+	}{
+		{"ca", settings.Tls{CA: files.CA, Cert: files.Client, Key: files.ClientKey}, ""},
+		{"pin only", settings.Tls{Pin: files.ServerPin, Cert: files.Client, Key: files.ClientKey}, ""},
+		{"ca and pin", settings.Tls{CA: files.CA, Pin: strings.ToUpper(files.ServerPin), Cert: files.Client, Key: files.ClientKey}, ""},
+		{"wrong pin", settings.Tls{Pin: other.ServerPin, Cert: files.Client, Key: files.ClientKey}, "doesn't match the pinned key"},
+		{"wrong ca", settings.Tls{CA: other.CA, Cert: files.Client, Key: files.ClientKey}, "certificate"},
+		{"no client certificate", settings.Tls{CA: files.CA}, "certificate"},
+		{"client certificate from other ca", settings.Tls{CA: files.CA, Cert: other.Client, Key: other.ClientKey}, "certificate"},
+	}
+
+	for _, test := range tests {
+		cfg := settings.Config{Tls: test.tls}
+		config, err := ClientConfig(&cfg, "127.0.0.1")
+		if err != nil {
+			t.Fatalf("ClientConfig(%s) failed: %v", test.name, err)
+		}
+		got := ""
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err == nil {
+			// TLS 1.3 reports a rejected client certificate on the first read
+			_, err = io.ReadAll(conn)
+			conn.Close()
+		}
+		if err != nil {
+			got = err.Error()
+		}
+		if (test.want == "") != (got == "") || !strings.Contains(got, test.want) {
+			t.Errorf("Wrong(%s) == %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	directory := t.TempDir()
+	if _, err := Init(directory, []string{"localhost"}, "client"); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	tests := []struct {
+		name string
+		tls  settings.Tls
+		want string
+	}{
+		{"no key", settings.Tls{Cert: filepath.Join(directory, "server.pem")}, "tls.cert and tls.key must be set to use TLS"},
+		{"missing cert", settings.Tls{Cert: filepath.Join(directory, "missing.pem"), Key: filepath.Join(directory, "server-key.pem")}, "unable to load server certificate"},
+		{"missing client ca", settings.Tls{Cert: filepath.Join(directory, "server.pem"), Key: filepath.Join(directory, "server-key.pem"), ClientCA: filepath.Join(directory, "missing.pem")}, "unable to read CA"},
+		{"client ca isn't pem", settings.Tls{Cert: filepath.Join(directory, "server.pem"), Key: filepath.Join(directory, "server-key.pem"), ClientCA: filepath.Join(directory, "server-key.pem")}, "no certificates found in CA"},
+	}
+	for _, test := range tests {
+		cfg := settings.Config{Tls: test.tls}
+		_, err := ServerConfig(&cfg)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Wrong(%s) == %v, want %q", test.name, err, test.want)
+		}
+	}
+}
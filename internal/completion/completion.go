@@ -0,0 +1,245 @@
+// DSUL - Disturb State USB Light : Completion module
+package completion
+
+import (
+	"fmt"
+
+	"github.com/hymnis/dsul-go/internal/ipc"
+)
+
+// Shells contains the shells that completion scripts can be generated for.
+var Shells = []string{"bash", "zsh", "fish"}
+
+// Kinds contains the kinds of values that can be completed.
+var Kinds = []string{"colors", "modes", "states", "devices"}
+
+// Script returns the completion script for the given shell.
+// Scripts get colors, modes and states by running "dsulc completion values <kind>".
+func Script(shell string) (string, error) {
+	switch shell {
+	case "bash":
+		return bashScript, nil
+	case "zsh":
+		return zshScript, nil
+	case "fish":
+		return fishScript, nil
+	}
+	return "", fmt.Errorf("unsupported shell: '%s'", shell)
+}
+
+// Values returns the names of the given kind of values, from the palette and devices.
+func Values(kind string, palette ipc.Palette, devices []ipc.Device) ([]string, error) {
+	values := []string{}
+	switch kind {
+	case "colors":
+		for _, color := range palette.Colors {
+			values = append(values, color.Name)
+		}
+	case "modes":
+		values = append(values, palette.Modes...)
+	case "states":
+		for _, state := range palette.States {
+			values = append(values, state.Name)
+		}
+	case "devices":
+		for _, device := range devices {
+			values = append(values, device.Port)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported kind: '%s'", kind)
+	}
+	return values, nil
+}
+
+const bashScript = `# bash completion for dsulc, load with: source <(dsulc completion bash)
+
+_dsulc_values() {
+    dsulc completion values "$1" 2>/dev/null
+}
+
+_dsulc() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local prev="${COMP_WORDS[COMP_CWORD-1]}"
+    local command="${COMP_WORDS[1]}"
+    local words=""
+
+    case "$prev" in
+        -c|--color) words="$(_dsulc_values colors)" ;;
+        -m|--mode) words="$(_dsulc_values modes)" ;;
+        -o|--output) words="text json yaml" ;;
+        --pattern) words="flash blink" ;;
+        --role) words="read control admin" ;;
+        --source) words="ipc http focus notify" ;;
+        -b|--brightness|-n|--network|-p|--password|-t|--timeout|--break|--long-break|--cycles|--count|--duration|--operations|--since|--limit) return ;;
+    esac
+
+    if [[ -z "$words" ]]; then
+        if [[ "$cur" == -* ]]; then
+            words="-h --help -c --color -l --list -m --mode -b --brightness -d --dim -u --undim -n --network -p --password -t --timeout -o --output -v --version --verbose --debug"
+        elif [[ $COMP_CWORD -eq 1 ]]; then
+            words="set get list state device config token log history undo restore focus notify watch completion"
+        elif [[ $COMP_CWORD -eq 2 ]]; then
+            case "$command" in
+                set) words="color brightness mode dim" ;;
+                get) words="state information" ;;
+                list) words="colors modes states all" ;;
+                state) words="$(_dsulc_values states)" ;;
+                device) words="list" ;;
+                config) words="path validate color state brightness-limits" ;;
+                token) words="create list revoke" ;;
+                focus) words="start stop pause resume status" ;;
+                notify) words="$(_dsulc_values colors)" ;;
+                completion) words="bash zsh fish values" ;;
+            esac
+        elif [[ $COMP_CWORD -eq 3 ]]; then
+            case "$command ${COMP_WORDS[2]}" in
+                "set color") words="$(_dsulc_values colors)" ;;
+                "set mode") words="$(_dsulc_values modes)" ;;
+                "set dim") words="on off" ;;
+                "config color") words="add remove rename" ;;
+                "config state") words="set remove" ;;
+                "completion values") words="colors modes states devices" ;;
+            esac
+        elif [[ $COMP_CWORD -eq 4 ]]; then
+            case "$command ${COMP_WORDS[2]} ${COMP_WORDS[3]}" in
+                "config color remove"|"config color rename") words="$(_dsulc_values colors)" ;;
+                "config state set"|"config state remove") words="$(_dsulc_values states)" ;;
+            esac
+        fi
+    fi
+
+    COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+
+complete -F _dsulc dsulc
+`
+
+const zshScript = `#compdef dsulc
+# zsh completion for dsulc, load with: source <(dsulc completion zsh)
+
+_dsulc_values() {
+    local -a values
+    values=(${(f)"$(dsulc completion values $1 2>/dev/null)"})
+    compadd -a values
+}
+
+_dsulc() {
+    local command=${words[2]}
+
+    case ${words[CURRENT-1]} in
+        -c|--color) _dsulc_values colors; return ;;
+        -m|--mode) _dsulc_values modes; return ;;
+        -o|--output) compadd text json yaml; return ;;
+        --pattern) compadd flash blink; return ;;
+        --role) compadd read control admin; return ;;
+        --source) compadd ipc http focus notify; return ;;
+        -b|--brightness|-n|--network|-p|--password|-t|--timeout|--break|--long-break|--cycles|--count|--duration|--operations|--since|--limit) return ;;
+    esac
+
+    if [[ ${words[CURRENT]} == -* ]]; then
+        compadd -- -h --help -c --color -l --list -m --mode -b --brightness -d --dim -u --undim -n --network -p --password -t --timeout -o --output -v --version --verbose --debug
+        return
+    fi
+
+    case $CURRENT in
+        2) compadd set get list state device config token log history undo restore focus notify watch completion ;;
+        3)
+            case $command in
+                set) compadd color brightness mode dim ;;
+                get) compadd state information ;;
+                list) compadd colors modes states all ;;
+                state) _dsulc_values states ;;
+                device) compadd list ;;
+                config) compadd path validate color state brightness-limits ;;
+                token) compadd create list revoke ;;
+                focus) compadd start stop pause resume status ;;
+                notify) _dsulc_values colors ;;
+                completion) compadd bash zsh fish values ;;
+            esac
+            ;;
+        4)
+            case "$command ${words[3]}" in
+                "set color") _dsulc_values colors ;;
+                "set mode") _dsulc_values modes ;;
+                "set dim") compadd on off ;;
+                "config color") compadd add remove rename ;;
+                "config state") compadd set remove ;;
+                "completion values") compadd colors modes states devices ;;
+            esac
+            ;;
+        5)
+            case "$command ${words[3]} ${words[4]}" in
+                "config color remove"|"config color rename") _dsulc_values colors ;;
+                "config state set"|"config state remove") _dsulc_values states ;;
+            esac
+            ;;
+    esac
+}
+
+if [[ "$funcstack[1]" = "_dsulc" ]]; then
+    _dsulc "$@"
+else
+    compdef _dsulc dsulc
+fi
+`
+
+const fishScript = `# fish completion for dsulc, load with: dsulc completion fish | source
+
+function __dsulc_values
+    dsulc completion values $argv[1] 2>/dev/null
+end
+
+# __dsulc_args_are returns true if the arguments given so far (not counting flags) are the given ones
+function __dsulc_args_are
+    set -l args (commandline -opc)
+    set -e args[1]
+    set -l positional
+    for arg in $args
+        string match -q -- '-*' $arg; or set -a positional $arg
+    end
+    test "$positional" = "$argv"
+end
+
+complete -c dsulc -f
+
+complete -c dsulc -n '__dsulc_args_are' -a 'set get list state device config token log history undo restore focus notify watch completion'
+complete -c dsulc -n '__dsulc_args_are set' -a 'color brightness mode dim'
+complete -c dsulc -n '__dsulc_args_are set color' -a '(__dsulc_values colors)'
+complete -c dsulc -n '__dsulc_args_are set mode' -a '(__dsulc_values modes)'
+complete -c dsulc -n '__dsulc_args_are set dim' -a 'on off'
+complete -c dsulc -n '__dsulc_args_are get' -a 'state information'
+complete -c dsulc -n '__dsulc_args_are list' -a 'colors modes states all'
+complete -c dsulc -n '__dsulc_args_are state' -a '(__dsulc_values states)'
+complete -c dsulc -n '__dsulc_args_are device' -a 'list'
+complete -c dsulc -n '__dsulc_args_are config' -a 'path validate color state brightness-limits'
+complete -c dsulc -n '__dsulc_args_are config color' -a 'add remove rename'
+complete -c dsulc -n '__dsulc_args_are config color remove; or __dsulc_args_are config color rename' -a '(__dsulc_values colors)'
+complete -c dsulc -n '__dsulc_args_are config state' -a 'set remove'
+complete -c dsulc -n '__dsulc_args_are config state set; or __dsulc_args_are config state remove' -a '(__dsulc_values states)'
+complete -c dsulc -n '__dsulc_args_are token' -a 'create list revoke'
+complete -c dsulc -n '__dsulc_args_are focus' -a 'start stop pause resume status'
+complete -c dsulc -n '__dsulc_args_are notify' -a '(__dsulc_values colors)'
+complete -c dsulc -n '__dsulc_args_are completion' -a 'bash zsh fish values'
+complete -c dsulc -n '__dsulc_args_are completion values' -a 'colors modes states devices'
+
+complete -c dsulc -s h -l help -d 'Show help'
+complete -c dsulc -s c -l color -x -a '(__dsulc_values colors)' -d 'Set given color'
+complete -c dsulc -s l -l list -d 'List settings and values'
+complete -c dsulc -s m -l mode -x -a '(__dsulc_values modes)' -d 'Set given mode'
+complete -c dsulc -s b -l brightness -x -d 'Set given brightness'
+complete -c dsulc -s d -l dim -d 'Dim colors'
+complete -c dsulc -s u -l undim -d 'Un-dim colors'
+complete -c dsulc -s n -l network -x -d 'Network server to connect to'
+complete -c dsulc -s p -l password -x -d 'Set password'
+complete -c dsulc -s t -l timeout -x -d 'Set how long to wait for the daemon'
+complete -c dsulc -s o -l output -x -a 'text json yaml' -d 'Set output format'
+complete -c dsulc -s v -l version -d 'Show version'
+complete -c dsulc -l verbose -d 'Show verbose output'
+complete -c dsulc -l debug -d 'Show debug output'
+complete -c dsulc -l pattern -x -a 'flash blink' -d 'Set notification pattern'
+complete -c dsulc -l role -x -a 'read control admin' -d 'Set role of the token'
+complete -c dsulc -l operations -x -d 'Set operations the token is allowed'
+complete -c dsulc -l since -x -d 'Only show log entries since given time or duration ago'
+complete -c dsulc -l source -x -a 'ipc http focus notify' -d 'Only show log entries from given source'
+complete -c dsulc -l limit -x -d 'Only show the last log entries'
+`
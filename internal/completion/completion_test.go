@@ -0,0 +1,55 @@
+// DSUL - Disturb State USB Light : Completion module tests.
+package completion
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hymnis/dsul-go/internal/ipc"
+)
+
+func TestScript(t *testing.T) {
+	for _, shell := range Shells {
+		script, err := Script(shell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(script, "dsulc completion values") {
+			t.Errorf("Wrong(%s) == %q, want it to get values from dsulc", shell, script)
+		}
+	}
+	if _, err := Script("powershell"); err == nil {
+		t.Errorf("Wrong(powershell) returned script without error")
+	}
+}
+
+func TestValues(t *testing.T) {
+	palette := ipc.Palette{
+		Colors: []ipc.PaletteColor{{Name: "red", Value: "255:0:0"}, {Name: "warmwhite", Value: "255:230:200"}},
+		Modes:  []string{"solid", "pulse"},
+		States: []ipc.PaletteState{{Name: "busy", Color: "red", Mode: "solid"}},
+	}
+	devices := []ipc.Device{{Port: "/dev/ttyUSB0"}}
+	tests := []struct {
+		in_value string
+		want     string
+	}{
+		{"colors", "red warmwhite"},
+		{"modes", "solid pulse"},
+		{"states", "busy"},
+		{"devices", "/dev/ttyUSB0"},
+	}
+
+	for _, test := range tests {
+		out_value, err := Values(test.in_value, palette, devices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(out_value, " ") != test.want {
+			t.Errorf("Wrong(%s) == %v, want %q", test.in_value, out_value, test.want)
+		}
+	}
+	if _, err := Values("volume", palette, devices); err == nil {
+		t.Errorf("Wrong(volume) returned values without error")
+	}
+}
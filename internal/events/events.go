@@ -0,0 +1,137 @@
+// DSUL - Disturb State USB Light : Events module
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	verbose bool = false
+	debug   bool = false
+)
+
+const bufferSize = 64 // number of events buffered for each subscriber
+
+// Event describes something that happened in the daemon.
+// Type is one of: state (a value was changed), device (device was connected or disconnected) or ping (a ping failed).
+type Event struct {
+	Type   string    `json:"type" yaml:"type"`
+	Source string    `json:"source,omitempty" yaml:"source,omitempty"`
+	Key    string    `json:"key,omitempty" yaml:"key,omitempty"`
+	Old    string    `json:"old,omitempty" yaml:"old,omitempty"`
+	New    string    `json:"new,omitempty" yaml:"new,omitempty"`
+	Time   time.Time `json:"time" yaml:"time"`
+}
+
+// Subscriber is used to subscribe or unsubscribe a channel to events.
+type Subscriber struct {
+	Events      chan Event
+	Unsubscribe bool
+}
+
+// String returns the event as a JSON string.
+func (e Event) String() string {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Summary returns the event as a human-readable line, e.g. "15:04:05 color: 255:0:0 -> 0:255:0 (ipc)".
+func (e Event) Summary() string {
+	name := e.Key
+	if name == "" {
+		name = e.Type
+	}
+	value := e.New
+	if e.Old != "" {
+		value = fmt.Sprintf("%s -> %s", e.Old, e.New)
+	}
+	summary := fmt.Sprintf("%s %s: %s", e.Time.Local().Format("15:04:05"), name, value)
+	if e.Source != "" {
+		summary += fmt.Sprintf(" (%s)", e.Source)
+	}
+	return summary
+}
+
+// ParseEvent returns an Event from a JSON string.
+func ParseEvent(value string) (*Event, error) {
+	e := Event{}
+	if err := json.Unmarshal([]byte(value), &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Publish sends an event to the event channel, without blocking if the channel is full.
+func Publish(event_channel chan Event, e Event) {
+	if event_channel == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case event_channel <- e:
+	default:
+		log.Printf("[events] Event channel is full, dropping event: %s\n", e)
+	}
+}
+
+// Subscribe returns a new channel that receives all events.
+func Subscribe(subscriber_channel chan Subscriber) chan Event {
+	events := make(chan Event, bufferSize)
+	subscriber_channel <- Subscriber{Events: events}
+	return events
+}
+
+// Unsubscribe stops sending events to the given channel and closes it.
+func Unsubscribe(subscriber_channel chan Subscriber, events chan Event) {
+	subscriber_channel <- Subscriber{Events: events, Unsubscribe: true}
+}
+
+// Runner parts //
+
+// Runner starts the event handler, that sends published events to all subscribers.
+func Runner(output_handling struct {
+	Verbose bool
+	Debug   bool
+}, event_channel chan Event, subscriber_channel chan Subscriber) {
+	verbose = output_handling.Verbose
+	debug = output_handling.Debug
+	subscribers := make(map[chan Event]bool)
+
+	for {
+		select {
+		case subscriber := <-subscriber_channel:
+			if subscriber.Unsubscribe {
+				if subscribers[subscriber.Events] {
+					delete(subscribers, subscriber.Events)
+					close(subscriber.Events)
+				}
+			} else {
+				subscribers[subscriber.Events] = true
+			}
+			if debug {
+				log.Printf("[events] Subscribers: %d\n", len(subscribers))
+			}
+		case e := <-event_channel:
+			if debug {
+				log.Printf("[events] Event: %s\n", e)
+			}
+			for events := range subscribers {
+				select {
+				case events <- e:
+				default:
+					if verbose {
+						log.Println("[events] Subscriber is not keeping up, dropping event")
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// DSUL - Disturb State USB Light : Events module tests.
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseEvent(t *testing.T) {
+	in_value := Event{Type: "state", Source: "ipc", Key: "color", Old: "255:0:0", New: "0:255:0", Time: time.Unix(0, 0).UTC()}
+	out_value, err := ParseEvent(in_value.String())
+
+	if err != nil || *out_value != in_value {
+		t.Errorf("Wrong(%q) == %v, want %v", in_value.String(), out_value, in_value)
+	}
+	if _, err := ParseEvent("not json"); err == nil {
+		t.Errorf("Wrong(%q) parsed without error", "not json")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	at := time.Date(2022, 1, 2, 15, 4, 5, 0, time.Local)
+	tests := []struct {
+		in_value Event
+		want     string
+	}{
+		{Event{Type: "state", Source: "ipc", Key: "color", Old: "255:0:0", New: "0:255:0", Time: at}, "15:04:05 color: 255:0:0 -> 0:255:0 (ipc)"},
+		{Event{Type: "ping", Source: "serial", New: "failed", Time: at}, "15:04:05 ping: failed (serial)"},
+	}
+
+	for _, test := range tests {
+		if out_value := test.in_value.Summary(); out_value != test.want {
+			t.Errorf("Wrong(%v) == %q, want %q", test.in_value, out_value, test.want)
+		}
+	}
+}
+
+func TestRunner(t *testing.T) {
+	event_channel := make(chan Event, 1)
+	subscriber_channel := make(chan Subscriber)
+	go Runner(struct {
+		Verbose bool
+		Debug   bool
+	}{}, event_channel, subscriber_channel)
+
+	subscription := Subscribe(subscriber_channel)
+	Publish(event_channel, Event{Type: "state", Key: "mode"})
+
+	select {
+	case e := <-subscription:
+		if e.Key != "mode" || e.Time.IsZero() {
+			t.Errorf("Wrong event received: %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No event received")
+	}
+
+	Unsubscribe(subscriber_channel, subscription)
+	if _, ok := <-subscription; ok {
+		t.Error("Subscription was not closed")
+	}
+}
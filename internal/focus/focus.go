@@ -0,0 +1,291 @@
+// DSUL - Disturb State USB Light : Focus module
+package focus
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/serial"
+	"github.com/hymnis/dsul-go/internal/settings"
+	"github.com/hymnis/dsul-go/internal/watchdog"
+)
+
+var (
+	verbose bool = false
+	debug   bool = false
+)
+
+const flashTime = time.Second * 3 // how long the light flashes at a transition
+
+// Command is a request for the focus timer and the channel to send the response on.
+type Command struct {
+	Action   string
+	Value    string
+	Response chan string
+}
+
+// Status holds the current state of the focus timer.
+type Status struct {
+	State      string        `json:"state"` // stopped, focus, break or longbreak
+	Paused     bool          `json:"paused"`
+	Remaining  time.Duration `json:"remaining"`
+	Cycle      int           `json:"cycle"`
+	Cycles     int           `json:"cycles"`
+	LongBreaks int           `json:"long_breaks"`
+}
+
+// timer holds the durations and status of the focus timer.
+type timer struct {
+	focus      time.Duration
+	short      time.Duration
+	long       time.Duration
+	status     Status
+	watchdog   *watchdog.Watchdog
+	generation int
+}
+
+// String returns the status as a string, that can be sent to clients.
+func (s Status) String() string {
+	return fmt.Sprintf("%s:%t:%s:%d:%d:%d", s.State, s.Paused, s.Remaining.Round(time.Second), s.Cycle, s.Cycles, s.LongBreaks)
+}
+
+// ParseStatus returns a Status struct from a status string.
+func ParseStatus(value string) (*Status, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 6 {
+		return nil, errors.New("invalid focus status")
+	}
+
+	status := Status{State: parts[0]}
+	var err error
+	if status.Paused, err = strconv.ParseBool(parts[1]); err != nil {
+		return nil, err
+	}
+	if status.Remaining, err = time.ParseDuration(parts[2]); err != nil {
+		return nil, err
+	}
+	if status.Cycle, err = strconv.Atoi(parts[3]); err != nil {
+		return nil, err
+	}
+	if status.Cycles, err = strconv.Atoi(parts[4]); err != nil {
+		return nil, err
+	}
+	if status.LongBreaks, err = strconv.Atoi(parts[5]); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// GetStartString returns the value used to start the focus timer.
+// Empty values are replaced with the defaults from the daemon's configuration.
+func GetStartString(duration string, short string, cycles int, long string) string {
+	cycles_str := ""
+	if cycles > 0 {
+		cycles_str = strconv.Itoa(cycles)
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", duration, short, cycles_str, long)
+}
+
+// parseStartString returns durations and number of cycles from a start value, using defaults from the configuration.
+// focus:break:cycles:long break - e.g. "25m:5m:4:15m"
+func parseStartString(value string, cfg *settings.Config) (time.Duration, time.Duration, time.Duration, int, error) {
+	values := []string{cfg.Focus.Duration, cfg.Focus.Break, strconv.Itoa(cfg.Focus.Cycles), cfg.Focus.LongBreak}
+	for i, part := range strings.Split(value, ":") {
+		if i < len(values) && part != "" {
+			values[i] = part
+		}
+	}
+
+	focus, err := time.ParseDuration(values[0])
+	if err != nil || focus <= 0 {
+		return 0, 0, 0, 0, fmt.Errorf("invalid focus duration: '%s'", values[0])
+	}
+	short, err := time.ParseDuration(values[1])
+	if err != nil || short <= 0 {
+		return 0, 0, 0, 0, fmt.Errorf("invalid break duration: '%s'", values[1])
+	}
+	cycles, err := strconv.Atoi(values[2])
+	if err != nil || cycles < 1 {
+		return 0, 0, 0, 0, fmt.Errorf("invalid number of cycles: '%s'", values[2])
+	}
+	long, err := time.ParseDuration(values[3])
+	if err != nil || long <= 0 {
+		return 0, 0, 0, 0, fmt.Errorf("invalid long break duration: '%s'", values[3])
+	}
+
+	return focus, short, long, cycles, nil
+}
+
+// next moves the timer to the following state and returns the duration of it.
+func (t *timer) next() time.Duration {
+	switch t.status.State {
+	case "focus":
+		if t.status.Cycle >= t.status.Cycles {
+			t.status.State = "longbreak"
+			t.status.LongBreaks += 1
+			return t.long
+		}
+		t.status.State = "break"
+		return t.short
+	case "longbreak":
+		t.status.Cycle = 1 // start over after a long break
+	default:
+		t.status.Cycle += 1
+	}
+
+	t.status.State = "focus"
+	return t.focus
+}
+
+// getStatus returns the current status, with the remaining time of the active state.
+func (t *timer) getStatus() Status {
+	status := t.status
+	if t.watchdog != nil && status.State != "stopped" {
+		status.Remaining = t.watchdog.Remaining()
+		status.Paused = t.watchdog.Paused()
+	}
+	return status
+}
+
+// getColor returns the configured color for the current state.
+func (t *timer) getColor(cfg *settings.Config) string {
+	switch t.status.State {
+	case "break":
+		return cfg.Focus.BreakColor
+	case "longbreak":
+		return cfg.Focus.LongBreakColor
+	}
+	return cfg.Focus.FocusColor
+}
+
+// Runner parts //
+
+// Runner starts the focus timer handler.
+// The timer switches between focus and break states and sets the light accordingly.
+func Runner(cfg *settings.Config, output_handling struct {
+	Verbose bool
+	Debug   bool
+}, focus_channel chan Command, cmd_channel chan serial.Command) {
+	verbose = output_handling.Verbose
+	debug = output_handling.Debug
+	run(cfg, focus_channel, cmd_channel, flashTime)
+}
+
+// run handles the focus timer commands, flashing the light for flash_time at each transition if enabled.
+// The light is restored to the state it had before the timer was started when it's stopped.
+func run(cfg *settings.Config, focus_channel chan Command, cmd_channel chan serial.Command, flash_time time.Duration) {
+	t := timer{status: Status{State: "stopped"}}
+	expired := make(chan int)  // generation of the watchdog timer that expired
+	flashed := make(chan bool) // sent when the transition flash is done
+	var flasher *watchdog.Watchdog
+	flash_mode := ""              // mode to restore after the transition flash, set while flashing
+	var before *settings.Hardware // state of the light before the timer was started
+
+	// start (re)starts the watchdog timer and sets the light for the current state
+	start := func(duration time.Duration) {
+		if t.watchdog != nil {
+			t.watchdog.Stop()
+		}
+		t.generation += 1
+		generation := t.generation
+		t.watchdog = watchdog.NewCallbackTimer(duration, func() { expired <- generation })
+
+		current := settings.Snapshot(cfg)
+		color := t.getColor(current)
+		if verbose {
+			log.Printf("[focus] State: %s (%v), color: %s\n", t.status.State, duration, color)
+		}
+		_ = serial.Send(cmd_channel, "focus", "color", color)
+		if current.Focus.Flash {
+			if flasher != nil {
+				flasher.Stop()
+			}
+			if flash_mode == "" {
+				flash_mode = "solid" // if the device doesn't respond, or its mode isn't configured
+				snapshot := settings.ParseHardwareInformation(serial.Send(cmd_channel, "focus", "information", "all"))
+				if cfg_mode, ok := settings.GetMode(snapshot.Current_mode, current); ok && snapshot.Version != "" {
+					flash_mode = cfg_mode.Name
+				}
+			}
+			_ = serial.Send(cmd_channel, "focus", "mode", "flash")
+			flasher = watchdog.NewCallbackTimer(flash_time, func() { flashed <- true })
+		}
+	}
+
+	for {
+		select {
+		case command := <-focus_channel:
+			if debug {
+				log.Printf("[focus] Command: %s '%s'\n", command.Action, command.Value)
+			}
+			ok := true
+
+			switch command.Action {
+			case "start":
+				focus, short, long, cycles, err := parseStartString(command.Value, settings.Snapshot(cfg))
+				if err != nil {
+					log.Printf("[focus] Failed to start: %v\n", err)
+					ok = false
+					break
+				}
+				if t.status.State == "stopped" {
+					before = settings.ParseHardwareInformation(serial.Send(cmd_channel, "focus", "information", "all"))
+				}
+				t.focus, t.short, t.long = focus, short, long
+				t.status = Status{State: "focus", Cycle: 1, Cycles: cycles}
+				start(t.focus)
+			case "stop":
+				if t.watchdog != nil {
+					t.watchdog.Stop()
+				}
+				t.generation += 1
+				if flasher != nil {
+					flasher.Stop()
+				}
+				flash_mode = ""
+				if t.status.State != "stopped" && before != nil && before.Version != "" {
+					serial.Restore(cmd_channel, "focus", *before, settings.Snapshot(cfg))
+				}
+				t.status.State = "stopped"
+			case "pause":
+				if t.status.State == "stopped" {
+					ok = false
+					break
+				}
+				t.watchdog.Pause()
+			case "resume":
+				if t.status.State == "stopped" {
+					ok = false
+					break
+				}
+				t.watchdog.Resume()
+			case "status":
+				// only report status
+			default:
+				ok = false
+			}
+
+			if command.Response != nil {
+				if ok {
+					command.Response <- t.getStatus().String()
+				} else {
+					command.Response <- "nok"
+				}
+			}
+		case generation := <-expired:
+			if generation == t.generation && t.status.State != "stopped" {
+				start(t.next())
+			}
+		case <-flashed:
+			if flash_mode != "" {
+				_ = serial.Send(cmd_channel, "focus", "mode", flash_mode)
+				flash_mode = ""
+			}
+		}
+	}
+}
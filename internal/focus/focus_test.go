@@ -0,0 +1,103 @@
+// DSUL - Disturb State USB Light : Focus module tests.
+package focus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/serial"
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestParseStatus(t *testing.T) {
+	in_value := Status{"break", true, time.Minute*4 + time.Second*30, 2, 4, 1}
+	out_value, err := ParseStatus(in_value.String())
+
+	if err != nil || *out_value != in_value {
+		t.Errorf("Wrong(%q) == %v (%v), want %v", in_value.String(), out_value, err, in_value)
+	}
+	if _, err := ParseStatus("nok"); err == nil {
+		t.Errorf("Wrong(%q) parsed without error", "nok")
+	}
+}
+
+func TestParseStartString(t *testing.T) {
+	cfg := settings.Config{Focus: settings.Focus{Duration: "25m", Break: "5m", LongBreak: "15m", Cycles: 4}}
+	cases := []struct {
+		in                 string
+		focus, short, long time.Duration
+		cycles             int
+		ok                 bool
+	}{
+		{GetStartString("", "", 0, ""), time.Minute * 25, time.Minute * 5, time.Minute * 15, 4, true},
+		{GetStartString("50m", "10m", 2, "30m"), time.Minute * 50, time.Minute * 10, time.Minute * 30, 2, true},
+		{"10m", time.Minute * 10, time.Minute * 5, time.Minute * 15, 4, true},
+		{"ten:::", 0, 0, 0, 0, false},
+		{":-5m::", 0, 0, 0, 0, false},
+		{"::0:", 0, 0, 0, 0, false},
+	}
+	for _, c := range cases {
+		focus, short, long, cycles, err := parseStartString(c.in, &cfg)
+		if (err == nil) != c.ok || focus != c.focus || short != c.short || long != c.long || cycles != c.cycles {
+			t.Errorf("Wrong(%q) == %v, %v, %v, %d (%v)", c.in, focus, short, long, cycles, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	tm := timer{focus: time.Minute * 25, short: time.Minute * 5, long: time.Minute * 15, status: Status{State: "focus", Cycle: 1, Cycles: 2}}
+	want := []struct {
+		state      string
+		duration   time.Duration
+		cycle      int
+		longBreaks int
+	}{
+		{"break", time.Minute * 5, 1, 0},
+		{"focus", time.Minute * 25, 2, 0},
+		{"longbreak", time.Minute * 15, 2, 1},
+		{"focus", time.Minute * 25, 1, 1},
+	}
+	for _, w := range want {
+		duration := tm.next()
+		if tm.status.State != w.state || duration != w.duration || tm.status.Cycle != w.cycle || tm.status.LongBreaks != w.longBreaks {
+			t.Errorf("Wrong state %v (%v), want %v", tm.status, duration, w)
+		}
+	}
+}
+
+func TestFlashRestoresMode(t *testing.T) {
+	cfg := settings.Config{Modes: []settings.Mode{{Name: "solid", Value: 1}, {Name: "blink", Value: 2}, {Name: "flash", Value: 3}}}
+	cfg.Focus = settings.Focus{Duration: "25m", Break: "5m", Cycles: 4, LongBreak: "15m", FocusColor: "red", Flash: true}
+
+	focus_channel := make(chan Command)
+	cmd_channel := make(chan serial.Command)
+	go run(&cfg, focus_channel, cmd_channel, time.Millisecond*10)
+	go func() { focus_channel <- Command{Action: "start"} }()
+
+	// receive returns the commands sent to the device, until count commands have been sent
+	receive := func(count int) string {
+		sent := []string{}
+		for len(sent) < count {
+			command := <-cmd_channel
+			if command.Key == "information" {
+				command.Response <- "+v001.002.003ll008lb000:150cc255000000cb100cm002cd0#"
+				continue
+			}
+			sent = append(sent, command.Key+" "+command.Value)
+			command.Response <- "ok"
+		}
+		return strings.Join(sent, ", ")
+	}
+
+	want := "color red, mode flash, mode blink"
+	if out_value := receive(3); out_value != want {
+		t.Errorf("Wrong(commands) == %q, want %q", out_value, want)
+	}
+
+	go func() { focus_channel <- Command{Action: "stop"} }()
+	want = "color 255:0:0, brightness 100, mode blink, dim false"
+	if out_value := receive(4); out_value != want {
+		t.Errorf("Wrong(commands after stop) == %q, want %q", out_value, want)
+	}
+}
@@ -0,0 +1,152 @@
+// DSUL - Disturb State USB Light : History module
+package history
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+// The history holds the states applied to the device, so an earlier state can be restored (e.g. with dsulc undo).
+// Changes given together (e.g. a color, mode and brightness, or a state) are one step, kept as one entry.
+// It's saved (as JSON) after every change and keeps the last history.size entries. The size is read on each change,
+// so reloaded settings are used right away.
+
+// State is how the device looks: its color (red:green:blue), mode, brightness and dim.
+type State struct {
+	Color      string `json:"color" yaml:"color"`
+	Mode       string `json:"mode" yaml:"mode"`
+	Brightness int    `json:"brightness" yaml:"brightness"`
+	Dim        bool   `json:"dim" yaml:"dim"`
+}
+
+// Entry is a state applied to the device. Source is the module applying it (ipc, http or focus), or "device" for a state
+// found on the device (e.g. when the daemon started). Client is who applied it, if known.
+type Entry struct {
+	Time   time.Time `json:"time" yaml:"time"`
+	Source string    `json:"source" yaml:"source"`
+	Client string    `json:"client,omitempty" yaml:"client,omitempty"`
+	State  `yaml:",inline"`
+	step   string // changes with the same step are merged into the entry
+}
+
+// History is the history of states, oldest first. A nil history doesn't record anything.
+type History struct {
+	cfg     *settings.Config
+	path    string
+	lock    sync.Mutex
+	entries []Entry
+	now     func() time.Time
+}
+
+// Open loads the history, or returns nil if it isn't enabled. A broken history file is replaced on the next change.
+func Open(cfg *settings.Config) *History {
+	if !cfg.History.Enabled {
+		return nil
+	}
+	h := &History{cfg: cfg, path: GetPath(cfg), entries: []Entry{}, now: time.Now}
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[history] Unable to read history %s: %v\n", h.path, err)
+		}
+		return h
+	}
+	if err := json.Unmarshal(data, &h.entries); err != nil {
+		log.Printf("[history] Ignoring broken history %s: %v\n", h.path, err)
+		h.entries = []Entry{}
+	}
+	return h
+}
+
+// GetPath returns the path of the history, history.json next to the config file if it isn't set.
+func GetPath(cfg *settings.Config) string {
+	if cfg.History.Path != "" {
+		return cfg.History.Path
+	}
+	return filepath.Join(filepath.Dir(settings.ConfigPath()), "history.json")
+}
+
+// Path returns the path of the history.
+func (h *History) Path() string {
+	return h.path
+}
+
+// Record adds the state of the entry to the history, or merges it into the last entry if it has the same step.
+// The previous state (before the change) is added first, if it isn't the last entry (e.g. the device was reset).
+func (h *History) Record(previous State, entry Entry, step string) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = h.now().UTC()
+	}
+	if previous != (State{}) && (len(h.entries) == 0 || h.entries[len(h.entries)-1].State != previous) {
+		h.entries = append(h.entries, Entry{Time: entry.Time, Source: "device", State: previous})
+	}
+	if last := len(h.entries) - 1; last >= 0 && step != "" && h.entries[last].step == step {
+		h.entries[last].Time, h.entries[last].State = entry.Time, entry.State
+	} else if last < 0 || h.entries[last].State != entry.State {
+		entry.step = step
+		h.entries = append(h.entries, entry)
+	}
+	if size := settings.Snapshot(h.cfg).History.Size; size > 0 && len(h.entries) > size {
+		h.entries = append([]Entry{}, h.entries[len(h.entries)-size:]...)
+	}
+	h.save()
+}
+
+// List returns the entries, newest first: the first entry is the latest state, the next one step back and so on.
+func (h *History) List() []Entry {
+	if h == nil {
+		return []Entry{}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	entries := make([]Entry, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		entries = append(entries, h.entries[i])
+	}
+	return entries
+}
+
+// Drop removes the given number of entries, newest first (e.g. once they're undone).
+func (h *History) Drop(count int) {
+	if h == nil || count <= 0 {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if count > len(h.entries) {
+		count = len(h.entries)
+	}
+	h.entries = h.entries[:len(h.entries)-count]
+	h.save()
+}
+
+// save writes the history to its file, replacing it only once it's written.
+func (h *History) save() {
+	data, err := json.MarshalIndent(h.entries, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(h.path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(h.path+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(h.path+".tmp", h.path)
+	}
+	if err != nil {
+		log.Println("[history] Unable to save history: " + err.Error())
+	}
+}
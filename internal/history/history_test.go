@@ -0,0 +1,85 @@
+// DSUL - Disturb State USB Light : History module tests.
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestRecord(t *testing.T) {
+	cfg := settings.Config{History: settings.History{Enabled: true, Path: filepath.Join(t.TempDir(), "state", "history.json"), Size: 4}}
+	h := Open(&cfg)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	h.now = func() time.Time { return now }
+
+	green := State{Color: "0:255:0", Mode: "solid", Brightness: 50}
+	red := State{Color: "255:0:0", Mode: "solid", Brightness: 50}
+	red_blink := State{Color: "255:0:0", Mode: "blink", Brightness: 50}
+	red_blink_dim := State{Color: "255:0:0", Mode: "blink", Brightness: 100, Dim: true}
+	black := State{Color: "0:0:0", Mode: "solid", Brightness: 50}
+
+	h.Record(green, Entry{Source: "ipc", Client: "alice@laptop", State: red}, "a")
+	h.Record(red, Entry{Source: "ipc", State: red_blink}, "b")
+	h.Record(red_blink, Entry{Source: "ipc", State: red_blink_dim}, "b")     // same step, merged
+	h.Record(red_blink_dim, Entry{Source: "ipc", State: red_blink_dim}, "c") // nothing changed
+	h.Record(green, Entry{Source: "http", State: black}, "d")                // changed outside the history
+
+	tests := []struct {
+		name  string
+		entry Entry
+		want  Entry
+	}{
+		{"latest", h.List()[0], Entry{Source: "http", State: black}},
+		{"changed outside", h.List()[1], Entry{Source: "device", State: green}},
+		{"merged", h.List()[2], Entry{Source: "ipc", State: red_blink_dim}},
+		{"oldest", h.List()[3], Entry{Source: "ipc", Client: "alice@laptop", State: red}},
+	}
+	if len(h.List()) != 4 {
+		t.Fatalf("Wrong(List) == %+v, want 4 entries", h.List())
+	}
+	for _, test := range tests {
+		if test.entry.Source != test.want.Source || test.entry.Client != test.want.Client || test.entry.State != test.want.State || !test.entry.Time.Equal(now) {
+			t.Errorf("Wrong(%s) == %+v, want %+v", test.name, test.entry, test.want)
+		}
+	}
+
+	if info, err := os.Stat(cfg.History.Path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Wrong(history mode) == %v (%v), want %v", info.Mode().Perm(), err, os.FileMode(0600))
+	}
+	h.Drop(2)
+	loaded := Open(&cfg).List()
+	if len(loaded) != 2 || loaded[0].State != red_blink_dim || loaded[1].State != red {
+		t.Errorf("Wrong(loaded) == %+v, want the two oldest entries", loaded)
+	}
+
+	var disabled *History
+	disabled.Record(green, Entry{State: red}, "")
+	disabled.Drop(1)
+	if entries := disabled.List(); len(entries) != 0 {
+		t.Errorf("Wrong(nil history) == %+v, want no entries", entries)
+	}
+	cfg.History.Enabled = false
+	if h := Open(&cfg); h != nil {
+		t.Errorf("Wrong(disabled) == %+v, want nil", h)
+	}
+}
+
+func TestOpenBroken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	if err := os.WriteFile(path, []byte("[{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := settings.Config{History: settings.History{Enabled: true, Path: path, Size: 10}}
+	h := Open(&cfg)
+	if entries := h.List(); len(entries) != 0 {
+		t.Errorf("Wrong(broken) == %+v, want no entries", entries)
+	}
+	h.Record(State{}, Entry{Source: "ipc", State: State{Color: "255:0:0", Mode: "solid"}}, "")
+	if entries := Open(&cfg).List(); len(entries) != 1 {
+		t.Errorf("Wrong(replaced) == %+v, want one entry", entries)
+	}
+}
@@ -0,0 +1,220 @@
+// DSUL - Disturb State USB Light : IPC module, client
+package ipc
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/certs"
+	"github.com/hymnis/dsul-go/internal/settings"
+	"github.com/hymnis/dsul-go/internal/tokens"
+)
+
+const retryTime = time.Second / 2 // time to wait between connection attempts
+
+// session holds the nonce given by the server, the counter of the last signed request and the client's name, for a connection.
+type session struct {
+	nonce   string
+	counter uint64
+	client  string
+}
+
+// connect connects to the server, performs the handshake and checks that the protocol version is supported.
+// Connecting is retried until the timeout is reached (a timeout of 0 means retrying forever).
+func connect(cfg *settings.Config, timeout time.Duration) (net.Conn, *session, error) {
+	start_time := time.Now()
+	handshake_timeout := timeout
+	if handshake_timeout == 0 {
+		handshake_timeout = defaultTimeout
+	}
+	tls_config, err := getTLSConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		conn, err := dial(cfg, tls_config, handshake_timeout)
+		if err == nil {
+			_ = conn.SetDeadline(time.Now().Add(handshake_timeout)) // don't wait forever on an unresponsive server
+			if err = clientHandshake(conn); err == nil {
+				var nonce string
+				if nonce, err = hello(conn); err == nil {
+					_ = conn.SetDeadline(time.Time{})
+					return conn, &session{nonce: nonce, client: GetClient(cfg)}, nil
+				}
+			}
+			conn.Close()
+		}
+		var protocol_error *Error
+		if errors.As(err, &protocol_error) {
+			return nil, nil, err // server doesn't accept the client (or the other way around), retrying won't help
+		}
+		if timeout != 0 && time.Since(start_time) > timeout {
+			return nil, nil, fmt.Errorf("unable to connect to server: %s", err.Error())
+		}
+		time.Sleep(retryTime)
+	}
+}
+
+// dial connects to the socket, if it's present and the server is local, the network server, if one is set
+// (using TLS if configured), or the local socket.
+// A failed TLS handshake (e.g. the server's certificate isn't trusted) is returned as an auth_failed error.
+func dial(cfg *settings.Config, tls_config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if path := getSocketPath(cfg); path != "" {
+		return net.Dial("unix", path)
+	}
+	if cfg.Network.Server == "" {
+		return dialLocal("dsul")
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(cfg.Network.Server, strconv.Itoa(cfg.Network.Port)))
+	if err != nil || tls_config == nil {
+		return conn, err
+	}
+	tls_conn := tls.Client(conn, tls_config)
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if err := tls_conn.Handshake(); err != nil {
+		conn.Close()
+		var net_error net.Error
+		if errors.As(err, &net_error) && net_error.Timeout() {
+			return nil, err
+		}
+		return nil, &Error{Code: ErrAuthFailed, Message: "TLS handshake failed: " + err.Error()}
+	}
+	return tls_conn, nil
+}
+
+// getTLSConfig returns the TLS configuration to connect to the network server, or nil if TLS isn't used.
+func getTLSConfig(cfg *settings.Config) (*tls.Config, error) {
+	if cfg.Network.Server == "" || !cfg.Tls.Enabled {
+		return nil, nil
+	}
+	config, err := certs.ClientConfig(cfg, cfg.Network.Server)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use TLS: %v", err)
+	}
+	return config, nil
+}
+
+// clientHandshake receives the transport version and maximum message size from the server.
+// With TLS 1.3 a rejected client certificate is only reported here, as an auth_failed error.
+func clientHandshake(conn net.Conn) error {
+	buff := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buff); err != nil {
+		var op_error *net.OpError
+		if errors.As(err, &op_error) && op_error.Op == "remote error" {
+			return &Error{Code: ErrAuthFailed, Message: "TLS connection rejected by the server: " + op_error.Err.Error()}
+		}
+		return errors.New("failed to receive handshake")
+	}
+	if buff[0] != transportVersion || buff[1] != 0 {
+		_, _ = conn.Write([]byte{1})
+		return fmt.Errorf("server uses unsupported transport (version %d, encryption %d)", buff[0], buff[1])
+	}
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return errors.New("unable to send handshake reply")
+	}
+
+	buff = make([]byte, 8)
+	if _, err := io.ReadFull(conn, buff); err != nil {
+		return errors.New("failed to receive max message length")
+	}
+	if binary.BigEndian.Uint32(buff[:4]) != 4 {
+		return errors.New("invalid max message length received")
+	}
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return errors.New("unable to send message length reply")
+	}
+
+	return nil
+}
+
+// hello sends the protocol version to the server and returns the nonce to sign requests with.
+// An error is returned if the protocol version isn't supported.
+func hello(conn net.Conn) (string, error) {
+	request, _ := NewRequest(0, OpHello, "", HelloPayload{Version: ProtocolVersion})
+	if err := writeRequest(conn, request); err != nil {
+		return "", err
+	}
+	response, err := readResponse(conn)
+	if err != nil {
+		return "", err
+	}
+	if response.Error != nil {
+		return "", response.Error
+	}
+	result := HelloPayload{}
+	if err := response.Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid hello response: %v", err)
+	}
+	return result.Nonce, nil
+}
+
+// sign identifies the client in the request and signs it with its password or token, if it has one, using the next counter of the session.
+func (sess *session) sign(request *Request) {
+	request.Client = sess.client
+	if request.Secret == "" {
+		return
+	}
+	sess.counter += 1
+	request.Counter = sess.counter
+	if id, ok := tokens.Parse(request.Secret); ok {
+		request.Token = id
+		request.Signature = tokens.Prove(request.Secret, getMessage(sess.nonce, *request))
+		return
+	}
+	request.Signature = sign(request.Secret, sess.nonce, *request)
+}
+
+// GetSecret returns what requests are signed with: the token, if one is set, or the password.
+func GetSecret(cfg *settings.Config) string {
+	if cfg.Token != "" {
+		return cfg.Token
+	}
+	return cfg.Password
+}
+
+// GetClient returns the name the client is identified by in the audit log: the configured name, or user@host.
+func GetClient(cfg *settings.Config) string {
+	if cfg.Client != "" {
+		return cfg.Client
+	}
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	return name
+}
+
+// writeRequest sends a request to the server.
+func writeRequest(conn net.Conn, request Request) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return writeFrame(conn, protocolMessage, data)
+}
+
+// readResponse reads the next response from the server, skipping other message types.
+func readResponse(conn net.Conn) (Response, error) {
+	for {
+		msg_type, data, err := readFrame(conn)
+		if err != nil {
+			return Response{}, err
+		}
+		if msg_type != protocolMessage {
+			continue
+		}
+		return decodeResponse(data)
+	}
+}
@@ -4,12 +4,12 @@ package ipc
 import (
 	"bytes"
 	"encoding/gob"
-	"fmt"
 	"log"
+	"net"
 	"time"
 
+	"github.com/hymnis/dsul-go/internal/events"
 	"github.com/hymnis/dsul-go/internal/settings"
-	ipc "github.com/hymnis/golang-ipc"
 )
 
 var (
@@ -17,208 +17,143 @@ var (
 	debug   bool = false
 )
 
-// Message to send between IPC nodes.
+const defaultTimeout = time.Second * 5 // used if no valid timeout is configured
+
+// Message to send between IPC nodes. Client optionally identifies the client (for the audit log), it isn't verified.
+//
+// Deprecated: Message is the legacy (gob encoded) message format, use Request and Response instead.
 type Message struct {
 	Type   string
 	Key    string
 	Value  string
 	Secret string
+	Client string
 }
 
 // Runner parts //
 
-// ServerRunner starts runner for IPC server.
-func ServerRunner(cfg *settings.Config, output_handling struct {
+// ClientRunner starts runner for the IPC client.
+// Requests from ipc_request are sent as soon as they are received and responses are sent to ipc_response.
+// If the connection can't be opened, or is lost, the error is sent to ipc_error.
+func ClientRunner(cfg *settings.Config, output_handling struct {
 	Verbose bool
 	Debug   bool
-}, cmd_channel chan string, rsp_channel chan string) {
+}, ipc_request chan Request, ipc_response chan Response, ipc_error chan error) {
 	verbose = output_handling.Verbose
 	debug = output_handling.Debug
-	sc_config := &ipc.ServerConfig{
-		Network: false,
-	}
 
-	if cfg.Network.Listen {
-		sc_config = &ipc.ServerConfig{
-			Network:     true,
-			NetworkPort: cfg.Network.Port,
-		}
-	}
-	sc, err := ipc.StartServer("dsul", sc_config)
+	conn, sess, err := connect(cfg, GetTimeout(cfg))
 	if err != nil {
-		log.Println(err)
+		ipc_error <- err
 		return
 	}
+	if debug {
+		log.Printf("[ipc] Connected to: %s\n", conn.RemoteAddr())
+	}
 
-	out_channel := make(chan Message) // sent over IPC, in 'serverSend'
-	go responseHandler(rsp_channel, out_channel)
-	go serverReceive(cfg, sc, cmd_channel, out_channel)
-	go serverSend(sc, out_channel)
-
-	select {}
+	go clientReceive(conn, ipc_response, ipc_error)
+	clientSend(conn, sess, ipc_request, ipc_error)
 }
 
-// serverSend takes a message from out channel and sends it over the active connection.
-func serverSend(sc *ipc.Server, out_channel chan Message) {
-	for {
-		select {
-		case message := <-out_channel:
-			msg_str := encodeToBytes(message)
-			msg_type := 2 // 2 == data
-			_ = sc.Write(msg_type, msg_str)
-			if debug {
-				log.Printf("[ipc] Server Sent: %v\n", msg_str)
-			}
-			time.Sleep(time.Second / 30)
-		}
-	}
-}
+// WatchRunner starts runner for the IPC client, that subscribes to events and sends them to event_channel.
+// The connection is kept open, and re-opened if it's lost (e.g. when the daemon restarts), until the program exits
+// or the server refuses the subscription (the error is then sent to ipc_error).
+func WatchRunner(cfg *settings.Config, output_handling struct {
+	Verbose bool
+	Debug   bool
+}, event_channel chan events.Event, ipc_error chan error) {
+	verbose = output_handling.Verbose
+	debug = output_handling.Debug
+	subscribe, _ := NewRequest(1, OpSubscribe, GetSecret(cfg), SubscribePayload{Topic: "events"})
 
-// serverReceive handles the received data from the active connection.
-func serverReceive(cfg *settings.Config, sc *ipc.Server, cmd_channel chan string, out_channel chan Message) {
 	for {
-		m, err := sc.Read()
+		conn, sess, err := connect(cfg, 0) // no timeout, wait for daemon
+		if err != nil {
+			ipc_error <- err
+			return
+		}
+		if verbose {
+			log.Printf("[ipc] Connected to: %s\n", conn.RemoteAddr())
+		}
 
-		if err == nil {
-			if m.MsgType == 1 {
-				if debug {
-					log.Printf("[ipc] Server Received, auth: %v\n", m.Data)
-				}
-			}
-			if m.MsgType == 2 {
-				if debug {
-					log.Printf("[ipc] Server Received, data: %v\n", m.Data)
-				}
-				cmd := decodeToMessage(m.Data)
-				// Authentication if needed
-				if cfg.Password != "" && cfg.Password != cmd.Secret {
-					log.Printf("[ipc] Server Authentication failed\n")
-				} else {
-					if cmd.Type == "set" {
-						// Send "set" message to cmd_channel (received by serial module)
-						cmd_channel <- fmt.Sprintf("%s:%s", cmd.Key, cmd.Value)
-					} else if cmd.Type == "get" {
-						// Get and return information (to IPC client)
-						if cmd.Key == "information" {
-							if cmd.Value == "all" {
-								// Request hardware state, returned via rsp_channel
-								cmd_channel <- fmt.Sprintf("%s:%s", cmd.Key, cmd.Value)
-							}
-						}
-					}
-				}
-			}
-		} else {
+		sess.sign(&subscribe)
+		if err := writeRequest(conn, subscribe); err != nil {
 			log.Println("[ipc] Error: " + err.Error())
-			break
+		} else if err := watchReceive(conn, event_channel); err != nil {
+			conn.Close()
+			ipc_error <- err
+			return
 		}
-	}
-}
-
-// responseHandler routes response messages from serial device to out channel.
-func responseHandler(rsp_channel chan string, out_channel chan Message) {
-	for {
-		select {
-		case response := <-rsp_channel:
-			out_channel <- Message{"set", "response", response, ""} // action, key, value, secret
+		conn.Close()
+		if verbose {
+			log.Println("[ipc] Connection lost, reconnecting")
 		}
 	}
 }
 
-// ClientRunner starts runner for the IPC client.
-func ClientRunner(cfg *settings.Config, output_handling struct {
-	Verbose bool
-	Debug   bool
-}, ipc_message chan Message, ipc_response chan Message, done chan bool) {
-	verbose = output_handling.Verbose
-	debug = output_handling.Debug
-	cc_config := &ipc.ClientConfig{
-		Network: false,
-		Timeout: 5,
-	}
-
-	if cfg.Network.Server != "" {
-		cc_config = &ipc.ClientConfig{
-			Network:       true,
-			NetworkPort:   cfg.Network.Port,
-			NetworkServer: cfg.Network.Server,
-			Timeout:       5,
+// clientSend takes a request, signs it and sends it over the active connection, until the channel is closed.
+func clientSend(conn net.Conn, sess *session, ipc_request chan Request, ipc_error chan error) {
+	for request := range ipc_request {
+		sess.sign(&request)
+		if err := writeRequest(conn, request); err != nil {
+			ipc_error <- err
+			return
+		}
+		if debug {
+			log.Printf("[ipc] Client Sent, request: %d (%s)\n", request.ID, request.Op)
 		}
 	}
+}
 
-	cc, err := ipc.StartClient("dsul", cc_config)
-	if err != nil {
-		log.Println(err)
-		return
+// GetTimeout returns how long to wait for the server (to connect or respond), as set in the configuration.
+func GetTimeout(cfg *settings.Config) time.Duration {
+	timeout, err := time.ParseDuration(cfg.Network.Timeout)
+	if err != nil || timeout <= 0 {
+		return defaultTimeout
 	}
-
-	ready := make(chan bool) // used to determine when ready to send in 'clientSend'
-	go clientReceive(cc, ready, ipc_response)
-	go clientSend(cc, ready, ipc_message, done)
-
-	select {}
+	return timeout
 }
 
-// clientSend takes a message and sends it over the active connection.
-func clientSend(cc *ipc.Client, ready chan bool, ipc_message chan Message, done chan bool) {
-	select {
-	case <-ready:
-		for {
-			select {
-			case message, more := <-ipc_message:
-				if more { // channel is open and more data will come
-					// Data
-					msg_str := encodeToBytes(message)
-					msg_type := 2 // 2 == data
-					_ = cc.Write(msg_type, msg_str)
-					if debug {
-						log.Printf("[ipc] Client Sent, data: %v\n", msg_str)
-					}
-					time.Sleep(time.Second / 30)
-				} else { // channel has been closed by client
-					done <- true // send done message once all messages are handled and channel is closed
-					return       // exit functions since we are all done
-				}
-			}
+// clientReceive handles the received responses from the active connection.
+func clientReceive(conn net.Conn, ipc_response chan Response, ipc_error chan error) {
+	for {
+		response, err := readResponse(conn)
+		if err != nil {
+			// The connection has either been closed or a malformed response was received
+			ipc_error <- err
+			return
+		}
+		if debug {
+			log.Printf("[ipc] Client Received, response: %d (%s)\n", response.ID, response.Op)
 		}
+		ipc_response <- response
 	}
 }
 
-// clientReceive handles the received data from the active connection.
-func clientReceive(cc *ipc.Client, ready chan bool, ipc_response chan Message) {
+// watchReceive sends received events to event_channel. It returns when the connection fails,
+// or with the error if the subscription is refused.
+func watchReceive(conn net.Conn, event_channel chan events.Event) error {
 	for {
-		m, err := cc.Read()
-
+		response, err := readResponse(conn)
 		if err != nil {
-			// An error is only returned if the recieved channel has been closed,
-			// so you know the connection has either been intentionally closed or has timmed out waiting to connect/re-connect.
-			log.Fatal("[ipc] Error: ", err)
-		}
-
-		if m.MsgType == -1 { // message type -1 is status change
-			if m.Status == "Connected" {
-				ready <- true
+			if verbose {
+				log.Println("[ipc] Error: " + err.Error())
 			}
+			return nil
 		}
-
-		if m.MsgType == -2 { // message type -2 is an error, these won't automatically cause the recieve channel to close.
-			log.Println("[ipc] Error: " + err.Error())
+		if response.Error != nil {
+			return response.Error
 		}
-
-		if m.MsgType == 1 { // message type 1 is authentication
-			// ...
-			if debug {
-				log.Printf("[ipc] Client Received, auth: %v\n", m.Data)
-			}
+		if response.Op != OpEvent {
+			continue
 		}
 
-		if m.MsgType == 2 { // message type 2 is data (messages)
-			if debug {
-				log.Printf("[ipc] Client Received, data: %v\n", m.Data)
-			}
-			response := decodeToMessage(m.Data)
-			ipc_response <- response
+		e := events.Event{}
+		if err := response.Decode(&e); err != nil {
+			log.Println("[ipc] Invalid event received: " + err.Error())
+			continue
 		}
+		event_channel <- e
 	}
 }
 
@@ -234,14 +169,11 @@ func encodeToBytes(p interface{}) []byte {
 }
 
 // decodeToMessage takes a byte string and returns a Message.
-func decodeToMessage(input []byte) Message {
+func decodeToMessage(input []byte) (Message, error) {
 	cmd := Message{}
 	dec := gob.NewDecoder(bytes.NewReader(input))
 	err := dec.Decode(&cmd)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return cmd
+	return cmd, err
 }
 
 // decodeToString takes a byte string and returns a string.
@@ -2,26 +2,36 @@
 package ipc
 
 import (
-	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/audit"
+	"github.com/hymnis/dsul-go/internal/history"
+	"github.com/hymnis/dsul-go/internal/notify"
+	"github.com/hymnis/dsul-go/internal/settings"
+	"github.com/hymnis/dsul-go/internal/tokens"
 )
 
 func TestEncodeToBytes(t *testing.T) {
-	in_value := Message{"", "", "", ""}
-	out_value := encodeToBytes(in_value)
-	want := []byte{59, 255, 129, 3, 1, 1, 7, 77, 101, 115, 115, 97, 103, 101, 1, 255, 130, 0, 1, 4, 1, 4, 84, 121, 112, 101, 1, 12, 0, 1, 3, 75, 101, 121, 1, 12, 0, 1, 5, 86, 97, 108, 117, 101, 1, 12, 0, 1, 6, 83, 101, 99, 114, 101, 116, 1, 12, 0, 0, 0, 3, 255, 130, 0}
+	in_value := Message{"set", "color", "red", "secret", "dsulc"}
+	out_value, err := decodeToMessage(encodeToBytes(in_value))
 
-	if !bytes.Equal(out_value, want) {
-		t.Errorf("Wrong(%q) == %q, want %q", in_value, out_value, want)
+	if err != nil || out_value != in_value {
+		t.Errorf("Wrong(%q) == %q, want %q", in_value, out_value, in_value)
 	}
 }
 
 func TestDecodeToMessage(t *testing.T) {
 	in_value := []byte{59, 255, 129, 3, 1, 1, 7, 77, 101, 115, 115, 97, 103, 101, 1, 255, 130, 0, 1, 4, 1, 4, 84, 121, 112, 101, 1, 12, 0, 1, 3, 75, 101, 121, 1, 12, 0, 1, 5, 86, 97, 108, 117, 101, 1, 12, 0, 1, 6, 83, 101, 99, 114, 101, 116, 1, 12, 0, 0, 0, 3, 255, 130, 0}
-	out_value := decodeToMessage(in_value)
-	want := Message{"", "", "", ""}
+	out_value, err := decodeToMessage(in_value)
+	want := Message{"", "", "", "", ""}
 
-	if out_value != want {
+	if err != nil || out_value != want {
 		t.Errorf("Wrong(%q) == %q, want %q", in_value, out_value, want)
 	}
 }
@@ -35,3 +45,612 @@ func TestDecodeToString(t *testing.T) {
 		t.Errorf("Wrong(%q) == %q, want %q", in_value, out_value, want)
 	}
 }
+
+func TestFrame(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		_ = writeFrame(client, 2, []byte("example"))
+	}()
+	msg_type, data, err := readFrame(server)
+
+	if err != nil || msg_type != 2 || string(data) != "example" {
+		t.Errorf("Wrong frame (%d, %q, %v), want (%d, %q, nil)", msg_type, data, err, 2, "example")
+	}
+}
+
+func TestDecodeToMessageMalformed(t *testing.T) {
+	in_value := []byte{1, 2, 3}
+	if _, err := decodeToMessage(in_value); err == nil {
+		t.Errorf("Wrong(%q) decoded without error", in_value)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	request, err := NewRequest(7, OpSet, "secret", SetPayload{Key: "color", Value: "red"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(request)
+	out_value, err := decodeRequest(data)
+	payload := SetPayload{}
+
+	if err != nil || out_value.Decode(&payload) != nil || out_value.ID != 7 || out_value.Version != ProtocolVersion || payload.Value != "red" {
+		t.Errorf("Wrong(%s) == %+v (%+v), want %+v", data, out_value, payload, request)
+	}
+	if _, err := decodeRequest([]byte("{")); err == nil {
+		t.Errorf("Wrong(%q) decoded without error", "{")
+	}
+}
+
+func TestValidateSet(t *testing.T) {
+	cfg := &settings.Config{
+		Colors: []settings.Color{{Name: "red", Value: "255:0:0"}},
+		Modes:  []settings.Mode{{Name: "solid", Value: 1}},
+		States: []settings.State{
+			{Name: "busy", Color: "red", Mode: "solid"},
+			{Name: "broken", Color: "purple", Mode: "solid"},
+		},
+		BrightnessMin: 0,
+		BrightnessMax: 150,
+	}
+	tests := []struct {
+		in_value SetPayload
+		want     bool
+	}{
+		{SetPayload{"color", "red", ""}, true},
+		{SetPayload{"color", "0:255:0", ""}, true},
+		{SetPayload{"color", "purple", ""}, false},
+		{SetPayload{"brightness", "100", ""}, true},
+		{SetPayload{"brightness", "200", ""}, false},
+		{SetPayload{"mode", "solid", ""}, true},
+		{SetPayload{"mode", "strobe", ""}, false},
+		{SetPayload{"dim", "true", ""}, true},
+		{SetPayload{"dim", "yes", ""}, false},
+		{SetPayload{"state", "busy", ""}, true},
+		{SetPayload{"state", "broken", ""}, false},
+		{SetPayload{"state", "away", ""}, false},
+		{SetPayload{"volume", "11", ""}, false},
+	}
+
+	for _, test := range tests {
+		if out_value := validateSet(test.in_value, cfg) == nil; out_value != test.want {
+			t.Errorf("Wrong(%+v) == %t, want %t", test.in_value, out_value, test.want)
+		}
+	}
+}
+
+func TestConfigPayload(t *testing.T) {
+	tests := []struct {
+		in_value ConfigPayload
+		want     string
+	}{
+		{ConfigPayload{Action: "color-add", Name: "pink", Value: "255:105:180"}, "pink"},
+		{ConfigPayload{Action: "color-rename", Name: "red", NewName: "crimson"}, "crimson"},
+		{ConfigPayload{Action: "color-remove", Name: "red"}, "color 'red' is used by state 'busy'"},
+		{ConfigPayload{Action: "state-set", Name: "busy", Color: "red", Mode: "blink"}, "blink"},
+		{ConfigPayload{Action: "brightness-limits", Min: 0, Max: 300}, "brightness limits must be between 0 and 255, with min not above max (got 0-300)"},
+		{ConfigPayload{Action: "color-paint", Name: "red"}, "unknown action: 'color-paint'"},
+	}
+
+	for _, test := range tests {
+		cfg := &settings.Config{
+			Colors: []settings.Color{{Name: "red", Value: "255:0:0"}},
+			Modes:  []settings.Mode{{Name: "solid", Value: 1}, {Name: "blink", Value: 2}},
+			States: []settings.State{{Name: "busy", Color: "red", Mode: "solid"}},
+		}
+		out_value := ""
+		change, err := test.in_value.GetChange()
+		if err == nil {
+			err = settings.ApplyChange(cfg, change)
+		}
+		if err != nil {
+			out_value = err.Error()
+		} else {
+			palette := NewPalette(cfg)
+			out_value = palette.Colors[len(palette.Colors)-1].Name
+			if test.in_value.Action == "state-set" {
+				out_value = palette.States[0].Mode
+			}
+		}
+		if out_value != test.want {
+			t.Errorf("Wrong(%+v) == %q, want %q", test.in_value, out_value, test.want)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	server_conn, client_conn := net.Pipe()
+	defer server_conn.Close()
+	defer client_conn.Close()
+
+	s := server{cfg: &settings.Config{}}
+	go s.handleConnection(server_conn)
+
+	if err := clientHandshake(client_conn); err != nil {
+		t.Fatal(err)
+	}
+	if nonce, err := hello(client_conn); err != nil || len(nonce) != 64 {
+		t.Errorf("Wrong hello, got %q (%v)", nonce, err)
+	}
+
+	request, _ := NewRequest(2, OpHello, "", HelloPayload{Version: ProtocolVersion})
+	request.Version = ProtocolVersion + 1
+	_ = writeRequest(client_conn, request)
+	response, err := readResponse(client_conn)
+	if err != nil || response.Error == nil || response.Error.Code != ErrUnsupportedVersion || response.ID != 2 {
+		t.Errorf("Wrong response to unsupported version: %+v (%v)", response, err)
+	}
+
+	_ = writeFrame(client_conn, protocolMessage, []byte("not json"))
+	response, err = readResponse(client_conn)
+	if err != nil || response.Error == nil || response.Error.Code != ErrInvalidRequest {
+		t.Errorf("Wrong response to malformed request: %+v (%v)", response, err)
+	}
+}
+
+func TestClients(t *testing.T) {
+	notify_channel := make(chan notify.Command)
+	go func() {
+		for command := range notify_channel {
+			command.Response <- "ok"
+		}
+	}()
+	s := server{cfg: &settings.Config{}, notify_channel: notify_channel}
+
+	// Clients are handled at the same time, the first one stays connected while the second one is served
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		server_conn, client_conn := net.Pipe()
+		defer server_conn.Close()
+		defer client_conn.Close()
+		go s.handleConnection(server_conn)
+
+		if err := clientHandshake(client_conn); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client_conn)
+	}
+	for i := len(clients) - 1; i >= 0; i-- {
+		_ = writeFrame(clients[i], legacyMessage, encodeToBytes(Message{"notify", "play", "red:flash:1:0s", "", ""}))
+		msg_type, data, err := readFrame(clients[i])
+		response, _ := decodeToMessage(data)
+		want := Message{"set", "notify", "ok", "", ""}
+
+		if err != nil || msg_type != legacyMessage || response != want {
+			t.Errorf("Wrong response for client %d: %+v (%v), want %+v", i, response, err, want)
+		}
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	server_conn, client_conn := net.Pipe()
+	defer server_conn.Close()
+	defer client_conn.Close()
+
+	s := server{cfg: &settings.Config{}}
+	go s.handleConnection(server_conn)
+	if err := clientHandshake(client_conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hello(client_conn); err != nil {
+		t.Fatal(err)
+	}
+
+	config, _ := NewRequest(2, OpConfig, "", ConfigPayload{Action: "color-add", Name: "pink", Value: "255:0:128"})
+	token, _ := NewRequest(3, OpToken, "", TokenPayload{Action: "list"})
+	get, _ := NewRequest(4, OpGet, "", GetPayload{Key: "unknown"})
+	tests := []struct {
+		name    string
+		request Request
+		want    string // error code
+	}{
+		{"config", config, ErrAuthFailed},
+		{"token", token, ErrAuthFailed},
+		{"get", get, ErrInvalidValue},
+	}
+
+	for _, test := range tests {
+		if err := writeRequest(client_conn, test.request); err != nil {
+			t.Fatal(err)
+		}
+		response, err := readResponse(client_conn)
+		out_value := ""
+		if err == nil && response.Error != nil {
+			out_value = response.Error.Code
+		}
+		if out_value != test.want {
+			t.Errorf("Wrong(%s) == %q, want %q", test.name, out_value, test.want)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	server_conn, client_conn := net.Pipe()
+	defer server_conn.Close()
+	defer client_conn.Close()
+
+	s := server{cfg: &settings.Config{Password: "secret"}}
+	go s.handleConnection(server_conn)
+	if err := clientHandshake(client_conn); err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := hello(client_conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := session{nonce: nonce}
+
+	replayed, _ := NewRequest(2, OpGet, "secret", GetPayload{Key: "unknown"})
+	sess.sign(&replayed)
+	wrong_password, _ := NewRequest(3, OpGet, "wrong", GetPayload{Key: "unknown"})
+	sess.sign(&wrong_password)
+	tampered, _ := NewRequest(4, OpGet, "secret", GetPayload{Key: "unknown"})
+	sess.sign(&tampered)
+	tampered.Payload = []byte(`{"key":"other"}`)
+	unsigned, _ := NewRequest(5, OpGet, "", GetPayload{Key: "unknown"})
+	old_client, _ := NewRequest(6, OpGet, "", GetPayload{Key: "unknown"})
+	old_client.Version = 1
+	tests := []struct {
+		name    string
+		request Request
+		want    string // error code
+	}{
+		{"signed", replayed, ErrInvalidValue},
+		{"replayed", replayed, ErrAuthFailed},
+		{"wrong password", wrong_password, ErrAuthFailed},
+		{"tampered", tampered, ErrAuthFailed},
+		{"unsigned", unsigned, ErrAuthFailed},
+		{"old client", old_client, ErrUnsupportedVersion},
+	}
+
+	for _, test := range tests {
+		if err := writeRequest(client_conn, test.request); err != nil {
+			t.Fatal(err)
+		}
+		response, err := readResponse(client_conn)
+		out_value := ""
+		if err == nil && response.Error != nil {
+			out_value = response.Error.Code
+		}
+		if out_value != test.want {
+			t.Errorf("Wrong(%s) == %q, want %q", test.name, out_value, test.want)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	read_token, read_cfg, _ := tokens.New("dashboard", "read", nil)
+	set_token, set_cfg, _ := tokens.New("calendar", "control", []string{"set"})
+	unknown_token, _, _ := tokens.New("unknown", "admin", nil)
+
+	server_conn, client_conn := net.Pipe()
+	defer server_conn.Close()
+	defer client_conn.Close()
+
+	s := server{cfg: &settings.Config{Tokens: []settings.Token{read_cfg, set_cfg}}}
+	go s.handleConnection(server_conn)
+	if err := clientHandshake(client_conn); err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := hello(client_conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := session{nonce: nonce}
+
+	read_get, _ := NewRequest(2, OpGet, read_token, GetPayload{Key: "unknown"})
+	read_set, _ := NewRequest(3, OpSet, read_token, SetPayload{Key: "color", Value: "unknown"})
+	read_token_list, _ := NewRequest(4, OpToken, read_token, TokenPayload{Action: "list"})
+	set_set, _ := NewRequest(5, OpSet, set_token, SetPayload{Key: "color", Value: "unknown"})
+	set_get, _ := NewRequest(6, OpGet, set_token, GetPayload{Key: "unknown"})
+	unknown, _ := NewRequest(7, OpGet, unknown_token, GetPayload{Key: "unknown"})
+	password, _ := NewRequest(8, OpGet, "secret", GetPayload{Key: "unknown"})
+	tampered, _ := NewRequest(9, OpGet, read_token, GetPayload{Key: "unknown"})
+	for _, request := range []*Request{&read_get, &read_set, &read_token_list, &set_set, &set_get, &unknown, &password, &tampered} {
+		sess.sign(request)
+	}
+	tampered.Payload = []byte(`{"key":"other"}`)
+	tests := []struct {
+		name    string
+		request Request
+		want    string // error code
+	}{
+		{"read token get", read_get, ErrInvalidValue},
+		{"read token set", read_set, ErrForbidden},
+		{"read token list tokens", read_token_list, ErrForbidden},
+		{"set only token set", set_set, ErrInvalidValue},
+		{"set only token get", set_get, ErrForbidden},
+		{"unknown token", unknown, ErrAuthFailed},
+		{"password without password set", password, ErrAuthFailed},
+		{"tampered", tampered, ErrAuthFailed},
+	}
+
+	for _, test := range tests {
+		if err := writeRequest(client_conn, test.request); err != nil {
+			t.Fatal(err)
+		}
+		response, err := readResponse(client_conn)
+		out_value := ""
+		if err == nil && response.Error != nil {
+			out_value = response.Error.Code
+		}
+		if out_value != test.want {
+			t.Errorf("Wrong(%s) == %q, want %q", test.name, out_value, test.want)
+		}
+	}
+}
+
+func TestSocketRole(t *testing.T) {
+	cfg := settings.Config{Socket: settings.Socket{Role: "read", Roles: []settings.SocketRole{
+		{Group: "4300", Role: "control"},
+		{User: "alice", Role: "admin"},
+		{User: "4201", Role: "control"},
+	}}}
+	tests := []struct {
+		uid       uint32
+		name      string
+		group_ids []string
+		want      string
+	}{
+		{0, "root", []string{"0"}, "admin"},
+		{4200, "bob", []string{"4200"}, "read"},
+		{4200, "bob", []string{"4200", "4300"}, "control"},
+		{4201, "4201", []string{"4201"}, "control"},
+		{4202, "alice", []string{"4202", "4300"}, "admin"},
+	}
+	for _, test := range tests {
+		if got := getSocketRole(&cfg, test.uid, test.name, test.group_ids); got != test.want {
+			t.Errorf("Wrong(%s %v) == %q, want %q", test.name, test.group_ids, got, test.want)
+		}
+	}
+
+	cfg.Socket.Role = "none"
+	if got := getSocketRole(&cfg, 4200, "bob", []string{"4200"}); got != "none" {
+		t.Errorf("Wrong(bob, socket.role none) == %q, want %q", got, "none")
+	}
+}
+
+func TestSocket(t *testing.T) {
+	cfg := settings.Config{Socket: settings.Socket{Path: filepath.Join(t.TempDir(), "run", "dsul.sock"), Mode: "0660", Role: "read"}}
+	if runtime.GOOS != "linux" {
+		if _, err := listenSocket(&cfg); err == nil {
+			t.Errorf("Wrong(listenSocket) == nil, want error without peer credentials")
+		}
+		return
+	}
+	listener, err := listenSocket(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(cfg.Socket.Path); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("Wrong(%s) == %v (%v), want -rw-rw----", cfg.Socket.Path, info.Mode().Perm(), err)
+	}
+	s := server{cfg: &cfg}
+	go s.accept(listener, true)
+
+	// The daemon's own user is an admin
+	conn, sess, err := connect(&cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request, _ := NewRequest(2, OpToken, "", TokenPayload{Action: "list"})
+	sess.sign(&request)
+	if err := writeRequest(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := readResponse(conn); err != nil || response.Error != nil {
+		t.Errorf("Wrong(token list on socket) == %+v (%v), want no error", response.Error, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(filepath.Dir(cfg.Socket.Path), "other.sock"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	other := settings.Config{Socket: settings.Socket{Path: filepath.Join(filepath.Dir(cfg.Socket.Path), "other.sock"), Mode: "0660"}}
+	if _, err := listenSocket(&other); err == nil {
+		t.Errorf("Wrong(listenSocket) on a file == nil, want error")
+	}
+	if path := getSocketPath(&other); path != "" {
+		t.Errorf("Wrong(getSocketPath) on a file == %q, want \"\"", path)
+	}
+	cfg.Network.Server = "lamp.example.com"
+	if path := getSocketPath(&cfg); path != "" {
+		t.Errorf("Wrong(getSocketPath) with a network server == %q, want \"\"", path)
+	}
+}
+
+func TestSocketPeer(t *testing.T) {
+	server_conn, client_conn := net.Pipe()
+	defer server_conn.Close()
+	defer client_conn.Close()
+
+	s := server{cfg: &settings.Config{Password: "secret"}}
+	go s.serve(server_conn, client{address: "bob (uid 4200, pid 1)", peer: &settings.Token{Name: "bob", Role: "read"}})
+	if err := clientHandshake(client_conn); err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := hello(client_conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := session{nonce: nonce}
+
+	get, _ := NewRequest(2, OpGet, "", GetPayload{Key: "unknown"})
+	set, _ := NewRequest(3, OpSet, "", SetPayload{Key: "color", Value: "unknown"})
+	signed_set, _ := NewRequest(4, OpSet, "secret", SetPayload{Key: "color", Value: "unknown"})
+	wrong_password, _ := NewRequest(5, OpGet, "wrong", GetPayload{Key: "unknown"})
+	legacy := encodeToBytes(Message{"set", "color", "red", "", ""})
+	for _, request := range []*Request{&get, &set, &signed_set, &wrong_password} {
+		sess.sign(request)
+	}
+	tests := []struct {
+		name    string
+		request Request
+		want    string // error code
+	}{
+		{"get by role", get, ErrInvalidValue},
+		{"set by role", set, ErrForbidden},
+		{"set with password", signed_set, ErrInvalidValue},
+		{"wrong password", wrong_password, ErrAuthFailed},
+	}
+	for _, test := range tests {
+		if err := writeRequest(client_conn, test.request); err != nil {
+			t.Fatal(err)
+		}
+		response, err := readResponse(client_conn)
+		out_value := ""
+		if err == nil && response.Error != nil {
+			out_value = response.Error.Code
+		}
+		if out_value != test.want {
+			t.Errorf("Wrong(%s) == %q, want %q", test.name, out_value, test.want)
+		}
+	}
+
+	if err := writeFrame(client_conn, legacyMessage, legacy); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := readFrame(client_conn)
+	if message, _ := decodeToMessage(data); err != nil || message.Value != "nok" {
+		t.Errorf("Wrong(legacy message on socket) == %+v (%v), want nok", message, err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	read_token, read_cfg, _ := tokens.New("dashboard", "read", nil)
+	admin_token, admin_cfg, _ := tokens.New("laptop", "admin", nil)
+	cfg := settings.Config{
+		Tokens: []settings.Token{read_cfg, admin_cfg},
+		Audit:  settings.Audit{Enabled: true, Path: filepath.Join(t.TempDir(), "audit.log")},
+	}
+	audit_log, err := audit.Open(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server_conn, client_conn := net.Pipe()
+	defer server_conn.Close()
+	defer client_conn.Close()
+
+	s := server{cfg: &cfg, audit_log: audit_log}
+	go s.handleConnection(server_conn)
+	if err := clientHandshake(client_conn); err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := hello(client_conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := session{nonce: nonce, client: "alice@laptop"}
+
+	read_get, _ := NewRequest(2, OpGet, read_token, GetPayload{Key: "palette"})
+	read_set, _ := NewRequest(3, OpSet, read_token, SetPayload{Key: "color", Value: "magenta"})
+	admin_set, _ := NewRequest(4, OpSet, admin_token, SetPayload{Key: "color", Value: "unknown"})
+	admin_config, _ := NewRequest(5, OpConfig, admin_token, ConfigPayload{Action: "color-add", Name: "pink", Value: "300:0:0"})
+	unsigned, _ := NewRequest(6, OpFocus, "", FocusPayload{Action: "stop"})
+	read_log, _ := NewRequest(7, OpLog, read_token, LogPayload{})
+	admin_log, _ := NewRequest(8, OpLog, admin_token, LogPayload{Source: "ipc"})
+	for _, request := range []*Request{&read_get, &read_set, &admin_set, &admin_config, &unsigned, &read_log, &admin_log} {
+		sess.sign(request)
+	}
+	for _, request := range []Request{read_get, read_set, admin_set, admin_config, unsigned, read_log} {
+		if err := writeRequest(client_conn, request); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readResponse(client_conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeRequest(client_conn, admin_log); err != nil {
+		t.Fatal(err)
+	}
+	response, err := readResponse(client_conn)
+	entries := []audit.Entry{}
+	if err != nil || response.Error != nil || response.Decode(&entries) != nil {
+		t.Fatalf("Wrong(log) == %v (%v), want entries", response.Error, err)
+	}
+
+	want := []audit.Entry{
+		{Source: "ipc", Identity: audit.Identity{Auth: "token dashboard", Client: "alice@laptop"}, Op: "set", Key: "color", Value: "magenta", Result: ErrForbidden},
+		{Source: "ipc", Identity: audit.Identity{Auth: "token laptop", Client: "alice@laptop"}, Op: "set", Key: "color", Value: "unknown", Result: ErrInvalidValue},
+		{Source: "ipc", Identity: audit.Identity{Auth: "token laptop", Client: "alice@laptop"}, Op: "config", Key: "color-add", Value: `{"name":"pink","value":"300:0:0"}`, Result: ErrInvalidValue},
+		{Source: "ipc", Identity: audit.Identity{Client: "alice@laptop"}, Op: "focus", Key: "stop", Result: ErrAuthFailed},
+		{Source: "ipc", Identity: audit.Identity{Auth: "token dashboard", Client: "alice@laptop"}, Op: "log", Result: ErrForbidden},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("Wrong(log) == %d entries %+v, want %d", len(entries), entries, len(want))
+	}
+	for i, entry := range entries {
+		if entry.Peer != "pipe" || entry.Time.IsZero() || entry.Message == "" {
+			t.Errorf("Wrong(entry %d) == %+v, want peer, time and message", i, entry)
+		}
+		entry.Peer, entry.Time, entry.Message = "", time.Time{}, ""
+		if entry != want[i] {
+			t.Errorf("Wrong(entry %d) == %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	read_token, read_cfg, _ := tokens.New("dashboard", "read", nil)
+	control_token, control_cfg, _ := tokens.New("laptop", "control", nil)
+	cfg := settings.Config{
+		Tokens:  []settings.Token{read_cfg, control_cfg},
+		History: settings.History{Enabled: true, Path: filepath.Join(t.TempDir(), "history.json"), Size: 10},
+	}
+	state_history := history.Open(&cfg)
+	state_history.Record(history.State{Color: "0:255:0", Mode: "solid"}, history.Entry{Source: "ipc", State: history.State{Color: "0:0:0", Mode: "solid"}}, "")
+
+	server_conn, client_conn := net.Pipe()
+	defer server_conn.Close()
+	defer client_conn.Close()
+
+	s := server{cfg: &cfg, history: state_history}
+	go s.handleConnection(server_conn)
+	if err := clientHandshake(client_conn); err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := hello(client_conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := session{nonce: nonce}
+
+	tests := []struct {
+		name    string
+		token   string
+		payload HistoryPayload
+		want    string // error code, empty if the request should succeed
+	}{
+		{"list", read_token, HistoryPayload{Action: "list"}, ""},
+		{"undo with read token", read_token, HistoryPayload{Action: "undo"}, ErrForbidden},
+		{"restore negative", control_token, HistoryPayload{Action: "restore", Index: -1}, ErrInvalidValue},
+		{"unknown action", control_token, HistoryPayload{Action: "redo"}, ErrInvalidValue},
+	}
+	for i, test := range tests {
+		request, _ := NewRequest(uint64(i+2), OpHistory, test.token, test.payload)
+		sess.sign(&request)
+		if err := writeRequest(client_conn, request); err != nil {
+			t.Fatal(err)
+		}
+		response, err := readResponse(client_conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.want == "" && response.Error != nil {
+			t.Errorf("Wrong(%s) == %v, want no error", test.name, response.Error)
+		} else if test.want != "" && (response.Error == nil || response.Error.Code != test.want) {
+			t.Errorf("Wrong(%s) == %v, want %s", test.name, response.Error, test.want)
+		}
+		if test.name == "list" {
+			entries := []history.Entry{}
+			if err := response.Decode(&entries); err != nil || len(entries) != 2 || entries[0].Color != "0:0:0" || entries[1].Source != "device" {
+				t.Errorf("Wrong(list) == %+v (%v), want the set state and the device state", entries, err)
+			}
+		}
+	}
+}
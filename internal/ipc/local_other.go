@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+// DSUL - Disturb State USB Light : IPC module, local connection (unix socket)
+package ipc
+
+import (
+	"net"
+	"os"
+)
+
+// listenLocal returns a listener for the unix socket with the given name.
+func listenLocal(name string) (net.Listener, error) {
+	path := "/tmp/" + name + ".sock"
+	if err := os.RemoveAll(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// dialLocal connects to the unix socket with the given name.
+func dialLocal(name string) (net.Conn, error) {
+	return net.Dial("unix", "/tmp/"+name+".sock")
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+// DSUL - Disturb State USB Light : IPC module, local connection (named pipe)
+package ipc
+
+import (
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// listenLocal returns a listener for the named pipe with the given name.
+func listenLocal(name string) (net.Listener, error) {
+	return winio.ListenPipe(`\\.\pipe\`+name, nil)
+}
+
+// dialLocal connects to the named pipe with the given name.
+func dialLocal(name string) (net.Conn, error) {
+	return winio.DialPipe(`\\.\pipe\`+name, nil)
+}
@@ -0,0 +1,336 @@
+// DSUL - Disturb State USB Light : IPC module, protocol
+package ipc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hymnis/dsul-go/internal/serial"
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+// Protocol messages are JSON encoded requests and responses, sent as their own message type.
+// Legacy messages (gob encoded Message's) are still handled by the server, but are deprecated.
+// If a password (or tokens) is set, requests are signed: see Request.
+const (
+	ProtocolVersion = 2 // current protocol version, requests are signed instead of carrying the password since version 2
+	legacyMessage   = 2 // message type used for legacy messages
+	protocolMessage = 3 // message type used for protocol messages
+)
+
+// Operations that can be requested.
+const (
+	OpHello     = "hello"     // protocol version handshake
+	OpSet       = "set"       // set a device value
+	OpGet       = "get"       // get device information
+	OpFocus     = "focus"     // control the focus timer
+	OpNotify    = "notify"    // show a notification
+	OpSubscribe = "subscribe" // receive events
+	OpConfig    = "config"    // change colors, states or brightness limits
+	OpToken     = "token"     // create, list or revoke tokens
+	OpLog       = "log"       // read the audit log
+	OpHistory   = "history"   // list or restore applied states
+	OpEvent     = "event"     // event sent to subscribed clients (response only)
+)
+
+// Error codes used in error responses.
+const (
+	ErrInvalidRequest     = "invalid_request"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrUnknownOp          = "unknown_op"
+	ErrAuthFailed         = "auth_failed"
+	ErrForbidden          = "forbidden"
+	ErrInvalidValue       = "invalid_value"
+	ErrDeviceOffline      = "device_offline"
+	ErrDeviceRejected     = "device_rejected"
+	ErrSaveFailed         = "save_failed"
+	ErrLogFailed          = "log_failed"
+)
+
+// Request is sent by the client. The ID is returned in the response(s) to the request.
+// The signature is a HMAC-SHA256 (hex encoded), keyed with the password, over the nonce given by the server in the hello
+// response, the counter, ID, operation and payload (see getMessage). The counter must increase with every request on a connection.
+// Requests signed with a token give the token's ID, and a proof of the token as signature (see tokens.Prove).
+// Client optionally identifies the client (e.g. "alice@laptop") in the daemon's audit log, it isn't signed or verified.
+type Request struct {
+	Version   int             `json:"version"`
+	ID        uint64          `json:"id"`
+	Op        string          `json:"op"`
+	Counter   uint64          `json:"counter,omitempty"`
+	Token     string          `json:"token,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+	Client    string          `json:"client,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Secret    string          `json:"-"` // password or token to sign the request with, it's never sent
+}
+
+// Response is sent by the server, either with a result or an error.
+type Response struct {
+	Version int             `json:"version"`
+	ID      uint64          `json:"id"`
+	Op      string          `json:"op"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error is a structured error, sent in responses.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// HelloPayload is the payload and result of a hello request. The result holds the nonce to sign requests with.
+type HelloPayload struct {
+	Version int    `json:"version"`
+	Nonce   string `json:"nonce,omitempty"`
+}
+
+// SetPayload is the payload of a set request. Key is one of: color, brightness, mode, dim or state.
+// Setting a state sets the mode and color configured for it (in that order).
+// Sets with the same step, on one connection, are one step in the state history (e.g. a color, mode and brightness
+// set together). Each set request is a step of its own if no step is given.
+type SetPayload struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Step  string `json:"step,omitempty"`
+}
+
+// GetPayload is the payload of a get request. Key is one of: information or state (result is settings.Hardware),
+// devices (result is a list of Device) or palette (result is Palette).
+type GetPayload struct {
+	Key string `json:"key"`
+}
+
+// Device describes a device handled by the daemon. Hardware values are only set if the device is connected.
+type Device struct {
+	Port          string `json:"port"`
+	Connected     bool   `json:"connected"`
+	Version       string `json:"version,omitempty"`
+	Leds          int    `json:"leds"`
+	BrightnessMin int    `json:"brightness_min"`
+	BrightnessMax int    `json:"brightness_max"`
+}
+
+// Palette holds the values configured in the daemon.
+type Palette struct {
+	Colors        []PaletteColor `json:"colors"`
+	Modes         []string       `json:"modes"`
+	States        []PaletteState `json:"states"`
+	BrightnessMin int            `json:"brightness_min"`
+	BrightnessMax int            `json:"brightness_max"`
+}
+
+// PaletteColor is a configured color.
+type PaletteColor struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PaletteState is a configured state.
+type PaletteState struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+	Mode  string `json:"mode"`
+}
+
+// FocusPayload is the payload of a focus request (result is focus.Status).
+// Action is one of: start, stop, pause, resume or status. Empty start values use the daemon's defaults.
+type FocusPayload struct {
+	Action    string `json:"action"`
+	Duration  string `json:"duration,omitempty"`
+	Break     string `json:"break,omitempty"`
+	LongBreak string `json:"long_break,omitempty"`
+	Cycles    int    `json:"cycles,omitempty"`
+}
+
+// NotifyPayload is the payload of a notify request.
+type NotifyPayload struct {
+	Color    string `json:"color"`
+	Pattern  string `json:"pattern"`
+	Count    int    `json:"count,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// ConfigPayload is the payload of a config request (result is Palette, with the change applied).
+// Action is one of: color-add (name and value), color-remove (name), color-rename (name and new name),
+// state-set (name, color and mode), state-remove (name) or brightness-limits (min and max).
+// Changes are saved in the daemon's config file.
+type ConfigPayload struct {
+	Action  string `json:"action"`
+	Name    string `json:"name,omitempty"`
+	NewName string `json:"new_name,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Color   string `json:"color,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+	Min     int    `json:"min,omitempty"`
+	Max     int    `json:"max,omitempty"`
+}
+
+// TokenPayload is the payload of a token request. Action is one of: create (name, role and optionally operations,
+// result is TokenInfo with the token), list (result is a list of TokenInfo) or revoke (name).
+// Tokens are saved in the daemon's config file.
+type TokenPayload struct {
+	Action     string   `json:"action"`
+	Name       string   `json:"name,omitempty"`
+	Role       string   `json:"role,omitempty"`
+	Operations []string `json:"operations,omitempty"`
+}
+
+// TokenInfo describes a token. The token itself is only given when it's created, it can't be shown later.
+type TokenInfo struct {
+	Name       string   `json:"name"`
+	ID         string   `json:"id"`
+	Role       string   `json:"role"`
+	Operations []string `json:"operations,omitempty"`
+	Created    string   `json:"created"`
+	Token      string   `json:"token,omitempty"`
+}
+
+// LogPayload is the payload of a log request (result is a list of audit.Entry). Since is given in RFC 3339 format,
+// source is one of: ipc, http, focus or notify. Only the last entries are returned if a limit is given.
+type LogPayload struct {
+	Since  string `json:"since,omitempty"`
+	Source string `json:"source,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// HistoryPayload is the payload of a history request. Action is one of: list (result is a list of history.Entry, newest first),
+// undo (restore the state before the current one) or restore (the state index steps back, as listed).
+// Result of undo and restore is the restored history.Entry.
+type HistoryPayload struct {
+	Action string `json:"action"`
+	Index  int    `json:"index,omitempty"`
+}
+
+// SubscribePayload is the payload of a subscribe request. Topic is: events (result of event responses is events.Event).
+type SubscribePayload struct {
+	Topic string `json:"topic"`
+}
+
+// NewPalette returns the palette of the given configuration. Brightness limits are limited to those of the device, if connected.
+func NewPalette(cfg *settings.Config) Palette {
+	brightness_min, brightness_max := serial.GetBrightnessLimits(cfg)
+	palette := Palette{
+		Colors:        []PaletteColor{},
+		Modes:         []string{},
+		States:        []PaletteState{},
+		BrightnessMin: brightness_min,
+		BrightnessMax: brightness_max,
+	}
+	for _, cfg_color := range cfg.Colors {
+		palette.Colors = append(palette.Colors, PaletteColor{Name: cfg_color.Name, Value: cfg_color.Value})
+	}
+	for _, cfg_mode := range cfg.Modes {
+		palette.Modes = append(palette.Modes, cfg_mode.Name)
+	}
+	for _, cfg_state := range cfg.States {
+		palette.States = append(palette.States, PaletteState{Name: cfg_state.Name, Color: cfg_state.Color, Mode: cfg_state.Mode})
+	}
+	return palette
+}
+
+// GetChange returns the configuration change requested.
+func (p ConfigPayload) GetChange() (settings.Change, error) {
+	switch p.Action {
+	case "color-add":
+		return settings.AddColor(p.Name, p.Value), nil
+	case "color-remove":
+		return settings.RemoveColor(p.Name), nil
+	case "color-rename":
+		return settings.RenameColor(p.Name, p.NewName), nil
+	case "state-set":
+		return settings.SetState(p.Name, p.Color, p.Mode), nil
+	case "state-remove":
+		return settings.RemoveState(p.Name), nil
+	case "brightness-limits":
+		return settings.SetBrightnessLimits(p.Min, p.Max), nil
+	}
+	return nil, fmt.Errorf("unknown action: '%s'", p.Action)
+}
+
+// Error returns the error as a string.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NewRequest returns a request for the given operation and payload.
+func NewRequest(id uint64, op string, secret string, payload interface{}) (Request, error) {
+	request := Request{Version: ProtocolVersion, ID: id, Op: op, Secret: secret}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return request, err
+		}
+		request.Payload = data
+	}
+	return request, nil
+}
+
+// NewTokenInfo returns the description of the configured token.
+func NewTokenInfo(cfg_token settings.Token) TokenInfo {
+	return TokenInfo{Name: cfg_token.Name, ID: cfg_token.ID, Role: cfg_token.Role, Operations: cfg_token.Operations, Created: cfg_token.Created}
+}
+
+// sign returns the signature of the request, for the nonce given by the server.
+func sign(password string, nonce string, request Request) string {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(getMessage(nonce, request))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getMessage returns what's signed of the request: the nonce, counter, ID and operation (each followed by a newline) and the payload.
+func getMessage(nonce string, request Request) []byte {
+	return append([]byte(fmt.Sprintf("%s\n%d\n%d\n%s\n", nonce, request.Counter, request.ID, request.Op)), request.Payload...)
+}
+
+// Decode decodes the request payload into the given value.
+func (r Request) Decode(value interface{}) error {
+	if len(r.Payload) == 0 {
+		return errors.New("payload is missing")
+	}
+	return json.Unmarshal(r.Payload, value)
+}
+
+// Decode decodes the response result into the given value.
+func (r Response) Decode(value interface{}) error {
+	if len(r.Result) == 0 {
+		return errors.New("result is missing")
+	}
+	return json.Unmarshal(r.Result, value)
+}
+
+// newResponse returns a response to the request, with the given result (if any).
+func newResponse(request Request, result interface{}) Response {
+	response := Response{Version: ProtocolVersion, ID: request.ID, Op: request.Op}
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return newErrorResponse(request, ErrInvalidRequest, err.Error())
+		}
+		response.Result = data
+	}
+	return response
+}
+
+// newErrorResponse returns an error response to the request.
+func newErrorResponse(request Request, code string, message string) Response {
+	return Response{Version: ProtocolVersion, ID: request.ID, Op: request.Op, Error: &Error{Code: code, Message: message}}
+}
+
+// decodeRequest takes a byte string and returns a Request.
+func decodeRequest(input []byte) (Request, error) {
+	request := Request{}
+	err := json.Unmarshal(input, &request)
+	return request, err
+}
+
+// decodeResponse takes a byte string and returns a Response.
+func decodeResponse(input []byte) (Response, error) {
+	response := Response{}
+	err := json.Unmarshal(input, &response)
+	return response, err
+}
@@ -0,0 +1,916 @@
+// DSUL - Disturb State USB Light : IPC module, server
+package ipc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/access"
+	"github.com/hymnis/dsul-go/internal/audit"
+	"github.com/hymnis/dsul-go/internal/certs"
+	"github.com/hymnis/dsul-go/internal/events"
+	"github.com/hymnis/dsul-go/internal/focus"
+	"github.com/hymnis/dsul-go/internal/history"
+	"github.com/hymnis/dsul-go/internal/notify"
+	"github.com/hymnis/dsul-go/internal/serial"
+	"github.com/hymnis/dsul-go/internal/settings"
+	"github.com/hymnis/dsul-go/internal/tokens"
+)
+
+// The server speaks the same (unencrypted) wire protocol as golang-ipc, so older clients can still connect,
+// but handles any number of connected clients at the same time.
+const (
+	transportVersion = 2       // golang-ipc protocol version
+	maxMessageSize   = 3145728 // maximum bytes allowed for each message
+)
+
+// server holds the configuration and channels used to handle messages from clients.
+type server struct {
+	cfg                *settings.Config // shared, read through settings.Snapshot
+	cmd_channel        chan serial.Command
+	focus_channel      chan focus.Command
+	notify_channel     chan notify.Command
+	subscriber_channel chan events.Subscriber
+	guard              *access.Guard    // checks peers in network mode (nil for the local socket)
+	audit_log          *audit.Log       // records requests, nil if disabled
+	history            *history.History // applied states, nil if disabled
+}
+
+// client holds a connection to a client and the messages to send to it.
+type client struct {
+	conn         net.Conn
+	out_channel  chan frame
+	done         chan bool
+	subscription chan events.Event
+	legacy       bool            // client has sent legacy messages
+	nonce        string          // given in the hello response, requests are signed with it
+	counter      uint64          // counter of the last authenticated request
+	address      string          // address of the client (or its user, on the socket), for logs
+	peer         *settings.Token // role of the client's user, on the socket
+	guard        *access.Guard   // checks the client, in network mode
+}
+
+// frame is a message, of the given type, to send.
+type frame struct {
+	msg_type int
+	data     []byte
+}
+
+// Runner parts //
+
+// ServerRunner starts runner for IPC server. In network mode peers are checked by the guard.
+// Requests are recorded in the audit log, except those only reading values.
+func ServerRunner(cfg *settings.Config, output_handling struct {
+	Verbose bool
+	Debug   bool
+}, guard *access.Guard, audit_log *audit.Log, state_history *history.History, cmd_channel chan serial.Command, focus_channel chan focus.Command, notify_channel chan notify.Command, subscriber_channel chan events.Subscriber) {
+	verbose = output_handling.Verbose
+	debug = output_handling.Debug
+	s := &server{
+		cfg:                cfg,
+		cmd_channel:        cmd_channel,
+		focus_channel:      focus_channel,
+		notify_channel:     notify_channel,
+		subscriber_channel: subscriber_channel,
+		audit_log:          audit_log,
+		history:            state_history,
+	}
+	if cfg.Network.Listen {
+		s.guard = guard
+	}
+
+	if cfg.Socket.Path != "" {
+		socket_listener, err := listenSocket(cfg)
+		if err != nil {
+			log.Printf("[ipc] Unable to use socket %s: %v\n", cfg.Socket.Path, err)
+			if !cfg.Network.Listen {
+				log.Println("[ipc] Using the default local socket instead")
+			}
+		} else if !cfg.Network.Listen {
+			s.accept(socket_listener, true) // the socket is used instead of the local socket
+			return
+		} else {
+			go s.accept(socket_listener, true)
+		}
+	}
+	listener, err := listen(cfg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.accept(listener, false)
+}
+
+// accept handles connections to the listener. Clients connected to the socket get the role of their user,
+// other clients are checked by the guard.
+func (s *server) accept(listener net.Listener, socket bool) {
+	if verbose {
+		log.Printf("[ipc] Listening on: %s\n", listener.Addr())
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("[ipc] Error: " + err.Error())
+			return
+		}
+		if socket {
+			go s.handleSocketConnection(conn)
+			continue
+		}
+		if !s.guard.Allowed(conn.RemoteAddr().String()) {
+			log.Printf("[ipc] Connection from %s rejected, not allowed by access.allow/access.deny\n", conn.RemoteAddr())
+			s.audit_log.Record(audit.Entry{Source: "ipc", Identity: audit.Identity{Peer: conn.RemoteAddr().String()}, Op: "connect", Result: ErrForbidden, Message: "not allowed by access.allow/access.deny"})
+			conn.Close()
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// listen returns a listener for the network port, if network mode is enabled, or the local socket.
+// The network port is opened on the configured address (or all interfaces) and uses TLS, if enabled.
+func listen(cfg *settings.Config) (net.Listener, error) {
+	if !cfg.Network.Listen {
+		return listenLocal("dsul")
+	}
+	address := net.JoinHostPort(cfg.Network.Address, strconv.Itoa(cfg.Network.Port))
+	if !cfg.Tls.Enabled {
+		log.Println("[ipc] Network mode without TLS, messages are not encrypted")
+		return net.Listen("tcp", address)
+	}
+	config, err := certs.ServerConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("[ipc] Unable to use TLS: %v", err)
+	}
+	return tls.Listen("tcp", address, config)
+}
+
+// handleSocketConnection handles a client connected to the socket, with the role of its user.
+func (s *server) handleSocketConnection(conn net.Conn) {
+	cfg := settings.Snapshot(s.cfg)
+	peer, description, err := getPeer(cfg, conn)
+	if err != nil {
+		log.Printf("[ipc] Connection to socket rejected: %v\n", err)
+		conn.Close()
+		return
+	}
+	if debug {
+		log.Printf("[ipc] Socket client %s has role: %s\n", description, peer.Role)
+	}
+	s.serve(conn, client{address: description, peer: peer})
+}
+
+// handleConnection performs the TLS handshake, if used, with a newly connected client and handles its messages.
+func (s *server) handleConnection(conn net.Conn) {
+	if tls_conn, ok := conn.(*tls.Conn); ok {
+		_ = conn.SetDeadline(time.Now().Add(defaultTimeout))
+		if err := tls_conn.Handshake(); err != nil {
+			log.Printf("[ipc] TLS handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+	}
+	address := conn.RemoteAddr().String()
+	if address == "" || address == "@" {
+		address = "local" // unnamed peer on the local socket
+	}
+	s.serve(conn, client{address: address, guard: s.guard})
+}
+
+// serve performs the handshake with the client and handles its messages, until it disconnects.
+func (s *server) serve(conn net.Conn, c client) {
+	defer conn.Close()
+	if err := serverHandshake(conn); err != nil {
+		log.Printf("[ipc] Handshake with %s failed: %v\n", c.address, err)
+		return
+	}
+	if debug {
+		log.Printf("[ipc] Client connected: %s\n", c.address)
+	}
+
+	c.conn, c.out_channel, c.done, c.nonce = conn, make(chan frame), make(chan bool), newNonce()
+	go serverSend(&c)
+	s.serverReceive(&c)
+	close(c.done)
+
+	if debug {
+		log.Printf("[ipc] Client disconnected: %s\n", c.address)
+	}
+}
+
+// serverSend takes a message from out channel and sends it to the client.
+func serverSend(c *client) {
+	for {
+		select {
+		case message := <-c.out_channel:
+			if err := writeFrame(c.conn, message.msg_type, message.data); err != nil {
+				log.Println("[ipc] Error: " + err.Error())
+			}
+			if debug {
+				log.Printf("[ipc] Server Sent: %s\n", message.data)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// send queues a legacy message to be sent to the client, unless the client has disconnected.
+func (c *client) send(message Message) {
+	c.queue(frame{legacyMessage, encodeToBytes(message)})
+}
+
+// reply queues a response to be sent to the client, unless the client has disconnected.
+func (c *client) reply(response Response) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Println("[ipc] Error: " + err.Error())
+		return
+	}
+	c.queue(frame{protocolMessage, data})
+}
+
+// queue queues a frame to be sent to the client, unless the client has disconnected.
+func (c *client) queue(message frame) {
+	select {
+	case c.out_channel <- message:
+	case <-c.done:
+	}
+}
+
+// subscribe sends all events to the client, using the given function, until it disconnects.
+func (s *server) subscribe(c *client, forward func(e events.Event)) {
+	if c.subscription != nil {
+		return
+	}
+	c.subscription = events.Subscribe(s.subscriber_channel)
+	go func(subscription chan events.Event) {
+		for e := range subscription {
+			forward(e)
+		}
+	}(c.subscription)
+}
+
+// serverReceive handles the received data from the client, until it disconnects.
+func (s *server) serverReceive(c *client) {
+	defer func() {
+		if c.subscription != nil {
+			events.Unsubscribe(s.subscriber_channel, c.subscription)
+		}
+	}()
+
+	for {
+		msg_type, data, err := readFrame(c.conn)
+		if err != nil {
+			if err != io.EOF && debug {
+				log.Println("[ipc] Error: " + err.Error())
+			}
+			return
+		}
+		if debug {
+			log.Printf("[ipc] Server Received, type: %d, data: %v\n", msg_type, data)
+		}
+
+		if msg_type == protocolMessage {
+			request, err := decodeRequest(data)
+			if err != nil {
+				c.reply(newErrorResponse(request, ErrInvalidRequest, "malformed request: "+err.Error()))
+				continue
+			}
+			c.reply(s.handleRequest(c, request))
+		} else if msg_type == legacyMessage {
+			if !c.legacy {
+				c.legacy = true
+				if verbose {
+					log.Println("[ipc] Client uses deprecated legacy messages, please upgrade it")
+				}
+			}
+			cmd, err := decodeToMessage(data)
+			if err != nil {
+				log.Println("[ipc] Malformed message received: " + err.Error())
+				continue
+			}
+			s.handleMessage(c, cmd)
+		}
+	}
+}
+
+// handleRequest handles a protocol request and returns the response. The request is recorded in the audit log.
+func (s *server) handleRequest(c *client, request Request) (response Response) {
+	cfg := settings.Snapshot(s.cfg)
+	identity := audit.Identity{Peer: c.address, Client: request.Client}
+	defer func() { s.record(request, identity, response) }()
+
+	if request.Version < ProtocolVersion {
+		log.Printf("[ipc] Client rejected, it uses protocol version %d\n", request.Version)
+		return newErrorResponse(request, ErrUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported, server uses version %d: upgrade the client (requests are signed instead of sending the password)", request.Version, ProtocolVersion))
+	}
+	if request.Version != ProtocolVersion {
+		return newErrorResponse(request, ErrUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported, server uses version %d", request.Version, ProtocolVersion))
+	}
+	// Banned peers are rejected until the ban ends, even with a valid signature
+	if ban_left, banned := c.guard.Banned(c.address); banned {
+		return newErrorResponse(request, ErrAuthFailed, fmt.Sprintf("too many failed authentications, try again in %s", ban_left))
+	}
+	if request.Op == OpHello {
+		return newResponse(request, HelloPayload{Version: ProtocolVersion, Nonce: c.nonce})
+	}
+	// Authentication if needed, requests signed with a token are only allowed the operations of the token.
+	// Unsigned requests on the socket are allowed the operations of the user's role.
+	cfg_token, subject := c.peer, "user"
+	authenticated := false
+	if c.peer != nil {
+		identity.Auth = "user " + c.peer.Name
+	}
+	if authRequired(cfg) && (c.peer == nil || request.Signature != "") {
+		signed_token, err := c.authenticate(cfg, request)
+		if err != nil {
+			log.Printf("[ipc] Server Authentication failed for %s: %s\n", c.address, err)
+			if ban_time, banned := c.guard.Failed(c.address); banned {
+				log.Printf("[ipc] Banned %s for %s, after %d failed authentications\n", access.GetHost(c.address), ban_time, cfg.Access.MaxFailures)
+			}
+			return newErrorResponse(request, ErrAuthFailed, "authentication failed")
+		}
+		c.guard.Succeeded(c.address)
+		cfg_token, subject, authenticated = signed_token, "token", true
+		identity.Auth = "password"
+		if signed_token != nil {
+			identity.Auth = "token " + signed_token.Name
+		}
+	}
+	if operation := getOperation(request); cfg_token != nil && !tokens.Allows(*cfg_token, operation) {
+		log.Printf("[ipc] Request from %s denied, %s '%s' (%s) isn't allowed to: %s\n", c.address, subject, cfg_token.Name, cfg_token.Role, operation)
+		return newErrorResponse(request, ErrForbidden, fmt.Sprintf("%s '%s' (%s) isn't allowed to: %s", subject, cfg_token.Name, cfg_token.Role, operation))
+	}
+
+	switch request.Op {
+	case OpSet:
+		payload := SetPayload{}
+		if err := request.Decode(&payload); err != nil {
+			return newErrorResponse(request, ErrInvalidRequest, err.Error())
+		}
+		if err := validateSet(payload, cfg); err != nil {
+			return newErrorResponse(request, ErrInvalidValue, err.Error())
+		}
+		for _, command := range getSetCommands(payload, cfg) {
+			if response := serial.SendAs(s.cmd_channel, "ipc", identity, getStep(c, request, payload), command.Key, command.Value); response != "ok" {
+				return deviceErrorResponse(request, response)
+			}
+		}
+		return newResponse(request, nil)
+	case OpGet:
+		payload := GetPayload{}
+		if err := request.Decode(&payload); err != nil {
+			return newErrorResponse(request, ErrInvalidRequest, err.Error())
+		}
+		if payload.Key == "palette" {
+			return newResponse(request, NewPalette(cfg))
+		}
+		if payload.Key != "information" && payload.Key != "state" && payload.Key != "devices" {
+			return newErrorResponse(request, ErrInvalidValue, fmt.Sprintf("unknown key: '%s'", payload.Key))
+		}
+		hardware_state := settings.ParseHardwareInformation(serial.Send(s.cmd_channel, "ipc", "information", "all"))
+		if payload.Key == "devices" {
+			return newResponse(request, []Device{getDevice(hardware_state, cfg)})
+		}
+		if hardware_state.Version == "" {
+			return newErrorResponse(request, ErrDeviceOffline, "unable to get information from device")
+		}
+		return newResponse(request, hardware_state)
+	case OpFocus:
+		payload := FocusPayload{}
+		if err := request.Decode(&payload); err != nil {
+			return newErrorResponse(request, ErrInvalidRequest, err.Error())
+		}
+		value := ""
+		if payload.Action == "start" {
+			value = focus.GetStartString(payload.Duration, payload.Break, payload.Cycles, payload.LongBreak)
+		}
+		response := make(chan string, 1)
+		s.focus_channel <- focus.Command{Action: payload.Action, Value: value, Response: response}
+		status, err := focus.ParseStatus(<-response)
+		if err != nil {
+			return newErrorResponse(request, ErrInvalidValue, "focus timer request was rejected")
+		}
+		return newResponse(request, status)
+	case OpNotify:
+		payload := NotifyPayload{}
+		if err := request.Decode(&payload); err != nil {
+			return newErrorResponse(request, ErrInvalidRequest, err.Error())
+		}
+		n := notify.Notification{Color: payload.Color, Pattern: payload.Pattern, Count: payload.Count}
+		if payload.Duration != "" {
+			duration, err := time.ParseDuration(payload.Duration)
+			if err != nil {
+				return newErrorResponse(request, ErrInvalidValue, fmt.Sprintf("invalid duration: '%s'", payload.Duration))
+			}
+			n.Duration = duration
+		}
+		if _, err := notify.ParseNotification(n.String()); err != nil {
+			return newErrorResponse(request, ErrInvalidValue, err.Error())
+		}
+		response := make(chan string, 1)
+		s.notify_channel <- notify.Command{Action: "play", Value: n.String(), Response: response}
+		if <-response != "ok" {
+			return newErrorResponse(request, ErrInvalidValue, "notification was rejected")
+		}
+		return newResponse(request, nil)
+	case OpSubscribe:
+		payload := SubscribePayload{}
+		if err := request.Decode(&payload); err != nil {
+			return newErrorResponse(request, ErrInvalidRequest, err.Error())
+		}
+		if payload.Topic != "events" {
+			return newErrorResponse(request, ErrInvalidValue, fmt.Sprintf("unknown topic: '%s'", payload.Topic))
+		}
+		s.subscribe(c, func(e events.Event) {
+			c.reply(newResponse(Request{ID: request.ID, Op: OpEvent}, e))
+		})
+		return newResponse(request, nil)
+	case OpConfig:
+		if response, ok := checkAdmin(c, request, authenticated); !ok {
+			return response
+		}
+		payload := ConfigPayload{}
+		if err := request.Decode(&payload); err != nil {
+			return newErrorResponse(request, ErrInvalidRequest, err.Error())
+		}
+		change, err := payload.GetChange()
+		if err != nil {
+			return newErrorResponse(request, ErrInvalidValue, err.Error())
+		}
+		return s.changeConfig(request, change)
+	case OpToken:
+		if response, ok := checkAdmin(c, request, authenticated); !ok {
+			return response
+		}
+		payload := TokenPayload{}
+		if err := request.Decode(&payload); err != nil {
+			return newErrorResponse(request, ErrInvalidRequest, err.Error())
+		}
+		return s.handleToken(request, payload)
+	case OpLog:
+		payload := LogPayload{}
+		if err := request.Decode(&payload); err != nil {
+			return newErrorResponse(request, ErrInvalidRequest, err.Error())
+		}
+		return s.readLog(request, payload)
+	case OpHistory:
+		payload := HistoryPayload{}
+		if err := request.Decode(&payload); err != nil {
+			return newErrorResponse(request, ErrInvalidRequest, err.Error())
+		}
+		return s.handleHistory(request, identity, payload)
+	}
+
+	return newErrorResponse(request, ErrUnknownOp, fmt.Sprintf("unknown operation: '%s'", request.Op))
+}
+
+// authRequired returns true if requests must be authenticated, when a password or tokens are set.
+func authRequired(cfg *settings.Config) bool {
+	return cfg.Password != "" || len(cfg.Tokens) > 0
+}
+
+// authenticate checks the signature of the request, and that its counter wasn't used before (so it isn't replayed).
+// Returns the token the request is signed with, or nil if it's signed with the password.
+func (c *client) authenticate(cfg *settings.Config, request Request) (*settings.Token, error) {
+	if request.Signature == "" {
+		return nil, errors.New("request isn't signed")
+	}
+	if request.Counter <= c.counter {
+		return nil, fmt.Errorf("counter %d was already used", request.Counter)
+	}
+	var cfg_token *settings.Token
+	if request.Token != "" {
+		found, ok := tokens.Find(cfg, request.Token)
+		if !ok {
+			return nil, fmt.Errorf("unknown token '%s'", request.Token)
+		}
+		if !tokens.CheckProof(found, getMessage(c.nonce, request), request.Signature) {
+			return nil, fmt.Errorf("invalid signature for token '%s'", found.Name)
+		}
+		cfg_token = &found
+	} else if cfg.Password == "" || !hmac.Equal([]byte(sign(cfg.Password, c.nonce, request)), []byte(request.Signature)) {
+		return nil, errors.New("invalid signature")
+	}
+	c.counter = request.Counter
+	return cfg_token, nil
+}
+
+// getOperation returns the operation a token must allow for the request. Getting the focus timer status is a get,
+// listing the state history is a get and restoring a state from it is a set.
+func getOperation(request Request) string {
+	if request.Op == OpFocus {
+		payload := FocusPayload{}
+		if err := request.Decode(&payload); err == nil && payload.Action == "status" {
+			return OpGet
+		}
+	}
+	if request.Op == OpHistory {
+		payload := HistoryPayload{}
+		if err := request.Decode(&payload); err == nil && payload.Action == "list" {
+			return OpGet
+		}
+		return OpSet
+	}
+	return request.Op
+}
+
+// newNonce returns a random nonce, for a client to sign its requests with.
+func newNonce() string {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatalln("[ipc] Unable to create nonce: " + err.Error())
+	}
+	return hex.EncodeToString(nonce)
+}
+
+// checkAdmin returns an error response, and false, if the client isn't allowed to change the configuration or tokens.
+// That needs a request signed with the password or a token, or a client on the socket, as their roles are checked.
+func checkAdmin(c *client, request Request, authenticated bool) (Response, bool) {
+	if !authenticated && c.peer == nil {
+		log.Printf("[ipc] Request from %s denied, %s needs the password or an admin role\n", c.address, request.Op)
+		return newErrorResponse(request, ErrAuthFailed, "the password or an admin role is needed to change the configuration or tokens"), false
+	}
+	return Response{}, true
+}
+
+// changeConfig validates the change, saves it in the config file and applies it to the running configuration.
+func (s *server) changeConfig(request Request, change settings.Change) Response {
+	if err := s.saveChange(change); err != nil {
+		return newErrorResponse(request, err.Code, err.Message)
+	}
+	if verbose {
+		log.Printf("[ipc] Configuration changed: %s\n", request.Payload)
+	}
+	return newResponse(request, NewPalette(settings.Snapshot(s.cfg)))
+}
+
+// handleToken creates, lists or revokes tokens. Created tokens are only returned once, only their hash is saved.
+func (s *server) handleToken(request Request, payload TokenPayload) Response {
+	switch payload.Action {
+	case "create":
+		token, cfg_token, err := tokens.New(payload.Name, payload.Role, payload.Operations)
+		if err != nil {
+			return newErrorResponse(request, ErrSaveFailed, "unable to create token: "+err.Error())
+		}
+		if err := s.saveChange(settings.AddToken(cfg_token)); err != nil {
+			return newErrorResponse(request, err.Code, err.Message)
+		}
+		if verbose {
+			log.Printf("[ipc] Token created: %s (%s)\n", cfg_token.Name, cfg_token.Role)
+		}
+		info := NewTokenInfo(cfg_token)
+		info.Token = token
+		return newResponse(request, info)
+	case "list":
+		list := []TokenInfo{}
+		for _, cfg_token := range settings.Snapshot(s.cfg).Tokens {
+			list = append(list, NewTokenInfo(cfg_token))
+		}
+		return newResponse(request, list)
+	case "revoke":
+		if err := s.saveChange(settings.RemoveToken(payload.Name)); err != nil {
+			return newErrorResponse(request, err.Code, err.Message)
+		}
+		if verbose {
+			log.Printf("[ipc] Token revoked: %s\n", payload.Name)
+		}
+		return newResponse(request, nil)
+	}
+	return newErrorResponse(request, ErrInvalidValue, fmt.Sprintf("unknown action: '%s'", payload.Action))
+}
+
+// readLog returns the audit log entries matching the payload.
+func (s *server) readLog(request Request, payload LogPayload) Response {
+	filter := audit.Filter{Source: payload.Source, Limit: payload.Limit}
+	if payload.Since != "" {
+		since, err := time.Parse(time.RFC3339, payload.Since)
+		if err != nil {
+			return newErrorResponse(request, ErrInvalidValue, fmt.Sprintf("since must be given in RFC 3339 format, not '%s'", payload.Since))
+		}
+		filter.Since = since
+	}
+	if s.audit_log == nil {
+		return newErrorResponse(request, ErrLogFailed, "audit log isn't enabled (audit.enabled)")
+	}
+	entries, err := s.audit_log.Read(filter)
+	if err != nil {
+		log.Println("[ipc] Unable to read audit log: " + err.Error())
+		return newErrorResponse(request, ErrLogFailed, "unable to read audit log: "+err.Error())
+	}
+	return newResponse(request, entries)
+}
+
+// handleHistory lists the state history, or restores a state from it.
+func (s *server) handleHistory(request Request, identity audit.Identity, payload HistoryPayload) Response {
+	if s.history == nil {
+		return newErrorResponse(request, ErrInvalidValue, "state history isn't enabled (history.enabled)")
+	}
+	switch payload.Action {
+	case "list":
+		return newResponse(request, s.history.List())
+	case "undo", "restore":
+		if payload.Index < 0 {
+			return newErrorResponse(request, ErrInvalidValue, fmt.Sprintf("index must be at least 0, not %d", payload.Index))
+		}
+		response := serial.SendAs(s.cmd_channel, "ipc", identity, "", payload.Action, strconv.Itoa(payload.Index))
+		if response == "invalid" && payload.Action == "undo" {
+			return newErrorResponse(request, ErrInvalidValue, "there is no earlier state to restore")
+		} else if response == "invalid" {
+			return newErrorResponse(request, ErrInvalidValue, fmt.Sprintf("there is no state %d step(s) back in the history", payload.Index))
+		} else if response != "ok" {
+			return deviceErrorResponse(request, response)
+		}
+		if entries := s.history.List(); len(entries) > 0 {
+			return newResponse(request, entries[0])
+		}
+		return newResponse(request, nil)
+	}
+	return newErrorResponse(request, ErrInvalidValue, fmt.Sprintf("unknown action: '%s'", payload.Action))
+}
+
+// record records the request, and its result, in the audit log. Requests only reading values aren't recorded,
+// unless they're rejected. Sets that reach the device are recorded by the serial module, with the previous value.
+func (s *server) record(request Request, identity audit.Identity, response Response) {
+	if s.audit_log == nil || request.Op == OpHello {
+		return
+	}
+	entry := audit.Entry{Source: "ipc", Identity: identity, Op: request.Op, Result: "ok"}
+	if response.Error != nil {
+		if request.Op == OpSet && (response.Error.Code == ErrDeviceOffline || response.Error.Code == ErrDeviceRejected) {
+			return
+		}
+		entry.Result, entry.Message = response.Error.Code, response.Error.Message
+	} else if request.Op == OpSet || isReadOnly(request) {
+		return
+	}
+	entry.Key, entry.Value = getAuditValues(request)
+	s.audit_log.Record(entry)
+}
+
+// isReadOnly returns true if the request only reads values (or subscribes to events).
+func isReadOnly(request Request) bool {
+	switch getOperation(request) {
+	case OpGet, OpSubscribe, OpLog:
+		return true
+	case OpToken:
+		payload := TokenPayload{}
+		return request.Decode(&payload) == nil && payload.Action == "list"
+	}
+	return false
+}
+
+// getAuditValues returns the key and value of the request to record: the key and value of a set, or the action
+// (or key) and the rest of the payload of other requests.
+func getAuditValues(request Request) (string, string) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(request.Payload, &fields); err != nil {
+		return "", string(request.Payload)
+	}
+	key := ""
+	for _, name := range []string{"action", "key"} {
+		if value, ok := fields[name].(string); ok && key == "" {
+			key = value
+			delete(fields, name)
+		}
+	}
+	if value, ok := fields["value"].(string); ok && len(fields) == 1 {
+		return key, value
+	}
+	if len(fields) == 0 {
+		return key, ""
+	}
+	data, _ := json.Marshal(fields)
+	return key, string(data)
+}
+
+// saveChange validates the change, saves it in the config file and applies it to the running configuration.
+func (s *server) saveChange(change settings.Change) *Error {
+	var save_error *Error
+	_ = settings.Update(s.cfg, func(changed *settings.Config) error {
+		if err := settings.ApplyChange(changed, change); err != nil {
+			save_error = &Error{Code: ErrInvalidValue, Message: err.Error()}
+			return err
+		}
+		if err := settings.SaveSettings(change); err != nil {
+			log.Println("[ipc] Unable to save configuration: " + err.Error())
+			save_error = &Error{Code: ErrSaveFailed, Message: "unable to save configuration: " + err.Error()}
+			return err
+		}
+		return nil
+	})
+	return save_error
+}
+
+// handleMessage handles a legacy message and sends the response.
+//
+// Deprecated: legacy messages are only handled for older clients, use protocol requests instead.
+func (s *server) handleMessage(c *client, cmd Message) {
+	cfg := settings.Snapshot(s.cfg)
+	// Legacy messages carry the password in plaintext, so they're not accepted when a password (or tokens) is set.
+	// They aren't accepted on the socket either, as they can't be checked against the user's role.
+	identity := audit.Identity{Peer: c.address, Client: cmd.Client}
+	if authRequired(cfg) || c.peer != nil {
+		log.Printf("[ipc] Legacy client %s rejected, it sends the password unprotected: upgrade the client\n", c.address)
+		s.audit_log.Record(audit.Entry{Source: "ipc", Identity: identity, Op: cmd.Type, Key: cmd.Key, Value: cmd.Value, Result: ErrAuthFailed, Message: "legacy messages aren't accepted"})
+		c.send(Message{"set", "response", "nok", "", ""})
+		return
+	}
+
+	if cmd.Type == "set" {
+		// Send "set" message to cmd_channel (received by serial module)
+		response := serial.SendAs(s.cmd_channel, "ipc", identity, "", cmd.Key, cmd.Value)
+		if response != "ok" {
+			response = "nok"
+		}
+		c.send(Message{"set", "response", response, "", ""}) // action, key, value, secret, client
+	} else if cmd.Type == "get" {
+		// Get and return information (to IPC client)
+		if cmd.Key == "information" {
+			if cmd.Value == "all" {
+				// Request hardware state
+				response := serial.Send(s.cmd_channel, "ipc", cmd.Key, cmd.Value)
+				if response == "offline" {
+					response = "nok"
+				}
+				c.send(Message{"set", "response", response, "", ""})
+			}
+		}
+	} else if cmd.Type == "focus" {
+		// Send "focus" message to focus_channel (received by focus module)
+		response := make(chan string, 1)
+		s.focus_channel <- focus.Command{Action: cmd.Key, Value: cmd.Value, Response: response}
+		status := <-response
+		if cmd.Key != "status" {
+			s.recordMessage(identity, cmd, status != "nok")
+		}
+		c.send(Message{"set", "focus", status, "", ""})
+	} else if cmd.Type == "notify" {
+		// Send "notify" message to notify_channel (received by notify module)
+		response := make(chan string, 1)
+		s.notify_channel <- notify.Command{Action: cmd.Key, Value: cmd.Value, Response: response}
+		result := <-response
+		s.recordMessage(identity, cmd, result == "ok")
+		c.send(Message{"set", "notify", result, "", ""})
+	} else if cmd.Type == "subscribe" && cmd.Key == "events" {
+		// Send all events to the client, until it disconnects
+		s.subscribe(c, func(e events.Event) {
+			c.send(Message{"event", e.Type, e.String(), "", ""})
+		})
+		c.send(Message{"set", "subscribe", "ok", "", ""})
+	}
+}
+
+// recordMessage records a legacy message, and if it was accepted, in the audit log.
+func (s *server) recordMessage(identity audit.Identity, cmd Message, ok bool) {
+	entry := audit.Entry{Source: "ipc", Identity: identity, Op: cmd.Type, Key: cmd.Key, Value: cmd.Value, Result: "ok"}
+	if !ok {
+		entry.Result = ErrInvalidValue
+	}
+	s.audit_log.Record(entry)
+}
+
+// validateSet returns an error if the key or value of a set request isn't valid.
+func validateSet(payload SetPayload, cfg *settings.Config) error {
+	ok := false
+	switch payload.Key {
+	case "color":
+		_, ok = serial.GetColorString(payload.Value, cfg)
+	case "brightness":
+		_, ok = serial.GetBrightnessString(payload.Value, cfg)
+	case "mode":
+		for _, cfg_mode := range cfg.Modes {
+			if cfg_mode.Name == payload.Value {
+				_, ok = serial.GetModeString(strconv.Itoa(cfg_mode.Value), cfg)
+			}
+		}
+	case "dim":
+		ok = payload.Value == "true" || payload.Value == "false"
+	case "state":
+		cfg_state, found := settings.GetState(payload.Value, cfg)
+		if !found {
+			break
+		}
+		if err := validateSet(SetPayload{Key: "mode", Value: cfg_state.Mode}, cfg); err != nil {
+			return fmt.Errorf("state '%s' is misconfigured, %s", payload.Value, err.Error())
+		}
+		if err := validateSet(SetPayload{Key: "color", Value: cfg_state.Color}, cfg); err != nil {
+			return fmt.Errorf("state '%s' is misconfigured, %s", payload.Value, err.Error())
+		}
+		ok = true
+	default:
+		return fmt.Errorf("unknown key: '%s'", payload.Key)
+	}
+	if !ok {
+		return fmt.Errorf("%s given is not supported: '%s'", payload.Key, payload.Value)
+	}
+	return nil
+}
+
+// getStep returns the history step of a set request: the step given by the client (on this connection), or the request itself.
+func getStep(c *client, request Request, payload SetPayload) string {
+	if payload.Step != "" {
+		return c.nonce + " " + payload.Step
+	}
+	return fmt.Sprintf("%s #%d", c.nonce, request.ID)
+}
+
+// getSetCommands returns the serial commands needed for a (validated) set request.
+func getSetCommands(payload SetPayload, cfg *settings.Config) []serial.Command {
+	if payload.Key == "state" {
+		cfg_state, _ := settings.GetState(payload.Value, cfg)
+		return []serial.Command{{Key: "mode", Value: cfg_state.Mode}, {Key: "color", Value: cfg_state.Color}}
+	}
+	return []serial.Command{{Key: payload.Key, Value: payload.Value}}
+}
+
+// getDevice returns the device description, from the configuration and hardware information.
+func getDevice(hardware_state *settings.Hardware, cfg *settings.Config) Device {
+	device := Device{Port: cfg.Serial.Port, Connected: hardware_state.Version != ""}
+	if device.Connected {
+		device.Version = hardware_state.Version
+		device.Leds = hardware_state.Leds
+		device.BrightnessMin = hardware_state.Brightness_min
+		device.BrightnessMax = hardware_state.Brightness_max
+	}
+	return device
+}
+
+// deviceErrorResponse returns an error response for a failed device command.
+func deviceErrorResponse(request Request, response string) Response {
+	if response == "offline" {
+		return newErrorResponse(request, ErrDeviceOffline, "device is not connected")
+	}
+	return newErrorResponse(request, ErrDeviceRejected, "device did not accept the command")
+}
+
+// serverHandshake sends the protocol version and maximum message size to the client.
+// Encryption is not used.
+func serverHandshake(conn net.Conn) error {
+	reply := make([]byte, 1)
+
+	if _, err := conn.Write([]byte{transportVersion, 0}); err != nil {
+		return errors.New("unable to send handshake")
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.New("failed to receive handshake reply")
+	}
+	if reply[0] != 0 {
+		return fmt.Errorf("client rejected handshake (%d)", reply[0])
+	}
+
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint32(buff[:4], 4)
+	binary.BigEndian.PutUint32(buff[4:], maxMessageSize)
+	if _, err := conn.Write(buff); err != nil {
+		return errors.New("unable to send max message length")
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.New("did not receive message length reply")
+	}
+
+	return nil
+}
+
+// readFrame reads a message frame and returns the message type and data.
+func readFrame(conn net.Conn) (int, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 4 || length > maxMessageSize+4 {
+		return 0, nil, fmt.Errorf("invalid message length: %d", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return 0, nil, err
+	}
+
+	return int(binary.BigEndian.Uint32(data[:4])), data[4:], nil
+}
+
+// writeFrame writes a message frame with the given message type and data.
+func writeFrame(conn net.Conn, msg_type int, data []byte) error {
+	frame := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(frame[:4], uint32(4+len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(msg_type))
+	copy(frame[8:], data)
+
+	_, err := conn.Write(frame)
+	return err
+}
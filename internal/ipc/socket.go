@@ -0,0 +1,159 @@
+// DSUL - Disturb State USB Light : IPC module, unix socket
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+// The socket (socket.path) is for local clients, which are authorized by the user and groups of their process (SO_PEERCRED)
+// instead of a password. Each user gets the best role given to it, or one of its groups, in socket.roles, or socket.role.
+// Root and the daemon's own user are admins. Requests signed with the password or a token are authorized as usual.
+
+// listenSocket returns a listener for the socket, with the configured owner, group and mode.
+func listenSocket(cfg *settings.Config) (net.Listener, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("peer credentials are only supported on Linux")
+	}
+	path := cfg.Socket.Path
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	uid, gid := -1, -1
+	if cfg.Socket.Owner != "" {
+		id, err := getUserID(cfg.Socket.Owner)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+	if cfg.Socket.Group != "" {
+		id, err := getGroupID(cfg.Socket.Group)
+		if err != nil {
+			return nil, err
+		}
+		gid, _ = strconv.Atoi(id)
+	}
+	mode, _ := strconv.ParseUint(cfg.Socket.Mode, 8, 32) // validated
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// getPeer returns the role of the peer connected to the socket, by its user and groups, and a description of it for logs.
+// Peers without a role (socket.role is "none") get role "none", which allows nothing.
+func getPeer(cfg *settings.Config, conn net.Conn) (*settings.Token, string, error) {
+	uid, gid, pid, err := getPeerCredentials(conn)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to get peer credentials: %v", err)
+	}
+	name := strconv.FormatUint(uint64(uid), 10)
+	group_ids := []string{strconv.FormatUint(uint64(gid), 10)}
+	if peer_user, err := user.LookupId(name); err == nil {
+		name = peer_user.Username
+		if ids, err := peer_user.GroupIds(); err == nil {
+			group_ids = append(group_ids, ids...)
+		}
+	}
+	description := fmt.Sprintf("%s (uid %d, pid %d)", name, uid, pid)
+
+	return &settings.Token{Name: name, Role: getSocketRole(cfg, uid, name, group_ids)}, description, nil
+}
+
+// getSocketRole returns the best role of the user, given to it or one of its groups, or socket.role if it has none.
+func getSocketRole(cfg *settings.Config, uid uint32, name string, group_ids []string) string {
+	if uid == 0 || int(uid) == os.Getuid() {
+		return "admin"
+	}
+	role := ""
+	for _, socket_role := range cfg.Socket.Roles {
+		matched := false
+		if socket_role.User != "" {
+			matched = socket_role.User == name || socket_role.User == strconv.FormatUint(uint64(uid), 10)
+		} else if gid, err := getGroupID(socket_role.Group); err == nil {
+			for _, id := range group_ids {
+				matched = matched || id == gid
+			}
+		}
+		if matched && len(settings.Roles[socket_role.Role]) > len(settings.Roles[role]) {
+			role = socket_role.Role
+		}
+	}
+	if role == "" {
+		return cfg.Socket.Role
+	}
+	return role
+}
+
+// getSocketPath returns the socket to connect to, if it's configured, present and the server is local.
+func getSocketPath(cfg *settings.Config) string {
+	if cfg.Socket.Path == "" || !isLocalServer(cfg.Network.Server) {
+		return ""
+	}
+	if info, err := os.Stat(cfg.Socket.Path); err != nil || info.Mode()&os.ModeSocket == 0 {
+		return ""
+	}
+	return cfg.Socket.Path
+}
+
+// isLocalServer returns true if the server is this host (or not set).
+func isLocalServer(server string) bool {
+	if server == "" || server == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(server)
+	return ip != nil && ip.IsLoopback()
+}
+
+// getUserID returns the uid of the user with the given name (or uid).
+func getUserID(name string) (string, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return name, nil
+	}
+	found, err := user.Lookup(name)
+	if err != nil {
+		return "", fmt.Errorf("unknown user '%s'", name)
+	}
+	return found.Uid, nil
+}
+
+// getGroupID returns the gid of the group with the given name (or gid).
+func getGroupID(name string) (string, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return name, nil
+	}
+	found, err := user.LookupGroup(name)
+	if err != nil {
+		return "", fmt.Errorf("unknown group '%s'", name)
+	}
+	return found.Gid, nil
+}
@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+// DSUL - Disturb State USB Light : IPC module, peer credentials (SO_PEERCRED)
+package ipc
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// getPeerCredentials returns the user, group and process of the peer connected to the unix socket.
+func getPeerCredentials(conn net.Conn) (uint32, uint32, int32, error) {
+	unix_conn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, 0, 0, errors.New("not a unix socket")
+	}
+	raw_conn, err := unix_conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var cred_err error
+	if err := raw_conn.Control(func(fd uintptr) {
+		cred, cred_err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, 0, 0, err
+	}
+	if cred_err != nil {
+		return 0, 0, 0, cred_err
+	}
+	return cred.Uid, cred.Gid, cred.Pid, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+// DSUL - Disturb State USB Light : IPC module, peer credentials (unsupported)
+package ipc
+
+import (
+	"errors"
+	"net"
+)
+
+// getPeerCredentials isn't supported on this platform, so the socket can't be used.
+func getPeerCredentials(conn net.Conn) (uint32, uint32, int32, error) {
+	return 0, 0, 0, errors.New("peer credentials aren't supported on this platform")
+}
@@ -0,0 +1,189 @@
+// DSUL - Disturb State USB Light : Notify module
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/serial"
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+var (
+	verbose bool = false
+	debug   bool = false
+)
+
+// Pattern holds the on and off times of a notification pattern.
+type Pattern struct {
+	On  time.Duration
+	Off time.Duration
+}
+
+// Patterns contains the available notification patterns.
+var Patterns = map[string]Pattern{
+	"flash": {time.Millisecond * 150, time.Millisecond * 150},
+	"blink": {time.Millisecond * 500, time.Millisecond * 500},
+}
+
+// Limits of a notification, as the device is held while it's shown, and of the number of queued notifications.
+const (
+	MaxCount    = 20
+	MaxDuration = time.Minute
+	MaxQueue    = 10
+)
+
+// Command is a request for the notification handler and the channel to send the response on.
+type Command struct {
+	Action   string
+	Value    string
+	Response chan string
+}
+
+// Notification holds the settings of a notification overlay.
+type Notification struct {
+	Color    string
+	Pattern  string
+	Count    int
+	Duration time.Duration
+}
+
+// String returns the notification as a string, that can be sent to the daemon.
+// color:pattern:count:duration - e.g. "orange:flash:3:0s"
+func (n Notification) String() string {
+	return fmt.Sprintf("%s:%s:%d:%s", n.Color, n.Pattern, n.Count, n.Duration)
+}
+
+// ParseNotification returns a Notification struct from a notification string.
+// The color can be given either as a name or as a red:green:blue value.
+func ParseNotification(value string) (*Notification, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 4 {
+		return nil, errors.New("invalid notification")
+	}
+
+	n := Notification{
+		Color:   strings.Join(parts[:len(parts)-3], ":"),
+		Pattern: parts[len(parts)-3],
+	}
+	var err error
+	if _, ok := Patterns[n.Pattern]; !ok {
+		return nil, fmt.Errorf("invalid pattern: '%s'", n.Pattern)
+	}
+	if n.Count, err = strconv.Atoi(parts[len(parts)-2]); err != nil || n.Count < 0 || n.Count > MaxCount {
+		return nil, fmt.Errorf("invalid count: '%s'", parts[len(parts)-2])
+	}
+	if n.Duration, err = time.ParseDuration(parts[len(parts)-1]); err != nil || n.Duration < 0 || n.Duration > MaxDuration {
+		return nil, fmt.Errorf("invalid duration: '%s'", parts[len(parts)-1])
+	}
+	if n.Count == 0 && n.Duration == 0 {
+		return nil, errors.New("either count or duration must be given")
+	}
+
+	return &n, nil
+}
+
+// isValidColor returns true if the color is a configured color name or a valid red:green:blue value.
+func isValidColor(value string, cfg *settings.Config) bool {
+	for _, cfg_color := range cfg.Colors {
+		if cfg_color.Name == value {
+			return true
+		}
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return false
+	}
+	for _, part := range parts {
+		if n, err := strconv.Atoi(part); err != nil || n < 0 || n > 255 {
+			return false
+		}
+	}
+	return true
+}
+
+// play shows the notification and then restores the light to the state it had before.
+// The device is held during the notification, so other commands are queued until it's done.
+func play(n Notification, overlay_channel chan serial.Command, cfg *settings.Config) {
+	if verbose {
+		log.Printf("[notify] Playing notification: %s\n", n)
+	}
+	_ = serial.Send(overlay_channel, "notify", "hold", "true")
+	snapshot := *settings.ParseHardwareInformation(serial.Send(overlay_channel, "notify", "information", "all"))
+	if debug {
+		log.Printf("[notify] Snapshot: %+v\n", snapshot)
+	}
+
+	pattern := Patterns[n.Pattern]
+	end := time.Now().Add(n.Duration)
+	_ = serial.Send(overlay_channel, "notify", "mode", settings.GetModeName(1, cfg)) // overlay is shown as solid
+	for i := 0; (n.Duration > 0 && time.Now().Before(end)) || (n.Duration == 0 && i < n.Count); i++ {
+		_ = serial.Send(overlay_channel, "notify", "color", n.Color)
+		time.Sleep(pattern.On)
+		_ = serial.Send(overlay_channel, "notify", "color", "0:0:0")
+		time.Sleep(pattern.Off)
+	}
+
+	// Restore snapshot
+	if snapshot.Version != "" {
+		serial.Restore(overlay_channel, "notify", snapshot, cfg)
+	} else {
+		log.Println("[notify] Failed to get state before notification, unable to restore it")
+	}
+	_ = serial.Send(overlay_channel, "notify", "hold", "false")
+}
+
+// Runner parts //
+
+// Runner starts the notification handler.
+// Notifications are queued and played one at a time.
+func Runner(cfg *settings.Config, output_handling struct {
+	Verbose bool
+	Debug   bool
+}, notify_channel chan Command, overlay_channel chan serial.Command) {
+	verbose = output_handling.Verbose
+	debug = output_handling.Debug
+
+	var queue []Notification
+	done := make(chan bool) // sent when a notification has been played
+	playing := false
+
+	for {
+		select {
+		case command := <-notify_channel:
+			rsp_msg := "nok"
+			if command.Action == "play" {
+				n, err := ParseNotification(command.Value)
+				if err == nil && !isValidColor(n.Color, settings.Snapshot(cfg)) {
+					err = fmt.Errorf("invalid color: '%s'", n.Color)
+				}
+				if err != nil {
+					log.Printf("[notify] Invalid notification: %v\n", err)
+				} else if len(queue) >= MaxQueue {
+					log.Println("[notify] Too many queued notifications, dropping notification")
+				} else {
+					queue = append(queue, *n)
+					rsp_msg = "ok"
+				}
+			}
+			if command.Response != nil {
+				command.Response <- rsp_msg
+			}
+		case <-done:
+			playing = false
+		}
+
+		if !playing && len(queue) > 0 {
+			playing = true
+			go func(n Notification, current *settings.Config) {
+				play(n, overlay_channel, current)
+				done <- true
+			}(queue[0], settings.Snapshot(cfg))
+			queue = queue[1:]
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// DSUL - Disturb State USB Light : Notify module tests.
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestParseNotification(t *testing.T) {
+	cases := []Notification{
+		{"orange", "flash", 3, 0},
+		{"255:0:50", "blink", 0, time.Second * 10},
+	}
+	for _, in_value := range cases {
+		out_value, err := ParseNotification(in_value.String())
+		if err != nil || *out_value != in_value {
+			t.Errorf("Wrong(%q) == %v (%v), want %v", in_value.String(), out_value, err, in_value)
+		}
+	}
+
+	invalid := []string{"", "orange:flash:3", "orange:pulse:3:0s", "orange:flash:x:0s", "orange:flash:0:0s", "orange:flash:1:-1s", "orange:flash:21:0s", "red:flash:0:24h"}
+	for _, in_value := range invalid {
+		if _, err := ParseNotification(in_value); err == nil {
+			t.Errorf("Wrong(%q) parsed without error", in_value)
+		}
+	}
+}
+
+func TestIsValidColor(t *testing.T) {
+	cfg := settings.Config{Colors: []settings.Color{{Name: "orange", Value: "255:20:0"}}}
+	cases := []struct {
+		in   string
+		want bool
+	}{
+		{"orange", true},
+		{"0:0:0", true},
+		{"255:255:255", true},
+		{"purple", false},
+		{"255:0", false},
+		{"256:0:0", false},
+		{"a:b:c", false},
+	}
+	for _, c := range cases {
+		got := isValidColor(c.in, &cfg)
+		if got != c.want {
+			t.Errorf("Wrong(%q) == %v, want %v", c.in, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+// DSUL - Disturb State USB Light : Output module
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/audit"
+	"github.com/hymnis/dsul-go/internal/events"
+	"github.com/hymnis/dsul-go/internal/focus"
+	"github.com/hymnis/dsul-go/internal/history"
+	"github.com/hymnis/dsul-go/internal/ipc"
+	"github.com/hymnis/dsul-go/internal/settings"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats.
+const (
+	Text = "text" // human-readable
+	JSON = "json"
+	YAML = "yaml"
+)
+
+// Formats contains the available output formats.
+var Formats = []string{Text, JSON, YAML}
+
+// SchemaVersion is the version of the Document schema, it's increased on incompatible changes.
+const SchemaVersion = 1
+
+// Document is the machine-readable output, with the results of all requests (in the order they were given).
+type Document struct {
+	Version int      `json:"version" yaml:"version"`
+	Results []Result `json:"results" yaml:"results"`
+}
+
+// Result is the result of a request.
+// Key and value are what was requested, e.g. "color" and "red" for a set request.
+type Result struct {
+	ID          uint64             `json:"id" yaml:"id"`
+	Op          string             `json:"op" yaml:"op"`
+	Key         string             `json:"key,omitempty" yaml:"key,omitempty"`
+	Value       string             `json:"value,omitempty" yaml:"value,omitempty"`
+	OK          bool               `json:"ok" yaml:"ok"`
+	Error       *Error             `json:"error,omitempty" yaml:"error,omitempty"`
+	Information *Information       `json:"information,omitempty" yaml:"information,omitempty"`
+	Focus       *Focus             `json:"focus,omitempty" yaml:"focus,omitempty"`
+	State       *settings.Hardware `json:"state,omitempty" yaml:"state,omitempty"`
+	Devices     []Device           `json:"devices,omitempty" yaml:"devices,omitempty"`
+	Colors      []Color            `json:"colors,omitempty" yaml:"colors,omitempty"`
+	Modes       []string           `json:"modes,omitempty" yaml:"modes,omitempty"`
+	States      []State            `json:"states,omitempty" yaml:"states,omitempty"`
+	Path        string             `json:"path,omitempty" yaml:"path,omitempty"`
+	Problems    []Problem          `json:"problems,omitempty" yaml:"problems,omitempty"`
+	Tokens      []Token            `json:"tokens,omitempty" yaml:"tokens,omitempty"`
+	Log         []audit.Entry      `json:"log,omitempty" yaml:"log,omitempty"`
+	History     []history.Entry    `json:"history,omitempty" yaml:"history,omitempty"`
+}
+
+// Error describes why a request failed.
+type Error struct {
+	Code    string `json:"code" yaml:"code"`
+	Message string `json:"message" yaml:"message"`
+}
+
+// Information holds the configured values and the current hardware values.
+type Information struct {
+	Modes      []string           `json:"modes" yaml:"modes"`
+	Colors     []Color            `json:"colors" yaml:"colors"`
+	Brightness Brightness         `json:"brightness" yaml:"brightness"`
+	Hardware   *settings.Hardware `json:"hardware,omitempty" yaml:"hardware,omitempty"`
+}
+
+// Color is a configured color.
+type Color struct {
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// State is a configured state, setting the given color and mode.
+type State struct {
+	Name  string `json:"name" yaml:"name"`
+	Color string `json:"color" yaml:"color"`
+	Mode  string `json:"mode" yaml:"mode"`
+}
+
+// Problem is a problem found in the configuration, with the file and line (or other source) it came from.
+type Problem struct {
+	Location string `json:"location,omitempty" yaml:"location,omitempty"`
+	Key      string `json:"key,omitempty" yaml:"key,omitempty"`
+	Message  string `json:"message" yaml:"message"`
+}
+
+// Device describes a device handled by the daemon. Hardware values are only set if the device is connected.
+type Device struct {
+	Port          string `json:"port" yaml:"port"`
+	Connected     bool   `json:"connected" yaml:"connected"`
+	Version       string `json:"version,omitempty" yaml:"version,omitempty"`
+	Leds          int    `json:"leds" yaml:"leds"`
+	BrightnessMin int    `json:"brightness_min" yaml:"brightness_min"`
+	BrightnessMax int    `json:"brightness_max" yaml:"brightness_max"`
+}
+
+// Token describes a token of the daemon. The token itself is only given when it's created.
+type Token struct {
+	Name       string   `json:"name" yaml:"name"`
+	ID         string   `json:"id" yaml:"id"`
+	Role       string   `json:"role" yaml:"role"`
+	Operations []string `json:"operations,omitempty" yaml:"operations,omitempty"`
+	Created    string   `json:"created" yaml:"created"`
+	Token      string   `json:"token,omitempty" yaml:"token,omitempty"`
+}
+
+// Brightness holds the brightness limits.
+type Brightness struct {
+	Min int `json:"min" yaml:"min"`
+	Max int `json:"max" yaml:"max"`
+}
+
+// Focus holds the focus timer status. Remaining is given in seconds.
+type Focus struct {
+	State      string `json:"state" yaml:"state"`
+	Paused     bool   `json:"paused" yaml:"paused"`
+	Remaining  int    `json:"remaining" yaml:"remaining"`
+	Cycle      int    `json:"cycle" yaml:"cycle"`
+	Cycles     int    `json:"cycles" yaml:"cycles"`
+	LongBreaks int    `json:"long_breaks" yaml:"long_breaks"`
+}
+
+// NewInformation returns the information from the daemon's palette and hardware values (if known).
+func NewInformation(palette ipc.Palette, hardware_state settings.Hardware) *Information {
+	information := Information{
+		Modes:      append([]string{}, palette.Modes...),
+		Colors:     []Color{},
+		Brightness: Brightness{Min: palette.BrightnessMin, Max: palette.BrightnessMax},
+	}
+	for _, color := range palette.Colors {
+		information.Colors = append(information.Colors, Color{Name: color.Name, Value: color.Value})
+	}
+	if hardware_state.Version != "" {
+		information.Hardware = &hardware_state
+	}
+	return &information
+}
+
+// NewList returns a result listing the values of the given kind in the daemon's palette: colors, modes, states or all.
+func NewList(palette ipc.Palette, kind string) Result {
+	result := Result{Op: "list", Key: kind, OK: true}
+	if kind == "colors" || kind == "all" {
+		result.Colors = []Color{}
+		for _, color := range palette.Colors {
+			result.Colors = append(result.Colors, Color{Name: color.Name, Value: color.Value})
+		}
+	}
+	if kind == "modes" || kind == "all" {
+		result.Modes = append([]string{}, palette.Modes...)
+	}
+	if kind == "states" || kind == "all" {
+		result.States = []State{}
+		for _, state := range palette.States {
+			result.States = append(result.States, State{Name: state.Name, Color: state.Color, Mode: state.Mode})
+		}
+	}
+	return result
+}
+
+// NewFocus returns the focus timer status.
+func NewFocus(status focus.Status) *Focus {
+	return &Focus{
+		State:      status.State,
+		Paused:     status.Paused,
+		Remaining:  int(status.Remaining.Seconds()),
+		Cycle:      status.Cycle,
+		Cycles:     status.Cycles,
+		LongBreaks: status.LongBreaks,
+	}
+}
+
+// IsFormat returns true if the given format is one of the output formats.
+func IsFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the document in the given (machine-readable) format.
+func Write(w io.Writer, format string, document Document) error {
+	switch format {
+	case JSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(document)
+	case YAML:
+		return writeYAML(w, document)
+	}
+	return fmt.Errorf("unsupported output format: '%s'", format)
+}
+
+// WriteEvent writes an event in the given format: a human-readable line, a JSON line or a YAML document.
+func WriteEvent(w io.Writer, format string, e events.Event) error {
+	switch format {
+	case Text:
+		_, err := fmt.Fprintln(w, e.Summary())
+		return err
+	case JSON:
+		_, err := fmt.Fprintln(w, e.String())
+		return err
+	case YAML:
+		if _, err := fmt.Fprintln(w, "---"); err != nil { // each event is a document of its own
+			return err
+		}
+		return writeYAML(w, e)
+	}
+	return fmt.Errorf("unsupported output format: '%s'", format)
+}
+
+// writeYAML writes the value as YAML.
+func writeYAML(w io.Writer, value interface{}) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// WriteText writes a successful result in the human-readable format.
+func WriteText(w io.Writer, result Result) {
+	if result.Information != nil {
+		writeInformation(w, *result.Information)
+	} else if result.Focus != nil {
+		writeFocus(w, *result.Focus)
+	} else if result.State != nil {
+		writeState(w, *result.State)
+	} else if result.Devices != nil {
+		writeDevices(w, result.Devices)
+	} else if result.Colors != nil || result.Modes != nil || result.States != nil {
+		writeList(w, result)
+	} else if result.Path != "" {
+		fmt.Fprintln(w, result.Path)
+	} else if result.Problems != nil {
+		writeProblems(w, result.Problems)
+	} else if result.Tokens != nil {
+		writeTokens(w, result.Tokens)
+	} else if result.Log != nil {
+		writeLog(w, result.Log)
+	} else if result.History != nil {
+		writeHistory(w, result)
+	} else {
+		fmt.Fprintf(w, "%s: ok\n", Describe(result))
+	}
+}
+
+// Describe returns a short description of what was requested, e.g. "set color red".
+func Describe(result Result) string {
+	parts := []string{result.Op}
+	for _, part := range []string{result.Key, result.Value} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// writeProblems writes one problem per line, as "location: key: message".
+func writeProblems(w io.Writer, problems []Problem) {
+	for _, problem := range problems {
+		fmt.Fprintln(w, settings.Problem(problem))
+	}
+}
+
+// writeInformation writes configuration and hardware values.
+func writeInformation(w io.Writer, information Information) {
+	fmt.Fprintln(w, "[modes]")
+	for _, mode := range information.Modes {
+		fmt.Fprintf(w, "- %s\n", mode)
+	}
+
+	fmt.Fprintln(w, "\n[colors]")
+	for _, color := range information.Colors {
+		fmt.Fprintf(w, "- %s\n", color.Name)
+	}
+
+	fmt.Fprintln(w, "\n[brightness]")
+	fmt.Fprintf(w, "- min = %v\n", information.Brightness.Min)
+	fmt.Fprintf(w, "- max = %v\n", information.Brightness.Max)
+
+	if information.Hardware != nil {
+		fmt.Fprintln(w, "\n[hardware values]")
+		fmt.Fprintf(w, "- version = %v\n", information.Hardware.Version)
+		fmt.Fprintf(w, "- leds = %v\n", information.Hardware.Leds)
+		fmt.Fprintf(w, "- color = %v\n", information.Hardware.Current_color)
+		fmt.Fprintf(w, "- mode = %v\n", information.Hardware.Current_mode)
+		fmt.Fprintf(w, "- brightness = %v\n", information.Hardware.Current_brightness)
+		fmt.Fprintf(w, "- dim = %v\n", information.Hardware.Current_dim)
+	}
+}
+
+// writeState writes the current hardware values.
+func writeState(w io.Writer, hardware_state settings.Hardware) {
+	fmt.Fprintln(w, "[state]")
+	fmt.Fprintf(w, "- color = %v\n", hardware_state.Current_color)
+	fmt.Fprintf(w, "- mode = %v\n", hardware_state.Current_mode)
+	fmt.Fprintf(w, "- brightness = %v\n", hardware_state.Current_brightness)
+	fmt.Fprintf(w, "- dim = %v\n", hardware_state.Current_dim)
+}
+
+// writeDevices writes the devices, with hardware values for connected devices.
+func writeDevices(w io.Writer, devices []Device) {
+	for i, device := range devices {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "[%s]\n", device.Port)
+		fmt.Fprintf(w, "- connected = %v\n", device.Connected)
+		if device.Connected {
+			fmt.Fprintf(w, "- version = %v\n", device.Version)
+			fmt.Fprintf(w, "- leds = %v\n", device.Leds)
+			fmt.Fprintf(w, "- brightness = %v-%v\n", device.BrightnessMin, device.BrightnessMax)
+		}
+	}
+}
+
+// writeTokens writes the tokens, with the token itself if it was just created.
+func writeTokens(w io.Writer, tokens []Token) {
+	for i, token := range tokens {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "[%s]\n", token.Name)
+		fmt.Fprintf(w, "- id = %v\n", token.ID)
+		fmt.Fprintf(w, "- role = %v\n", token.Role)
+		if len(token.Operations) > 0 {
+			fmt.Fprintf(w, "- operations = %v\n", strings.Join(token.Operations, ", "))
+		}
+		fmt.Fprintf(w, "- created = %v\n", token.Created)
+		if token.Token != "" {
+			fmt.Fprintf(w, "- token = %v\n", token.Token)
+			fmt.Fprintln(w, "\nStore the token now, it can't be shown again.")
+		}
+	}
+}
+
+// writeLog writes one entry per line, as "time source op key value: result (message, previous value) by client".
+func writeLog(w io.Writer, entries []audit.Entry) {
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s %-6s %s: %s", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Source, Describe(Result{Op: entry.Op, Key: entry.Key, Value: entry.Value}), entry.Result)
+		details := []string{}
+		if entry.Message != "" {
+			details = append(details, entry.Message)
+		}
+		if entry.Previous != "" {
+			details = append(details, "was "+entry.Previous)
+		}
+		if len(details) > 0 {
+			line += " (" + strings.Join(details, ", ") + ")"
+		}
+		clients := []string{}
+		for _, part := range []string{entry.Client, entry.Auth, entry.Peer} {
+			if part != "" {
+				clients = append(clients, part)
+			}
+		}
+		if len(clients) > 0 {
+			line += " by " + strings.Join(clients, ", ")
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// writeHistory writes the listed states, newest first as "steps back: time source (client): state",
+// or the state restored by undo or restore.
+func writeHistory(w io.Writer, result Result) {
+	if result.Key != "list" {
+		for _, entry := range result.History {
+			fmt.Fprintf(w, "%s: ok, restored %s\n", Describe(result), describeState(entry.State))
+		}
+		return
+	}
+	for i, entry := range result.History {
+		source := entry.Source
+		if entry.Client != "" {
+			source += " (" + entry.Client + ")"
+		}
+		fmt.Fprintf(w, "%3d  %s  %s: %s\n", i, entry.Time.Local().Format("2006-01-02 15:04:05"), source, describeState(entry.State))
+	}
+}
+
+// describeState returns a short description of a state, e.g. "color 255:0:0, mode solid, brightness 50, dim off".
+func describeState(state history.State) string {
+	dim := "off"
+	if state.Dim {
+		dim = "on"
+	}
+	return fmt.Sprintf("color %s, mode %s, brightness %d, dim %s", state.Color, state.Mode, state.Brightness, dim)
+}
+
+// writeList writes the listed colors, modes and states, in sections if more than one kind is listed.
+func writeList(w io.Writer, result Result) {
+	sections := result.Key == "all"
+	if result.Colors != nil {
+		if sections {
+			fmt.Fprintln(w, "[colors]")
+		}
+		for _, color := range result.Colors {
+			fmt.Fprintf(w, "%s\t%s\n", color.Name, color.Value)
+		}
+	}
+	if result.Modes != nil {
+		if sections {
+			fmt.Fprintln(w, "\n[modes]")
+		}
+		for _, mode := range result.Modes {
+			fmt.Fprintln(w, mode)
+		}
+	}
+	if result.States != nil {
+		if sections {
+			fmt.Fprintln(w, "\n[states]")
+		}
+		for _, state := range result.States {
+			fmt.Fprintf(w, "%s\t%s %s\n", state.Name, state.Color, state.Mode)
+		}
+	}
+}
+
+// writeFocus writes the focus timer status.
+func writeFocus(w io.Writer, status Focus) {
+	fmt.Fprintln(w, "[focus]")
+	fmt.Fprintf(w, "- state = %v\n", status.State)
+	if status.State != "stopped" {
+		fmt.Fprintf(w, "- paused = %v\n", status.Paused)
+		fmt.Fprintf(w, "- remaining = %v\n", time.Duration(status.Remaining)*time.Second)
+		fmt.Fprintf(w, "- cycle = %v/%v\n", status.Cycle, status.Cycles)
+		fmt.Fprintf(w, "- long breaks = %v\n", status.LongBreaks)
+	}
+}
@@ -0,0 +1,130 @@
+// DSUL - Disturb State USB Light : Output module tests.
+package output
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/audit"
+	"github.com/hymnis/dsul-go/internal/events"
+	"github.com/hymnis/dsul-go/internal/focus"
+	"github.com/hymnis/dsul-go/internal/history"
+	"github.com/hymnis/dsul-go/internal/ipc"
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		in_value Result
+		want     string
+	}{
+		{Result{Op: "set", Key: "color", Value: "red"}, "set color red"},
+		{Result{Op: "get", Key: "information"}, "get information"},
+		{Result{Op: "notify", Value: "orange"}, "notify orange"},
+	}
+
+	for _, test := range tests {
+		if out_value := Describe(test.in_value); out_value != test.want {
+			t.Errorf("Wrong(%+v) == %q, want %q", test.in_value, out_value, test.want)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	palette := ipc.Palette{
+		Colors:        []ipc.PaletteColor{{Name: "red", Value: "255:0:0"}},
+		Modes:         []string{"solid"},
+		BrightnessMax: 150,
+	}
+	document := Document{Version: SchemaVersion, Results: []Result{
+		{ID: 1, Op: "get", Key: "information", OK: true, Information: NewInformation(palette, settings.Hardware{Version: "1.2.3", Leds: 8})},
+		{ID: 2, Op: "set", Key: "color", Value: "blue", Error: &Error{Code: "invalid_value", Message: "color given is not supported"}},
+	}}
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{JSON, []string{`"version": 1`, `"leds": 8`, `"ok": false`, `"code": "invalid_value"`}},
+		{YAML, []string{"version: 1", "leds: 8", "ok: false", "code: invalid_value"}},
+	}
+
+	for _, test := range tests {
+		buff := bytes.Buffer{}
+		if err := Write(&buff, test.format, document); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range test.want {
+			if !strings.Contains(buff.String(), want) {
+				t.Errorf("Wrong(%s) == %s, want it to contain %q", test.format, buff.String(), want)
+			}
+		}
+	}
+	if err := Write(&bytes.Buffer{}, Text, document); err == nil {
+		t.Errorf("Wrong(%s) wrote document without error", Text)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	buff := bytes.Buffer{}
+	WriteText(&buff, Result{Op: "set", Key: "brightness", Value: "100", OK: true})
+	WriteText(&buff, Result{Op: "focus", Key: "status", OK: true, Focus: NewFocus(focus.Status{State: "focus", Remaining: time.Minute * 5, Cycle: 1, Cycles: 4})})
+	WriteText(&buff, Result{Op: "token", Key: "list", OK: true, Tokens: []Token{{Name: "calendar", ID: "0a1b2c3d", Role: "control", Operations: []string{"set", "notify"}, Created: "2026-01-02T03:04:05Z"}}})
+	WriteText(&buff, Result{Op: "log", OK: true, Log: []audit.Entry{
+		{Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local), Source: "ipc", Identity: audit.Identity{Peer: "192.168.1.10:52314", Auth: "token calendar", Client: "alice@laptop"}, Op: "set", Key: "color", Value: "magenta", Result: "ok", Previous: "0:255:0"},
+		{Time: time.Date(2026, 1, 2, 3, 5, 0, 0, time.Local), Source: "http", Op: "set", Key: "PUT /api/state", Result: "auth_failed", Message: "authentication failed"},
+	}})
+	WriteText(&buff, Result{Op: "history", Key: "list", OK: true, History: []history.Entry{
+		{Time: time.Date(2026, 1, 2, 3, 6, 0, 0, time.Local), Source: "ipc", Client: "alice@laptop", State: history.State{Color: "0:0:0", Mode: "solid", Brightness: 50}},
+		{Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local), Source: "device", State: history.State{Color: "255:0:0", Mode: "blink", Brightness: 100, Dim: true}},
+	}})
+	WriteText(&buff, Result{Op: "history", Key: "undo", OK: true, History: []history.Entry{{Source: "device", State: history.State{Color: "255:0:0", Mode: "blink", Brightness: 100, Dim: true}}}})
+	want := "set brightness 100: ok\n[focus]\n- state = focus\n- paused = false\n- remaining = 5m0s\n- cycle = 1/4\n- long breaks = 0\n" +
+		"[calendar]\n- id = 0a1b2c3d\n- role = control\n- operations = set, notify\n- created = 2026-01-02T03:04:05Z\n" +
+		"2026-01-02 03:04:05 ipc    set color magenta: ok (was 0:255:0) by alice@laptop, token calendar, 192.168.1.10:52314\n" +
+		"2026-01-02 03:05:00 http   set PUT /api/state: auth_failed (authentication failed)\n" +
+		"  0  2026-01-02 03:06:00  ipc (alice@laptop): color 0:0:0, mode solid, brightness 50, dim off\n" +
+		"  1  2026-01-02 03:04:05  device: color 255:0:0, mode blink, brightness 100, dim on\n" +
+		"history undo: ok, restored color 255:0:0, mode blink, brightness 100, dim on\n"
+
+	if buff.String() != want {
+		t.Errorf("Wrong() == %q, want %q", buff.String(), want)
+	}
+}
+
+func TestNewList(t *testing.T) {
+	palette := ipc.Palette{
+		Colors: []ipc.PaletteColor{{Name: "red", Value: "255:0:0"}},
+		Modes:  []string{"solid"},
+		States: []ipc.PaletteState{{Name: "busy", Color: "red", Mode: "solid"}},
+	}
+	tests := []struct {
+		in_value string
+		want     string
+	}{
+		{"colors", "red\t255:0:0\n"},
+		{"modes", "solid\n"},
+		{"states", "busy\tred solid\n"},
+		{"all", "[colors]\nred\t255:0:0\n\n[modes]\nsolid\n\n[states]\nbusy\tred solid\n"},
+	}
+
+	for _, test := range tests {
+		buff := bytes.Buffer{}
+		WriteText(&buff, NewList(palette, test.in_value))
+		if buff.String() != test.want {
+			t.Errorf("Wrong(%s) == %q, want %q", test.in_value, buff.String(), test.want)
+		}
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	e := events.Event{Type: "state", Key: "mode", Old: "solid", New: "pulse", Time: time.Unix(0, 0).UTC()}
+	buff := bytes.Buffer{}
+	if err := WriteEvent(&buff, YAML, e); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buff.String(), "---\ntype: state\n") {
+		t.Errorf("Wrong(%s) == %q, want a YAML document", YAML, buff.String())
+	}
+}
@@ -0,0 +1,128 @@
+// DSUL - Disturb State USB Light : Reload module
+package reload
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/serial"
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+var (
+	verbose bool = false
+	debug   bool = false
+)
+
+const settleTime = time.Millisecond * 250 // how long to wait for more changes to the config file before reloading
+
+// Runner parts //
+
+// Runner reloads the settings when the config file changes, or when SIGHUP is received.
+// Arguments (settings given on the command line) are applied to the reloaded settings.
+func Runner(cfg *settings.Config, output_handling struct {
+	Verbose bool
+	Debug   bool
+}, arguments settings.Change, cmd_channel chan serial.Command) {
+	verbose = output_handling.Verbose
+	debug = output_handling.Debug
+
+	changed := make(chan bool, 1)
+	for _, path := range settings.ConfigPaths() {
+		if _, err := os.Stat(filepath.Dir(path)); err != nil {
+			continue // no config file there, yet
+		}
+		if err := watch(path, changed); err != nil {
+			log.Printf("[reload] Unable to watch config file, use SIGHUP to reload: %v\n", err)
+		}
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	settle := time.NewTimer(time.Hour)
+	settle.Stop()
+	for {
+		select {
+		case <-changed:
+			settle.Reset(settleTime) // editors often write the file more than once
+		case <-settle.C:
+			if verbose {
+				log.Println("[reload] Config file changed")
+			}
+			_ = reload(cfg, arguments, cmd_channel)
+		case <-hangup:
+			if verbose {
+				log.Println("[reload] SIGHUP received")
+			}
+			_ = reload(cfg, arguments, cmd_channel)
+		}
+	}
+}
+
+// reload loads, validates and applies the settings. The running settings are kept if the loaded ones aren't valid.
+// Network settings (and the socket's path, owner, group and mode, and if and where the audit log and state history are written) are only applied on restart,
+// changed serial settings reopen the device.
+func reload(cfg *settings.Config, arguments settings.Change, cmd_channel chan serial.Command) error {
+	loaded, err := settings.LoadValidSettings(arguments)
+	if err != nil {
+		log.Println("[reload] Settings rejected, keeping the running settings:")
+		for _, problem := range settings.GetProblems(err) {
+			log.Printf("[reload] - %s\n", problem)
+		}
+		return err
+	}
+
+	changed, reopen := false, false
+	_ = settings.Update(cfg, func(current *settings.Config) error {
+		keepRestartSettings(&loaded, current)
+		if reflect.DeepEqual(loaded, *current) {
+			return nil
+		}
+		changed, reopen = true, loaded.Serial != current.Serial
+		*current = loaded
+		return nil
+	})
+	if !changed {
+		if debug {
+			log.Println("[reload] Settings unchanged")
+		}
+		return nil
+	}
+	log.Println("[reload] Settings reloaded")
+
+	if reopen && cmd_channel != nil {
+		log.Printf("[reload] Serial settings changed, reopening device: %s (%d)\n", loaded.Serial.Port, loaded.Serial.Baudrate)
+		if response := serial.Send(cmd_channel, "reload", "reopen", ""); response != "ok" {
+			log.Printf("[reload] Device is not connected: %s\n", loaded.Serial.Port)
+		}
+	}
+	return nil
+}
+
+// keepRestartSettings keeps the running settings that are only applied on restart, logging the ones that changed.
+func keepRestartSettings(loaded *settings.Config, cfg *settings.Config) {
+	origins := loaded.Network.HttpOrigins // applied directly
+	loaded.Network.HttpOrigins = cfg.Network.HttpOrigins
+	if !reflect.DeepEqual(loaded.Network, cfg.Network) {
+		log.Println("[reload] Network settings changed, restart the daemon to apply them")
+		loaded.Network = cfg.Network
+	}
+	loaded.Network.HttpOrigins = origins
+	if loaded.Socket.Path != cfg.Socket.Path || loaded.Socket.Owner != cfg.Socket.Owner || loaded.Socket.Group != cfg.Socket.Group || loaded.Socket.Mode != cfg.Socket.Mode {
+		log.Println("[reload] Socket settings changed, restart the daemon to apply them")
+		loaded.Socket.Path, loaded.Socket.Owner, loaded.Socket.Group, loaded.Socket.Mode = cfg.Socket.Path, cfg.Socket.Owner, cfg.Socket.Group, cfg.Socket.Mode
+	}
+	if loaded.Audit.Enabled != cfg.Audit.Enabled || loaded.Audit.Path != cfg.Audit.Path {
+		log.Println("[reload] Audit log settings changed, restart the daemon to apply them")
+		loaded.Audit.Enabled, loaded.Audit.Path = cfg.Audit.Enabled, cfg.Audit.Path
+	}
+	if loaded.History.Enabled != cfg.History.Enabled || loaded.History.Path != cfg.History.Path {
+		log.Println("[reload] History settings changed, restart the daemon to apply them")
+		loaded.History.Enabled, loaded.History.Path = cfg.History.Enabled, cfg.History.Path
+	}
+}
@@ -0,0 +1,69 @@
+// DSUL - Disturb State USB Light : Reload module tests.
+package reload
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestReload(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	cfg, err := settings.LoadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(settings.ConfigPath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	arguments := func(cfg *settings.Config) error {
+		cfg.Password = "secret"
+		return nil
+	}
+	uses := "states: []\nfocus: {focuscolor: black, breakcolor: black, longbreakcolor: black}\n" // only use black
+	tests := []struct {
+		in_value string // config file
+		want     string // color and password of the running settings, after reload
+	}{
+		{"colors:\n  - name: black\n    value: 0:0:0\n  - name: pink\n    value: 255:105:180\n", "pink secret"},
+		{"colors:\n  - name: black\n    value: 0:0:0\n  - name: pink\n    value: 255:105:999\n", "pink secret"},
+		{"colors:\n  - name: black\n    value: 0:0:0\n  - name: rose\n    value: 255:105:180\nnetwork:\n  port: 9999\n", "rose secret"},
+	}
+
+	for _, test := range tests {
+		if err := os.WriteFile(settings.ConfigPath(), []byte(test.in_value+uses), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_ = reload(&cfg, arguments, nil)
+		if out_value := cfg.Colors[len(cfg.Colors)-1].Name + " " + cfg.Password; out_value != test.want {
+			t.Errorf("Wrong(%q) == %q, want %q", test.in_value, out_value, test.want)
+		}
+	}
+	if cfg.Network.Port != 9292 {
+		t.Errorf("Wrong() == %d, want network port to be unchanged until restart", cfg.Network.Port)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dsul.yml")
+	if err := os.WriteFile(path, []byte("password: \"\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed := make(chan bool, 1)
+	if err := watch(path, changed); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if err := os.WriteFile(path, []byte("password: \"secret\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second * 5):
+		t.Errorf("Wrong() didn't notice the changed file")
+	}
+}
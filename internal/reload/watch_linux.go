@@ -0,0 +1,50 @@
+// DSUL - Disturb State USB Light : Reload module, file watching (inotify)
+package reload
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watch sends on the changed channel when the file is written, created or replaced.
+// The directory is watched, as editors often replace the file instead of writing to it.
+func watch(path string, changed chan bool) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	dir, name := filepath.Split(path)
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE); err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	go func() {
+		defer unix.Close(fd)
+		buff := make([]byte, 4096)
+		for {
+			n, err := unix.Read(fd, buff)
+			if err != nil {
+				log.Printf("[reload] Stopped watching config file: %v\n", err)
+				return
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buff[offset]))
+				start := offset + unix.SizeofInotifyEvent
+				offset = start + int(event.Len)
+				if strings.TrimRight(string(buff[start:offset]), "\x00") != name {
+					continue
+				}
+				select {
+				case changed <- true:
+				default: // a change is already waiting to be handled
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+// DSUL - Disturb State USB Light : Reload module, file watching (polling)
+package reload
+
+import (
+	"os"
+	"time"
+)
+
+const pollInterval = time.Second * 2 // how often the file is checked for changes
+
+// watch sends on the changed channel when the file is created, or its modification time or size changes.
+func watch(path string, changed chan bool) error {
+	info, _ := os.Stat(path) // the file may be created later
+
+	go func() {
+		for range time.Tick(pollInterval) {
+			current, err := os.Stat(path)
+			if err != nil || (info != nil && current.ModTime().Equal(info.ModTime()) && current.Size() == info.Size()) {
+				continue
+			}
+			info = current
+			select {
+			case changed <- true:
+			default: // a change is already waiting to be handled
+			}
+		}
+	}()
+	return nil
+}
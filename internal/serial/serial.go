@@ -6,8 +6,12 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/hymnis/dsul-go/internal/audit"
+	"github.com/hymnis/dsul-go/internal/events"
+	"github.com/hymnis/dsul-go/internal/history"
 	"github.com/hymnis/dsul-go/internal/settings"
 	"github.com/hymnis/dsul-go/internal/watchdog"
 	"go.bug.st/serial"
@@ -16,10 +20,35 @@ import (
 var (
 	verbose bool = false
 	debug   bool = false
+
+	limits_lock   sync.RWMutex
+	device_limits settings.Hardware // brightness limits reported by the device, kept apart from the configured ones
 )
 
+// Command is a request for the serial device and the channel to send the response on.
+// Source tells what sent the command (e.g. ipc, http or focus), and Identity who sent it (for the audit log).
+// Changes with the same step (e.g. a color, mode and brightness set together) are one step in the history.
+type Command struct {
+	Key      string
+	Value    string
+	Response chan string
+	Source   string
+	Identity audit.Identity
+	Step     string
+}
+
 // Init starts the initialization of the serial device.
 func Init(cfg *settings.Config) serial.Port {
+	port, err := open(cfg)
+	if err != nil {
+		log.Fatalf("[serial] Failed to open port: %v", err.Error())
+	}
+
+	return port
+}
+
+// open opens the serial port and waits for the device to boot.
+func open(cfg *settings.Config) (serial.Port, error) {
 	mode := &serial.Mode{
 		BaudRate: cfg.Serial.Baudrate,
 		Parity:   serial.NoParity,
@@ -28,7 +57,7 @@ func Init(cfg *settings.Config) serial.Port {
 	}
 	port, err := serial.Open(cfg.Serial.Port, mode)
 	if err != nil {
-		log.Fatalf("[serial] Failed to open port: %v", err.Error())
+		return nil, err
 	}
 	port.SetReadTimeout(time.Second * 2)
 	if verbose {
@@ -36,7 +65,7 @@ func Init(cfg *settings.Config) serial.Port {
 	}
 	time.Sleep(time.Second * 2) // let device boot properly
 
-	return port
+	return port, nil
 }
 
 // Read receives serial data from given port and returns it.
@@ -47,7 +76,7 @@ func Read(port serial.Port) string {
 	for {
 		n, err := port.Read(buff)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("[serial] Failed to read: %v\n", err)
 			break
 		}
 		if n == 0 {
@@ -87,7 +116,7 @@ func Write(port serial.Port, data []byte) {
 	}
 	_, err := port.Write(data)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("[serial] Failed to write: %v\n", err)
 	}
 }
 
@@ -213,12 +242,16 @@ func GetColorString(value string, cfg *settings.Config) (string, bool) {
 			}
 		}
 	}
-	red, green, blue := func(s []string) (string, string, string) {
-		return s[0], s[1], s[2]
-	}(strings.Split(value, ":"))
-	red_i, _ := strconv.Atoi(red)
-	green_i, _ := strconv.Atoi(green)
-	blue_i, _ := strconv.Atoi(blue)
+	rgb := strings.Split(value, ":")
+	if len(rgb) != 3 {
+		return command, ok // not a known color or a red:green:blue value
+	}
+	red_i, err_red := strconv.Atoi(rgb[0])
+	green_i, err_green := strconv.Atoi(rgb[1])
+	blue_i, err_blue := strconv.Atoi(rgb[2])
+	if err_red != nil || err_green != nil || err_blue != nil {
+		return command, ok
+	}
 
 	if red_i >= 0 && red_i <= 255 && green_i >= 0 && green_i <= 255 && blue_i >= 0 && blue_i <= 255 {
 		command = fmt.Sprintf("+l%03d%03d%03d#", red_i, green_i, blue_i)
@@ -232,9 +265,10 @@ func GetColorString(value string, cfg *settings.Config) (string, bool) {
 func GetBrightnessString(value string, cfg *settings.Config) (string, bool) {
 	command := ""
 	ok := false
-	value_i, _ := strconv.Atoi(value)
+	value_i, err := strconv.Atoi(value)
+	brightness_min, brightness_max := GetBrightnessLimits(cfg)
 
-	if value_i >= cfg.BrightnessMin && value_i <= cfg.BrightnessMax {
+	if err == nil && value_i >= brightness_min && value_i <= brightness_max {
 		command = fmt.Sprintf("+b%03d#", value_i)
 		ok = true
 	}
@@ -242,6 +276,13 @@ func GetBrightnessString(value string, cfg *settings.Config) (string, bool) {
 	return command, ok
 }
 
+// GetBrightnessLimits returns the brightness limits allowed by both the configuration and the connected device.
+func GetBrightnessLimits(cfg *settings.Config) (int, int) {
+	limits_lock.RLock()
+	defer limits_lock.RUnlock()
+	return settings.GetBrightnessLimits(cfg, device_limits)
+}
+
 // GetModeString returns a string ready to send to serial device, for setting display mode.
 func GetModeString(value string, cfg *settings.Config) (string, bool) {
 	command := ""
@@ -271,16 +312,28 @@ func GetDimString(value string) (string, bool) {
 	return command, ok
 }
 
-// updateHardwareInformation gets and parses hardware information, updating settings if needed and returns the information.
-func updateHardwareInformation(port serial.Port, cfg *settings.Config) string {
+// getColorValue returns the red:green:blue value of the given color (name or value), in the same format as the device reports it.
+func getColorValue(value string, cfg *settings.Config) string {
+	command, ok := GetColorString(value, cfg)
+	if !ok {
+		return ""
+	}
+	red_i, _ := strconv.Atoi(command[2:5])
+	green_i, _ := strconv.Atoi(command[5:8])
+	blue_i, _ := strconv.Atoi(command[8:11])
+	return fmt.Sprintf("%d:%d:%d", red_i, green_i, blue_i)
+}
+
+// updateHardwareInformation gets and parses hardware information, storing the device's brightness limits, and returns the information.
+// The configured limits aren't changed, brightness values are checked against both (see GetBrightnessLimits).
+func updateHardwareInformation(port serial.Port) string {
 	hardware_info := SendRequest(port)
 	hardware_state := *settings.ParseHardwareInformation(hardware_info)
 
-	if hardware_state.Brightness_min >= 0 {
-		cfg.BrightnessMin = hardware_state.Brightness_min
-	}
 	if hardware_state.Brightness_max > 0 {
-		cfg.BrightnessMax = hardware_state.Brightness_max
+		limits_lock.Lock()
+		device_limits = settings.Hardware{Brightness_min: hardware_state.Brightness_min, Brightness_max: hardware_state.Brightness_max}
+		limits_lock.Unlock()
 	}
 
 	return hardware_info
@@ -289,70 +342,399 @@ func updateHardwareInformation(port serial.Port, cfg *settings.Config) string {
 // Runner parts //
 
 // Runner set ups the serial communication handler.
-// Handles reading and writing in different goroutines.
+// Handles reading and writing in different goroutines. Changes to the device state are recorded in the audit log,
+// and applied states in the history.
 func Runner(cfg *settings.Config, output_handling struct {
 	Verbose bool
 	Debug   bool
-}, cmd_channel chan string, rsp_channel chan string) {
+}, audit_log *audit.Log, state_history *history.History, cmd_channel chan Command, overlay_channel chan Command, event_channel chan events.Event) {
 	verbose = output_handling.Verbose
 	debug = output_handling.Debug
 	port := Init(cfg)
 	_ = SendPing(port)
-	_ = updateHardwareInformation(port, cfg)
 
-	go commandHandler(port, cmd_channel, rsp_channel, cfg)
+	go commandHandler(port, cmd_channel, overlay_channel, event_channel, audit_log, state_history, cfg)
 
 	select {}
 }
 
+// device holds the serial port and the last known state of the device.
+type device struct {
+	port          serial.Port
+	connected     bool
+	state         settings.Hardware
+	cfg           *settings.Config // snapshot of the shared configuration, taken for each event
+	shared        *settings.Config
+	event_channel chan events.Event
+	audit_log     *audit.Log
+	history       *history.History
+}
+
+// update requests the hardware information and stores the current state.
+func (d *device) update() string {
+	hw_info := updateHardwareInformation(d.port)
+	hardware_state := *settings.ParseHardwareInformation(hw_info)
+	if hardware_state.Version != "" {
+		d.state = hardware_state
+	}
+	return hw_info
+}
+
+// check pings the device and handles it being disconnected.
+func (d *device) check() bool {
+	if SendPing(d.port) {
+		return true
+	}
+	events.Publish(d.event_channel, events.Event{Type: "ping", Source: "serial", New: "failed"})
+	if SendPing(d.port) { // try again before giving up on the device
+		return true
+	}
+
+	log.Printf("[serial] Device is not responding, closing port: %s\n", d.cfg.Serial.Port)
+	d.port.Close()
+	d.connected = false
+	events.Publish(d.event_channel, events.Event{Type: "device", Source: "serial", Old: "connected", New: "disconnected"})
+	return false
+}
+
+// reconnect tries to open the port again and returns true if the device responds.
+func (d *device) reconnect() bool {
+	port, err := open(d.cfg)
+	if err != nil {
+		if debug {
+			log.Printf("[serial] Failed to open port: %v\n", err)
+		}
+		return false
+	}
+	if !SendPing(port) {
+		port.Close()
+		return false
+	}
+
+	log.Printf("[serial] Device connected: %s\n", d.cfg.Serial.Port)
+	d.port = port
+	d.connected = true
+	d.update()
+	events.Publish(d.event_channel, events.Event{Type: "device", Source: "serial", Old: "disconnected", New: "connected"})
+	return true
+}
+
+// reopen closes the port and opens it again (e.g. with another port or baudrate), restoring the last known state.
+func (d *device) reopen() string {
+	state := d.state
+	if d.connected {
+		log.Printf("[serial] Reopening port: %s\n", d.cfg.Serial.Port)
+		d.port.Close()
+		d.connected = false
+		events.Publish(d.event_channel, events.Event{Type: "device", Source: "serial", Old: "connected", New: "disconnected"})
+	}
+	if !d.reconnect() {
+		return "offline"
+	}
+	d.restore(state)
+	return "ok"
+}
+
+// restore sets the mode, brightness, color and dim of the given state, if it's known.
+func (d *device) restore(state settings.Hardware) {
+	if state.Version == "" {
+		return
+	}
+	if verbose {
+		log.Println("[serial] Restoring device state")
+	}
+	_ = SendModeCommand(d.port, strconv.Itoa(state.Current_mode), d.cfg)
+	_ = SendBrightnessCommand(d.port, strconv.Itoa(state.Current_brightness), d.cfg)
+	_ = SendColorCommand(d.port, state.Current_color, d.cfg)
+	_ = SendDimCommand(d.port, strconv.Itoa(state.Current_dim))
+	d.update()
+}
+
 // commandHandler receives incoming commands and calls the appropriate serial functions.
-func commandHandler(port serial.Port, cmd_channel chan string, rsp_channel chan string, cfg *settings.Config) {
+// Commands on the overlay channel take precedence. While the overlay channel holds the device
+// ("hold:true"), commands from the command channel are queued and handled once it's released ("hold:false").
+func commandHandler(port serial.Port, cmd_channel chan Command, overlay_channel chan Command, event_channel chan events.Event, audit_log *audit.Log, state_history *history.History, cfg *settings.Config) {
 	pinger := watchdog.NewChannelTimer(time.Second * 30) // make sure watchdog send ping every 30 seconds if no other commands have been sent
+	retrier := watchdog.NewChannelTimer(time.Second * 5) // try to reconnect every 5 seconds while the device is disconnected
+	d := device{port: port, connected: true, cfg: settings.Snapshot(cfg), shared: cfg, event_channel: event_channel, audit_log: audit_log, history: state_history}
+	d.update()
+	held := false
+	var pending []Command
 
 	for {
 		select {
 		case <-pinger.Channel():
-			_ = SendPing(port)
+			d.cfg = settings.Snapshot(d.shared)
+			if d.connected {
+				_ = d.check()
+			}
 			pinger.Kick()
-		case data := <-cmd_channel:
-			if len(data) > 0 {
-				parts := strings.Split(data, ":")
-				status := false
-				rsp_msg := "nok"
-
-				if parts[0] == "color" {
-					status = SendColorCommand(port, parts[1], cfg)
-				} else if parts[0] == "brightness" {
-					status = SendBrightnessCommand(port, parts[1], cfg)
-				} else if parts[0] == "mode" {
-					mode_str := ""
-					for _, cfg_mode := range cfg.Modes {
-						if cfg_mode.Name == parts[1] {
-							mode_str = strconv.Itoa(cfg_mode.Value)
-						}
-					}
-					status = SendModeCommand(port, mode_str, cfg)
-				} else if parts[0] == "dim" {
-					dim_str := "0"
-					if parts[1] == "true" {
-						dim_str = "1"
+		case <-retrier.Channel():
+			d.cfg = settings.Snapshot(d.shared)
+			if !d.connected {
+				_ = d.reconnect()
+			}
+			retrier.Kick()
+		case command := <-overlay_channel:
+			d.cfg = settings.Snapshot(d.shared)
+			if command.Key == "hold" {
+				held = command.Value == "true"
+				respond(command, "ok")
+				if !held {
+					if verbose && len(pending) > 0 {
+						log.Printf("[serial] Handling %d queued command(s)\n", len(pending))
 					}
-					status = SendDimCommand(port, dim_str)
-				} else if parts[0] == "information" {
-					if parts[1] == "all" {
-						hw_info := updateHardwareInformation(port, cfg)
-						rsp_channel <- hw_info
-						pinger.Kick()
-						break // skip kicking and sending reply later on
+					for _, queued := range pending {
+						d.handleCommand(queued)
 					}
+					pending = nil
 				}
+			} else {
+				d.handleCommand(command)
+			}
+			pinger.Kick()
+		case command := <-cmd_channel:
+			d.cfg = settings.Snapshot(d.shared)
+			if held {
+				pending = append(pending, command)
+				break
+			}
+			d.handleCommand(command)
+			pinger.Kick()
+		}
+	}
+}
 
-				if status {
-					rsp_msg = "ok"
-				}
-				rsp_channel <- rsp_msg
-				pinger.Kick()
+// handleCommand calls the serial function for the given command and sends the response.
+// Applied states are recorded in the history, "undo" and "restore" restore states from it.
+func (d *device) handleCommand(command Command) {
+	if len(command.Key) == 0 {
+		return
+	}
+	if command.Key == "reopen" {
+		respond(command, d.reopen())
+		return
+	}
+	if !d.connected && !d.reconnect() {
+		d.record(command, "offline", "")
+		respond(command, "offline")
+		return
+	}
+	if command.Key == "undo" || command.Key == "restore" {
+		respond(command, d.restoreHistory(command))
+		return
+	}
+	previous := d.getState()
+	response := d.change(command)
+	if response == "ok" {
+		d.remember(command, previous)
+	}
+	respond(command, response)
+}
+
+// change calls the serial function for the given command and returns the response.
+// Changes to the device state are published as events, and recorded in the audit log (also when they fail).
+func (d *device) change(command Command) string {
+	status := false
+	rsp_msg := "nok"
+	old_value, new_value := "", ""
+
+	if command.Key == "color" {
+		status = SendColorCommand(d.port, command.Value, d.cfg)
+		old_value, new_value = d.state.Current_color, getColorValue(command.Value, d.cfg)
+		if status {
+			d.state.Current_color = new_value
+		}
+	} else if command.Key == "brightness" {
+		status = SendBrightnessCommand(d.port, command.Value, d.cfg)
+		value_i, _ := strconv.Atoi(command.Value)
+		old_value, new_value = strconv.Itoa(d.state.Current_brightness), strconv.Itoa(value_i)
+		if status {
+			d.state.Current_brightness = value_i
+		}
+	} else if command.Key == "mode" {
+		mode_str := ""
+		for _, cfg_mode := range d.cfg.Modes {
+			if cfg_mode.Name == command.Value {
+				mode_str = strconv.Itoa(cfg_mode.Value)
+			}
+		}
+		status = SendModeCommand(d.port, mode_str, d.cfg)
+		old_value, new_value = settings.GetModeName(d.state.Current_mode, d.cfg), command.Value
+		if status {
+			d.state.Current_mode, _ = strconv.Atoi(mode_str)
+		}
+	} else if command.Key == "dim" {
+		dim_str := "0"
+		if command.Value == "true" {
+			dim_str = "1"
+		}
+		status = SendDimCommand(d.port, dim_str)
+		old_value, new_value = strconv.FormatBool(d.state.Current_dim == 1), strconv.FormatBool(dim_str == "1")
+		if status {
+			d.state.Current_dim, _ = strconv.Atoi(dim_str)
+		}
+	} else if command.Key == "ping" {
+		status = SendPing(d.port)
+	} else if command.Key == "information" {
+		if command.Value == "all" {
+			hw_info := d.update()
+			if hw_info == "" {
+				_ = d.check()
 			}
+			return hw_info
+		}
+	}
+
+	if status {
+		rsp_msg = "ok"
+		if old_value != new_value {
+			events.Publish(d.event_channel, events.Event{Type: "state", Source: command.Source, Key: command.Key, Old: old_value, New: new_value})
+		}
+	} else if !d.check() { // make sure device is still there
+		rsp_msg = "offline"
+	}
+	d.record(command, rsp_msg, old_value)
+	return rsp_msg
+}
+
+// record records a command changing the device state in the audit log, with its response and the previous value.
+// Notification overlays aren't recorded, the notify request is recorded where it's accepted (e.g. by IPC).
+func (d *device) record(command Command, response string, previous string) {
+	if !isStateKey(command.Key) || command.Source == "notify" {
+		return
+	}
+	entry := audit.Entry{Source: command.Source, Identity: command.Identity, Op: "set", Key: command.Key, Value: command.Value, Result: "ok", Previous: previous}
+	if response == "offline" {
+		entry.Result, entry.Message = "device_offline", "device is not connected"
+	} else if response != "ok" {
+		entry.Result, entry.Message = "device_rejected", "device did not accept the command"
+	}
+	d.audit_log.Record(entry)
+}
+
+// remember records the state after a change in the history. Notification overlays aren't recorded, as they restore the state afterwards.
+func (d *device) remember(command Command, previous history.State) {
+	if !isStateKey(command.Key) || command.Source == "notify" {
+		return
+	}
+	d.history.Record(previous, history.Entry{Source: command.Source, Client: getClient(command.Identity), State: d.getState()}, command.Step)
+}
+
+// restoreHistory restores a state from the history and returns the response. Undo restores the state before the current one,
+// removing the undone entry from the history. Restore restores the state the given number of steps back, adding it to the history
+// (so it can be undone). Returns "invalid" if there is no such state.
+func (d *device) restoreHistory(command Command) string {
+	entries := d.history.List()
+	current := d.getState()
+	index := 0
+	if command.Key == "restore" {
+		n, err := strconv.Atoi(command.Value)
+		if err != nil || n < 0 {
+			return "invalid"
+		}
+		index = n
+	} else if len(entries) > 0 && entries[0].State == current {
+		index = 1 // the latest entry is the current state, unless it was changed outside the history (e.g. the device was reset)
+	}
+	if index >= len(entries) {
+		return "invalid"
+	}
+
+	for _, change := range getChanges(current, entries[index].State) {
+		change.Source, change.Identity = command.Source, command.Identity
+		if response := d.change(change); response != "ok" {
+			return response
 		}
 	}
+	if verbose {
+		log.Printf("[serial] Restored state %d step(s) back: %+v\n", index, entries[index].State)
+	}
+	if command.Key == "undo" {
+		d.history.Drop(index)
+	} else {
+		d.history.Record(current, history.Entry{Source: command.Source, Client: getClient(command.Identity), State: d.getState()}, "")
+	}
+	return "ok"
+}
+
+// getState returns the state of the device, for the history. It's empty if the state isn't known.
+func (d *device) getState() history.State {
+	if d.state.Version == "" {
+		return history.State{}
+	}
+	return history.State{
+		Color:      d.state.Current_color,
+		Mode:       settings.GetModeName(d.state.Current_mode, d.cfg),
+		Brightness: d.state.Current_brightness,
+		Dim:        d.state.Current_dim == 1,
+	}
+}
+
+// getChanges returns the commands needed to change the current state into the given state, in the order they're restored.
+func getChanges(current history.State, state history.State) []Command {
+	changes := []Command{}
+	if state.Mode != current.Mode {
+		changes = append(changes, Command{Key: "mode", Value: state.Mode})
+	}
+	if state.Brightness != current.Brightness {
+		changes = append(changes, Command{Key: "brightness", Value: strconv.Itoa(state.Brightness)})
+	}
+	if state.Color != current.Color {
+		changes = append(changes, Command{Key: "color", Value: state.Color})
+	}
+	if state.Dim != current.Dim {
+		changes = append(changes, Command{Key: "dim", Value: strconv.FormatBool(state.Dim)})
+	}
+	return changes
+}
+
+// getClient returns who sent a command, for the history: the client's identity, or its address.
+func getClient(identity audit.Identity) string {
+	if identity.Client != "" {
+		return identity.Client
+	}
+	return identity.Peer
+}
+
+// isStateKey returns true if the key is part of the device state: color, brightness, mode or dim.
+func isStateKey(key string) bool {
+	return key == "color" || key == "brightness" || key == "mode" || key == "dim"
+}
+
+// Send sends a command to the serial device, via the command channel, and waits for the response.
+func Send(cmd_channel chan Command, source string, key string, value string) string {
+	return SendAs(cmd_channel, source, audit.Identity{}, "", key, value)
+}
+
+// SendAs sends a command, on behalf of the given client, to the serial device and waits for the response.
+// Changes with the same (non-empty) step are one step in the history.
+func SendAs(cmd_channel chan Command, source string, identity audit.Identity, step string, key string, value string) string {
+	response := make(chan string, 1)
+	cmd_channel <- Command{Key: key, Value: value, Response: response, Source: source, Identity: identity, Step: step}
+	return <-response
+}
+
+// Restore sets the light to a state read from the device before it was changed, e.g. by a notification.
+// Modes are set by name, so the mode is only restored if it's configured.
+func Restore(cmd_channel chan Command, source string, snapshot settings.Hardware, cfg *settings.Config) {
+	dim := "false"
+	if snapshot.Current_dim == 1 {
+		dim = "true"
+	}
+	_ = Send(cmd_channel, source, "color", snapshot.Current_color)
+	_ = Send(cmd_channel, source, "brightness", strconv.Itoa(snapshot.Current_brightness))
+	if cfg_mode, ok := settings.GetMode(snapshot.Current_mode, cfg); ok {
+		_ = Send(cmd_channel, source, "mode", cfg_mode.Name)
+	} else {
+		log.Printf("[%s] Mode %d isn't configured, unable to restore it\n", source, snapshot.Current_mode)
+	}
+	_ = Send(cmd_channel, source, "dim", dim)
+}
+
+// respond sends the response to the channel given by the command, if any.
+func respond(command Command, response string) {
+	if command.Response != nil {
+		command.Response <- response
+	}
 }
@@ -1,7 +1,14 @@
 // DSUL - Disturb State USB Light : Serial module tests.
 package serial
 
-import "testing"
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/hymnis/dsul-go/internal/audit"
+	"github.com/hymnis/dsul-go/internal/history"
+	"github.com/hymnis/dsul-go/internal/settings"
+)
 
 func TestSomething(t *testing.T) {
 	cases := []struct {
@@ -17,3 +24,157 @@ func TestSomething(t *testing.T) {
 		}
 	}
 }
+
+func TestGetColorString(t *testing.T) {
+	cfg := settings.Config{Colors: []settings.Color{{Name: "orange", Value: "255:20:0"}}}
+	cases := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"orange", "+l255020000#", true},
+		{"0:128:255", "+l000128255#", true},
+		{"purple", "", false},
+		{"255:0", "", false},
+		{"256:0:0", "", false},
+		{"a:b:c", "", false},
+	}
+	for _, c := range cases {
+		got, ok := GetColorString(c.in, &cfg)
+		if got != c.want || ok != c.ok {
+			t.Errorf("Wrong(%q) == %q (%v), want %q (%v)", c.in, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestGetBrightnessString(t *testing.T) {
+	cfg := settings.Config{BrightnessMin: 0, BrightnessMax: 150}
+	cases := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"0", "+b000#", true},
+		{"150", "+b150#", true},
+		{"151", "", false},
+		{"bright", "", false},
+	}
+	for _, c := range cases {
+		got, ok := GetBrightnessString(c.in, &cfg)
+		if got != c.want || ok != c.ok {
+			t.Errorf("Wrong(%q) == %q (%v), want %q (%v)", c.in, got, ok, c.want, c.ok)
+		}
+	}
+
+	limits_lock.Lock()
+	device_limits = settings.Hardware{Brightness_min: 10, Brightness_max: 100}
+	limits_lock.Unlock()
+	defer func() { device_limits = settings.Hardware{} }()
+	cases = []struct {
+		in, want string
+		ok       bool
+	}{
+		{"5", "", false},
+		{"100", "+b100#", true},
+		{"120", "", false},
+	}
+	for _, c := range cases {
+		got, ok := GetBrightnessString(c.in, &cfg)
+		if got != c.want || ok != c.ok {
+			t.Errorf("Wrong(device limits, %q) == %q (%v), want %q (%v)", c.in, got, ok, c.want, c.ok)
+		}
+	}
+	if cfg.BrightnessMin != 0 || cfg.BrightnessMax != 150 {
+		t.Errorf("Wrong(configured limits) == %d-%d, want 0-150", cfg.BrightnessMin, cfg.BrightnessMax)
+	}
+}
+
+func TestRecordOffline(t *testing.T) {
+	cfg := settings.Config{Serial: settings.Serial{Port: filepath.Join(t.TempDir(), "missing"), Baudrate: 38400}}
+	cfg.Audit = settings.Audit{Enabled: true, Path: filepath.Join(t.TempDir(), "audit.log")}
+	audit_log, err := audit.Open(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := device{cfg: &cfg, audit_log: audit_log}
+	identity := audit.Identity{Peer: "local", Client: "alice@laptop"}
+
+	response := make(chan string, 2)
+	d.handleCommand(Command{Key: "color", Value: "red", Response: response, Source: "ipc", Identity: identity})
+	d.handleCommand(Command{Key: "information", Value: "all", Response: response, Source: "ipc", Identity: identity})
+	d.handleCommand(Command{Key: "color", Value: "0:0:0", Source: "notify"})
+	if got := <-response; got != "offline" {
+		t.Errorf("Wrong(response) == %q, want %q", got, "offline")
+	}
+
+	entries, err := audit_log.Read(audit.Filter{})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Wrong(recorded) == %+v (%v), want one entry", entries, err)
+	}
+	if entries[0].Identity != identity || entries[0].Key != "color" || entries[0].Result != "device_offline" {
+		t.Errorf("Wrong(entry) == %+v, want offline color set by %+v", entries[0], identity)
+	}
+}
+
+func TestRemember(t *testing.T) {
+	cfg := settings.Config{Modes: []settings.Mode{{Name: "solid", Value: 1}, {Name: "blink", Value: 2}}}
+	cfg.History = settings.History{Enabled: true, Path: filepath.Join(t.TempDir(), "history.json"), Size: 10}
+	d := device{cfg: &cfg, history: history.Open(&cfg)}
+	d.state = settings.Hardware{Version: "1.0", Current_color: "0:255:0", Current_mode: 1, Current_brightness: 50}
+	identity := audit.Identity{Peer: "local", Client: "alice@laptop"}
+
+	changes := []struct {
+		command Command
+		apply   func(*settings.Hardware)
+	}{
+		{Command{Key: "color", Source: "ipc", Identity: identity, Step: "a"}, func(hw *settings.Hardware) { hw.Current_color = "255:0:0" }},
+		{Command{Key: "mode", Source: "ipc", Identity: identity, Step: "a"}, func(hw *settings.Hardware) { hw.Current_mode = 2 }},
+		{Command{Key: "color", Source: "notify"}, func(hw *settings.Hardware) { hw.Current_color = "0:0:255" }},
+		{Command{Key: "color", Source: "notify"}, func(hw *settings.Hardware) { hw.Current_color = "255:0:0" }},
+		{Command{Key: "brightness", Source: "focus"}, func(hw *settings.Hardware) { hw.Current_brightness = 100 }},
+	}
+	for _, change := range changes {
+		previous := d.getState()
+		change.apply(&d.state)
+		d.remember(change.command, previous)
+	}
+
+	want := []history.Entry{
+		{Source: "focus", State: history.State{Color: "255:0:0", Mode: "blink", Brightness: 100}},
+		{Source: "ipc", Client: "alice@laptop", State: history.State{Color: "255:0:0", Mode: "blink", Brightness: 50}},
+		{Source: "device", State: history.State{Color: "0:255:0", Mode: "solid", Brightness: 50}},
+	}
+	entries := d.history.List()
+	if len(entries) != len(want) {
+		t.Fatalf("Wrong(history) == %+v, want %d entries", entries, len(want))
+	}
+	for i, entry := range entries {
+		if entry.Source != want[i].Source || entry.Client != want[i].Client || entry.State != want[i].State {
+			t.Errorf("Wrong(entry %d) == %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+func TestGetChanges(t *testing.T) {
+	current := history.State{Color: "0:0:0", Mode: "solid", Brightness: 50}
+	tests := []struct {
+		state history.State
+		want  []Command
+	}{
+		{current, []Command{}},
+		{history.State{Color: "255:0:0", Mode: "solid", Brightness: 50}, []Command{{Key: "color", Value: "255:0:0"}}},
+		{history.State{Color: "255:0:0", Mode: "blink", Brightness: 100, Dim: true}, []Command{
+			{Key: "mode", Value: "blink"}, {Key: "brightness", Value: "100"}, {Key: "color", Value: "255:0:0"}, {Key: "dim", Value: "true"},
+		}},
+	}
+	for _, test := range tests {
+		got := getChanges(current, test.state)
+		if len(got) != len(test.want) {
+			t.Errorf("Wrong(%+v) == %+v, want %+v", test.state, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Key != test.want[i].Key || got[i].Value != test.want[i].Value {
+				t.Errorf("Wrong(%+v) == %+v, want %+v", test.state, got, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// DSUL - Disturb State USB Light : Settings module, credentials
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Passwords are kept off the command line and out of config files with password files: --password-file, passwordfile in
+// config files, DSUL_PASSWORDFILE or the systemd credential "password" (LoadCredential=password:<path>).
+// Clients can also keep a password (or token) per server in their credentials file.
+
+var (
+	credentialsName = "credentials.yml"
+	credentialName  = "password" // name of the systemd credential, in $CREDENTIALS_DIRECTORY
+)
+
+// Credential holds the secrets used for a server.
+type Credential struct {
+	Password string
+	Token    string
+}
+
+// ReadPasswordFile returns the password in the file, without the trailing newline.
+// The file must not be readable by others.
+func ReadPasswordFile(path string) (string, error) {
+	if err := checkPermissions(path, 0007, "chmod o-rwx"); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %v", err)
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("password file is empty: %s", path)
+	}
+	return password, nil
+}
+
+// CredentialsPath returns the path to the user's credentials file.
+func CredentialsPath() string {
+	return buildPath(credentialsName)
+}
+
+// GetCredential returns the credential for the server, from the user's credentials file.
+// Servers are given as "host:port" or "host" (any port), the local daemon as "local".
+// The credentials file must only be accessible by the user (chmod 600).
+func GetCredential(server string, port int) (Credential, bool, error) {
+	path := CredentialsPath()
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return Credential{}, false, nil
+	}
+	if err := checkPermissions(path, 0077, "chmod 600"); err != nil {
+		return Credential{}, false, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Credential{}, false, err
+	}
+	credentials := map[string]Credential{}
+	if err := yaml.Unmarshal(data, &credentials); err != nil {
+		return Credential{}, false, getFileProblems(path, err)
+	}
+
+	names := []string{"local"}
+	if server != "" {
+		names = []string{net.JoinHostPort(server, strconv.Itoa(port)), server}
+	}
+	for _, name := range names {
+		if credential, ok := credentials[name]; ok {
+			return credential, true, nil
+		}
+	}
+	return Credential{}, false, nil
+}
+
+// ApplyCredential sets the password and token from the user's credentials file, for the configured server.
+// Secrets from the environment take precedence over the credentials file, the ones in config files don't.
+func ApplyCredential(cfg *Config, sources Sources) error {
+	credential, ok, err := GetCredential(cfg.Network.Server, cfg.Network.Port)
+	if err != nil || !ok {
+		return err
+	}
+	if credential.Password != "" && !strings.HasPrefix(sources["password"], "environment") {
+		cfg.Password = credential.Password
+		sources["password"] = CredentialsPath()
+	}
+	if credential.Token != "" && !strings.HasPrefix(sources["token"], "environment") {
+		cfg.Token = credential.Token
+		sources["token"] = CredentialsPath()
+	}
+	return nil
+}
+
+// withPasswordFile loads a layer of settings, reading the password from the password file if the layer sets one.
+// A password file takes precedence over a password set in the same layer.
+func withPasswordFile(cfg *Config, sources Sources, load func() error) error {
+	before := cfg.PasswordFile
+	if err := load(); err != nil {
+		return err
+	}
+	if cfg.PasswordFile == before || cfg.PasswordFile == "" {
+		return nil
+	}
+	password, err := ReadPasswordFile(cfg.PasswordFile)
+	if err != nil {
+		return err
+	}
+	cfg.Password = password
+	sources["password"] = sources["passwordfile"]
+	return nil
+}
+
+// loadCredential reads the password from the systemd credential, if the daemon is started with one.
+func loadCredential(cfg *Config, sources Sources) error {
+	directory := os.Getenv("CREDENTIALS_DIRECTORY")
+	if directory == "" {
+		return nil
+	}
+	path := filepath.Join(directory, credentialName)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	password, err := ReadPasswordFile(path)
+	if err != nil {
+		return err
+	}
+	cfg.Password = password
+	sources["password"] = "credential " + credentialName
+	return nil
+}
+
+// savePassword moves a password from the config file to a password file next to it, so it isn't saved in plaintext.
+func savePassword(cfg *Config) error {
+	path := filepath.Join(filepath.Dir(ConfigPath()), "password")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(cfg.Password+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil { // the file might already exist, with other permissions
+		return err
+	}
+	cfg.PasswordFile = path
+	return nil
+}
+
+// checkPermissions returns an error if the file is accessible with the given permissions (e.g. by others).
+// Permissions aren't checked on Windows.
+func checkPermissions(path string, permissions fs.FileMode, fix string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&permissions != 0 {
+		return fmt.Errorf("%s is accessible by others (%s), run: %s %s", path, info.Mode().Perm(), fix, path)
+	}
+	return nil
+}
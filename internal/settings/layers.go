@@ -0,0 +1,471 @@
+// DSUL - Disturb State USB Light : Settings module, layered configuration
+package settings
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings are read in layers, each one overriding the previous: defaults, the system config file, the user's config file
+// (or the one given as argument) and environment variables (DSUL_<KEY>, e.g. DSUL_SERIAL_PORT). Arguments are applied last.
+
+// Sources holds where each setting came from, by key (e.g. "serial.port").
+type Sources map[string]string
+
+// Setting is a setting with its (effective) value and where it came from.
+type Setting struct {
+	Key    string
+	Value  string
+	Source string
+}
+
+// Sources of settings, that aren't a config file.
+const (
+	SourceDefault   = "default"
+	SourceArguments = "arguments"
+)
+
+// LoadSettings returns the settings from all layers (or defaults), or why they couldn't be loaded.
+func LoadSettings() (Config, error) {
+	cfg, _, err := LoadLayers()
+	return cfg, err
+}
+
+// LoadLayers returns the settings from all layers, and where each setting came from.
+func LoadLayers() (Config, Sources, error) {
+	cfg := getDefaults()
+	sources := Sources{}
+	walkSettings(&cfg, func(key string, _ reflect.Value) {
+		sources[key] = SourceDefault
+	})
+
+	if err := withPasswordFile(&cfg, sources, func() error { return loadFile(SystemConfigPath(), &cfg, sources) }); err != nil {
+		return cfg, sources, err
+	}
+	if err := withPasswordFile(&cfg, sources, func() error { return loadFile(ConfigPath(), &cfg, sources) }); err != nil {
+		if configPath == "" || !errors.Is(err, fs.ErrNotExist) {
+			return cfg, sources, err
+		}
+		return cfg, sources, fmt.Errorf("config file not found: %s", configPath)
+	}
+	if err := loadCredential(&cfg, sources); err != nil {
+		return cfg, sources, err
+	}
+	err := withPasswordFile(&cfg, sources, func() error { return loadEnvironment(&cfg, sources) })
+	return cfg, sources, err
+}
+
+// ApplyArguments applies the settings given as arguments, marking the settings changed by them.
+func ApplyArguments(cfg *Config, sources Sources, arguments Change) error {
+	before := getValues(cfg)
+	if err := withPasswordFile(cfg, sources, func() error { return ApplyChange(cfg, arguments) }); err != nil {
+		return err
+	}
+	for key, value := range getValues(cfg) {
+		if value != before[key] {
+			sources[key] = SourceArguments
+		}
+	}
+	return nil
+}
+
+// Dump returns all settings, with their values and where they came from. The password is hidden.
+func Dump(cfg *Config, sources Sources) []Setting {
+	values := getValues(cfg)
+	dump := []Setting{}
+	walkSettings(cfg, func(key string, _ reflect.Value) {
+		value := values[key]
+		if (key == "password" || key == "token") && value != "" {
+			value = "(hidden)"
+		}
+		dump = append(dump, Setting{Key: key, Value: value, Source: sources[key]})
+	})
+	return dump
+}
+
+// SaveSettings applies the change to the settings in the config file and saves them.
+// Only settings that were already in the file, or differ from the defaults and system config file, are saved.
+// Values from the environment or given as arguments (or changed at runtime) are not saved, unless they're part of the change.
+// A password in the config file is moved to a password file, so it isn't saved in plaintext.
+func SaveSettings(change Change) error {
+	cfg := getDefaults()
+	sources := Sources{}
+	if err := loadFile(SystemConfigPath(), &cfg, sources); err != nil {
+		return err
+	}
+	base := getValues(&cfg)
+	if err := loadFile(ConfigPath(), &cfg, sources); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := ApplyChange(&cfg, change); err != nil {
+		return err
+	}
+	if sources["password"] == ConfigPath() && cfg.Password != "" && cfg.PasswordFile == base["passwordfile"] {
+		if err := savePassword(&cfg); err != nil {
+			return err
+		}
+	}
+
+	keep := map[string]bool{"schemaVersion": true} // the format of the saved file
+	for key, value := range getValues(&cfg) {
+		keep[key] = keep[key] || sources[key] == ConfigPath() || value != base[key]
+	}
+	return saveFile(ConfigPath(), &cfg, keep)
+}
+
+// SetConfigPath sets the config file to use instead of the user's config file.
+func SetConfigPath(path string) {
+	configPath = path
+}
+
+// ConfigPath returns the path to the user's config file (or the one given as argument).
+func ConfigPath() string {
+	if configPath != "" {
+		return configPath
+	}
+	return buildPath(configName)
+}
+
+// SystemConfigPath returns the path to the system config file.
+func SystemConfigPath() string {
+	if runtime.GOOS == "windows" {
+		return fmt.Sprintf("%s\\%s\\%s", os.Getenv("ProgramData"), applicationName, configName)
+	}
+	return fmt.Sprintf("/etc/%s/%s", applicationName, configName)
+}
+
+// ConfigPaths returns the paths of the config files, in the order they're read.
+func ConfigPaths() []string {
+	return []string{SystemConfigPath(), ConfigPath()}
+}
+
+// loadFile reads the settings in the config file, if it exists, marking the settings found in it.
+func loadFile(path string, cfg *Config, sources Sources) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && path != configPath {
+		return nil // config files are optional, unless given as argument
+	} else if err != nil {
+		return err
+	}
+
+	root := yaml.Node{}
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return getFileProblems(path, err)
+	}
+	if err := migrate(&root, path); err != nil {
+		return err
+	}
+	if len(root.Content) == 0 {
+		return nil // empty config file
+	}
+	if err := root.Decode(cfg); err != nil {
+		return getFileProblems(path, err)
+	}
+	found := map[string]interface{}{}
+	_ = root.Decode(&found)
+	walkSettings(cfg, func(key string, _ reflect.Value) {
+		if hasKey(found, key) {
+			sources[key] = path
+		}
+	})
+	return nil
+}
+
+// getFileProblems returns the problems of an error from parsing a config file, located by file and line.
+func getFileProblems(path string, err error) Problems {
+	messages := []string{err.Error()}
+	if type_error, ok := err.(*yaml.TypeError); ok {
+		messages = type_error.Errors
+	}
+
+	problems := Problems{}
+	for _, message := range messages {
+		problem := Problem{Location: path, Message: strings.TrimPrefix(message, "yaml: ")}
+		if match := regexp.MustCompile(`^line (\d+): (.*)$`).FindStringSubmatch(problem.Message); match != nil {
+			problem.Location = path + ":" + match[1]
+			problem.Message = match[2]
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// saveFile writes the settings to the config file, only the ones to keep. The password is never written.
+// Settings are updated in the file's YAML tree, so comments and the order of keys are kept. The file is replaced
+// once the new one is written, keeping its mode, so a failed write never leaves a truncated config file.
+func saveFile(path string, cfg *Config, keep map[string]bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	root := yaml.Node{}
+	mode := fs.FileMode(0644)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return getFileProblems(path, err)
+		}
+		if err := migrate(&root, path); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(root.Content) == 0 {
+		root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	mapping := root.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: settings must be given as keys and values", path)
+	}
+
+	var set_err error
+	walkSettings(cfg, func(key string, value reflect.Value) {
+		if key == "password" || key == "token" {
+			removeNode(mapping, key) // secrets are only read from config files, never saved
+			return
+		}
+		if !keep[key] || set_err != nil {
+			return
+		}
+		set_err = setNode(mapping, key, value.Interface())
+	})
+	if set_err != nil {
+		return set_err
+	}
+
+	buffer := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return replaceFile(path, buffer.Bytes(), mode)
+}
+
+// replaceFile writes the data to a temporary file next to the file, and renames it over the file once it's synced.
+func replaceFile(path string, data []byte, mode fs.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(mode)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// setNode sets the (dotted) key in the parsed config file, adding it and its sections if missing.
+// A value that hasn't changed is left as it is, and a changed value keeps its comments.
+func setNode(mapping *yaml.Node, key string, value interface{}) error {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		section := getNode(mapping, part)
+		if section == nil {
+			section = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: part}, section)
+		} else if section.Kind != yaml.MappingNode {
+			*section = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", HeadComment: section.HeadComment, LineComment: section.LineComment}
+		}
+		mapping = section
+	}
+
+	current := getNode(mapping, parts[len(parts)-1])
+	if current != nil {
+		existing := reflect.New(reflect.TypeOf(value))
+		if current.Decode(existing.Interface()) == nil && reflect.DeepEqual(existing.Elem().Interface(), value) {
+			return nil
+		}
+	}
+	value_node := yaml.Node{}
+	if err := value_node.Encode(value); err != nil {
+		return err
+	}
+	if current == nil {
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: parts[len(parts)-1]}, &value_node)
+		return nil
+	}
+	value_node.HeadComment, value_node.LineComment, value_node.FootComment = current.HeadComment, current.LineComment, current.FootComment
+	*current = value_node
+	return nil
+}
+
+// removeNode removes the (dotted) key from the parsed config file, if it's set.
+func removeNode(mapping *yaml.Node, key string) {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		if mapping = getNode(mapping, part); mapping == nil || mapping.Kind != yaml.MappingNode {
+			return
+		}
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == parts[len(parts)-1] {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// getNode returns the value of the key in the mapping, or nil if it isn't set.
+func getNode(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// loadEnvironment reads settings from environment variables, lists (e.g. colors) can only be set in config files.
+func loadEnvironment(cfg *Config, sources Sources) error {
+	var err error
+	walkSettings(cfg, func(key string, value reflect.Value) {
+		name := GetEnvironmentName(key)
+		env_value, ok := os.LookupEnv(name)
+		if !ok || err != nil || key == "schemaVersion" {
+			return
+		}
+		switch value.Kind() {
+		case reflect.String:
+			value.SetString(env_value)
+		case reflect.Int:
+			n, parse_err := strconv.Atoi(env_value)
+			if parse_err != nil {
+				err = fmt.Errorf("%s must be a number, not '%s'", name, env_value)
+				return
+			}
+			value.SetInt(int64(n))
+		case reflect.Bool:
+			b, parse_err := strconv.ParseBool(env_value)
+			if parse_err != nil {
+				err = fmt.Errorf("%s must be true or false, not '%s'", name, env_value)
+				return
+			}
+			value.SetBool(b)
+		default:
+			return
+		}
+		sources[key] = "environment " + name
+	})
+	return err
+}
+
+// GetEnvironmentName returns the name of the environment variable for the setting, e.g. DSUL_SERIAL_PORT.
+func GetEnvironmentName(key string) string {
+	return "DSUL_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// walkSettings calls the function for each setting (that isn't a section), with its key and (settable) value.
+// Keys are the same as in config files, e.g. "serial.port".
+func walkSettings(cfg *Config, fn func(key string, value reflect.Value)) {
+	var walk func(prefix string, value reflect.Value)
+	walk = func(prefix string, value reflect.Value) {
+		for i := 0; i < value.NumField(); i++ {
+			key := prefix + getKeyName(value.Type().Field(i))
+			if value.Field(i).Kind() == reflect.Struct {
+				walk(key+".", value.Field(i))
+			} else {
+				fn(key, value.Field(i))
+			}
+		}
+	}
+	walk("", reflect.ValueOf(cfg).Elem())
+}
+
+// getKeyName returns the name of the setting in config files, the yaml tag or the lowercase field name.
+func getKeyName(field reflect.StructField) string {
+	if name := field.Tag.Get("yaml"); name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+// getValues returns the values of all settings as strings, by key.
+func getValues(cfg *Config) map[string]string {
+	values := map[string]string{}
+	walkSettings(cfg, func(key string, value reflect.Value) {
+		if value.Kind() != reflect.Slice {
+			values[key] = fmt.Sprint(value.Interface())
+			return
+		}
+		items := []string{}
+		for i := 0; i < value.Len(); i++ {
+			if value.Index(i).Kind() != reflect.Struct {
+				items = append(items, fmt.Sprint(value.Index(i).Interface()))
+				continue
+			}
+			fields := []string{}
+			for j := 0; j < value.Index(i).NumField(); j++ {
+				fields = append(fields, fmt.Sprint(value.Index(i).Field(j).Interface()))
+			}
+			items = append(items, strings.Join(fields, " "))
+		}
+		values[key] = strings.Join(items, ", ")
+	})
+	return values
+}
+
+// hasKey returns true if the (dotted) key is set in the parsed config file.
+func hasKey(found map[string]interface{}, key string) bool {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		section, ok := found[part].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		found = section
+	}
+	_, ok := found[parts[len(parts)-1]]
+	return ok
+}
+
+// buildPath returns the path to the given file path, in the user's config directory.
+// The path is dependant on the OS.
+func buildPath(path string) string {
+	if runtime.GOOS == "windows" {
+		return fmt.Sprintf("%s\\%s\\%s", os.Getenv("APPDATA"),
+			applicationName,
+			path)
+	}
+
+	var unixConfigDir string
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		unixConfigDir = xdg
+	} else {
+		unixConfigDir = os.Getenv("HOME") + "/.config"
+	}
+
+	return fmt.Sprintf("%s/%s/%s", unixConfigDir,
+		applicationName,
+		path)
+}
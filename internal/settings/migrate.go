@@ -0,0 +1,56 @@
+// DSUL - Disturb State USB Light : Settings module, migrations
+package settings
+
+import (
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// migrations migrate a config file from one schema version to the next, migrations[0] migrates version 0 to 1.
+// When the config file format changes, SchemaVersion is raised and a migration is added for the old format.
+var migrations = []func(mapping *yaml.Node) error{
+	// Config files from before schemaVersion was added are version 0, they have the same format as version 1
+	func(mapping *yaml.Node) error { return nil },
+}
+
+// migrate migrates the parsed config file to the current schema version.
+// Config files from a newer version of DSUL can't be read, as settings might have moved or changed meaning.
+func migrate(root *yaml.Node, path string) error {
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil // empty, or not settings at all (reported when decoding)
+	}
+	mapping := root.Content[0]
+
+	version := 0
+	var version_node *yaml.Node
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == "schemaVersion" {
+			version_node = mapping.Content[i+1]
+		}
+	}
+	if version_node != nil {
+		problem := Problem{Location: fmt.Sprintf("%s:%d", path, version_node.Line), Key: "schemaVersion"}
+		n, err := strconv.Atoi(version_node.Value)
+		if err != nil || n < 0 {
+			problem.Message = fmt.Sprintf("schema version must be a number, not '%s'", version_node.Value)
+			return Problems{problem}
+		}
+		if n > SchemaVersion {
+			problem.Message = fmt.Sprintf("schema version %d is newer than supported (%d), update DSUL to use this config file", n, SchemaVersion)
+			return Problems{problem}
+		}
+		version = n
+	}
+
+	for ; version < SchemaVersion; version++ {
+		if err := migrations[version](mapping); err != nil {
+			return fmt.Errorf("%s: failed to migrate from schema version %d: %v", path, version, err)
+		}
+	}
+	if version_node != nil {
+		version_node.Value = strconv.Itoa(SchemaVersion)
+	}
+	return nil
+}
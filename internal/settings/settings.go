@@ -3,20 +3,22 @@ package settings
 
 import (
 	"fmt"
-	"log"
-	"os"
 	"regexp"
-	"runtime"
 	"strconv"
-
-	"github.com/tucnak/store"
+	"strings"
+	"sync"
 )
 
 var (
 	applicationName = "dsul"
 	configName      = "dsul.yml"
+	configPath      = ""         // config file given as argument, used instead of the user's config file
+	shared_lock     sync.RWMutex // held while the daemon's (shared) configuration is replaced or copied
 )
 
+// SchemaVersion is the version of the config file format, config files with an older version are migrated when read.
+const SchemaVersion = 1
+
 type Color struct {
 	Name  string
 	Value string
@@ -25,62 +27,368 @@ type Mode struct {
 	Name  string
 	Value int
 }
+type State struct {
+	Name  string
+	Color string
+	Mode  string
+}
 type Serial struct {
 	Port     string
 	Baudrate int
 }
 type Network struct {
-	Listen bool
-	Server string
-	Port   int
+	Listen      bool
+	Address     string // address to listen on in network mode, all interfaces if not set
+	Server      string
+	Port        int
+	HttpListen  bool
+	HttpAddress string
+	HttpPort    int
+	HttpOrigins []string // web page origins (e.g. https://dashboard.example.com) allowed to use the WebSocket event stream
+	Timeout     string
+}
+type Access struct {
+	Allow       []string // IPs or CIDRs allowed to connect, all if not set
+	Deny        []string // IPs or CIDRs never allowed to connect
+	MaxFailures int      // failed authentications before a peer is banned, 0 disables bans
+	BanTime     string
+}
+type Socket struct {
+	Path  string // unix socket for local clients, used instead of /tmp/dsul.sock, not used if empty
+	Owner string // user or uid owning the socket, the daemon's user if empty
+	Group string // group or gid of the socket, the daemon's group if empty
+	Mode  string // permissions of the socket, in octal
+	Role  string // role of users not in roles, or "none" to reject them
+	Roles []SocketRole
+}
+type SocketRole struct {
+	User  string // user or uid
+	Group string // group or gid, for all its members
+	Role  string
+}
+type Audit struct {
+	Enabled  bool
+	Path     string // audit log, audit.log next to the config file if not set
+	MaxSize  int    // size (in MB) the log is rotated at, 0 disables rotation
+	MaxFiles int    // rotated logs to keep
+}
+type History struct {
+	Enabled bool
+	Path    string // history.json next to the config file if not set
+	Size    int    // states to keep
+}
+type Tls struct {
+	Enabled  bool
+	Cert     string
+	Key      string
+	CA       string
+	ClientCA string
+	Pin      string
+}
+type Token struct {
+	Name       string
+	ID         string
+	Hash       string // the token itself isn't stored, see tokens.New
+	Role       string
+	Operations []string // if set, only these operations are allowed (and only if the role allows them)
+	Created    string
+}
+type Focus struct {
+	Duration       string
+	Break          string
+	LongBreak      string
+	Cycles         int
+	FocusColor     string
+	BreakColor     string
+	LongBreakColor string
+	Flash          bool
 }
 type Config struct {
+	SchemaVersion int `yaml:"schemaVersion"`
 	Colors        []Color
 	Modes         []Mode
+	States        []State
 	BrightnessMin int
 	BrightnessMax int
 	Serial        Serial
 	Password      string
+	PasswordFile  string
+	Token         string // used by clients to authenticate, instead of the password
+	Client        string // sent by clients to identify themselves in the daemon's audit log, user@host if not set
+	Tokens        []Token
 	Network       Network
+	Access        Access
+	Socket        Socket
+	Audit         Audit
+	History       History
+	Tls           Tls
+	Focus         Focus
 }
 
 type Hardware struct {
-	Version            string
-	Leds               int
-	Brightness_min     int
-	Brightness_max     int
-	Current_color      string
-	Current_brightness int
-	Current_mode       int
-	Current_dim        int
-}
-
-// GetSettings returns the settings from the config file or defaults.
-func GetSettings() *Config {
-	cfg := getDefaults()
-
-	store.Init(applicationName)
-	guaranteeConfigFile()
-	if err := store.Load(configName, &cfg); err != nil {
-		log.Fatalln("Failed to load the DSUL configuration: ", err)
+	Version            string `json:"version" yaml:"version"`
+	Leds               int    `json:"leds" yaml:"leds"`
+	Brightness_min     int    `json:"brightness_min" yaml:"brightness_min"`
+	Brightness_max     int    `json:"brightness_max" yaml:"brightness_max"`
+	Current_color      string `json:"color" yaml:"color"`
+	Current_brightness int    `json:"brightness" yaml:"brightness"`
+	Current_mode       int    `json:"mode" yaml:"mode"`
+	Current_dim        int    `json:"dim" yaml:"dim"`
+}
+
+// Roles are the roles a token can have, with the operations they allow.
+var Roles = map[string][]string{
+	"read":    {"get", "subscribe"},
+	"control": {"get", "subscribe", "set", "focus", "notify"},
+	"admin":   {"get", "subscribe", "set", "focus", "notify", "config", "token", "log"},
+}
+
+// Change changes colors, states, brightness limits or tokens of a configuration.
+// It returns an error, and leaves the configuration unchanged, if the change isn't valid.
+type Change func(cfg *Config) error
+
+// ApplyChange applies the change to the configuration, if it's valid.
+func ApplyChange(cfg *Config, change Change) error {
+	changed := *cfg
+	if err := change(&changed); err != nil {
+		return err
+	}
+	*cfg = changed
+	return nil
+}
+
+// Update calls update with a copy of the shared configuration, and replaces the configuration with the copy unless an error is returned.
+// Changes (e.g. a reload and a configuration change from a client) are applied one at a time, and never seen half-copied by Snapshot.
+func Update(cfg *Config, update func(changed *Config) error) error {
+	shared_lock.Lock()
+	defer shared_lock.Unlock()
+
+	changed := *cfg
+	if err := update(&changed); err != nil {
+		return err
+	}
+	*cfg = changed
+	return nil
+}
+
+// Snapshot returns a copy of the shared configuration. Modules use a snapshot while handling a command, as the configuration
+// may be replaced (see Update) at any time. Lists in it are never changed in place, changes replace them.
+func Snapshot(cfg *Config) *Config {
+	shared_lock.RLock()
+	defer shared_lock.RUnlock()
+
+	snapshot := *cfg
+	return &snapshot
+}
+
+// AddColor returns a change adding a color, value is given as red:green:blue.
+func AddColor(name string, value string) Change {
+	return func(cfg *Config) error {
+		if err := validateName(name); err != nil {
+			return err
+		}
+		if getColorIndex(name, cfg) >= 0 {
+			return fmt.Errorf("color '%s' already exists", name)
+		}
+		if !isColorValue(value) {
+			return fmt.Errorf("color value must be given as red:green:blue (0-255), not '%s'", value)
+		}
+		cfg.Colors = append(append([]Color{}, cfg.Colors...), Color{name, value})
+		return nil
+	}
+}
+
+// RemoveColor returns a change removing a color. Colors used by states or the focus timer can't be removed.
+func RemoveColor(name string) Change {
+	return func(cfg *Config) error {
+		index := getColorIndex(name, cfg)
+		if index < 0 {
+			return fmt.Errorf("color '%s' doesn't exist", name)
+		}
+		for _, cfg_state := range cfg.States {
+			if cfg_state.Color == name {
+				return fmt.Errorf("color '%s' is used by state '%s'", name, cfg_state.Name)
+			}
+		}
+		for _, focus_color := range []string{cfg.Focus.FocusColor, cfg.Focus.BreakColor, cfg.Focus.LongBreakColor} {
+			if focus_color == name {
+				return fmt.Errorf("color '%s' is used by the focus timer", name)
+			}
+		}
+		cfg.Colors = append(append([]Color{}, cfg.Colors[:index]...), cfg.Colors[index+1:]...)
+		return nil
+	}
+}
+
+// RenameColor returns a change renaming a color, states and focus timer colors using it are updated.
+func RenameColor(name string, new_name string) Change {
+	return func(cfg *Config) error {
+		index := getColorIndex(name, cfg)
+		if index < 0 {
+			return fmt.Errorf("color '%s' doesn't exist", name)
+		}
+		if err := validateName(new_name); err != nil {
+			return err
+		}
+		if getColorIndex(new_name, cfg) >= 0 {
+			return fmt.Errorf("color '%s' already exists", new_name)
+		}
+		cfg.Colors = append([]Color{}, cfg.Colors...)
+		cfg.Colors[index].Name = new_name
+		cfg.States = append([]State{}, cfg.States...)
+		for i := range cfg.States {
+			if cfg.States[i].Color == name {
+				cfg.States[i].Color = new_name
+			}
+		}
+		for _, focus_color := range []*string{&cfg.Focus.FocusColor, &cfg.Focus.BreakColor, &cfg.Focus.LongBreakColor} {
+			if *focus_color == name {
+				*focus_color = new_name
+			}
+		}
+		return nil
+	}
+}
+
+// SetState returns a change adding a state, or updating it if it already exists.
+func SetState(name string, color string, mode string) Change {
+	return func(cfg *Config) error {
+		if err := validateName(name); err != nil {
+			return err
+		}
+		if getColorIndex(color, cfg) < 0 {
+			return fmt.Errorf("color '%s' doesn't exist", color)
+		}
+		mode_found := false
+		for _, cfg_mode := range cfg.Modes {
+			mode_found = mode_found || cfg_mode.Name == mode
+		}
+		if !mode_found {
+			return fmt.Errorf("mode '%s' doesn't exist", mode)
+		}
+		cfg.States = append([]State{}, cfg.States...)
+		for i := range cfg.States {
+			if cfg.States[i].Name == name {
+				cfg.States[i] = State{name, color, mode}
+				return nil
+			}
+		}
+		cfg.States = append(cfg.States, State{name, color, mode})
 		return nil
 	}
+}
+
+// RemoveState returns a change removing a state.
+func RemoveState(name string) Change {
+	return func(cfg *Config) error {
+		for i, cfg_state := range cfg.States {
+			if cfg_state.Name == name {
+				cfg.States = append(append([]State{}, cfg.States[:i]...), cfg.States[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("state '%s' doesn't exist", name)
+	}
+}
 
-	return &cfg
+// SetBrightnessLimits returns a change setting the brightness limits (0-255).
+func SetBrightnessLimits(min int, max int) Change {
+	return func(cfg *Config) error {
+		if min < 0 || max > 255 || min > max {
+			return fmt.Errorf("brightness limits must be between 0 and 255, with min not above max (got %d-%d)", min, max)
+		}
+		cfg.BrightnessMin = min
+		cfg.BrightnessMax = max
+		return nil
+	}
 }
 
-// SaveSettings saves the settings to the config file.
-func SaveSettings(cfg *Config) {
-	store.Init(applicationName)
-	guaranteeConfigFile()
-	if err := store.Save(configName, &cfg); err != nil {
-		log.Fatalln("Failed to save the DSUL configuration: ", err)
+// AddToken returns a change adding a token.
+func AddToken(token Token) Change {
+	return func(cfg *Config) error {
+		if err := validateName(token.Name); err != nil {
+			return err
+		}
+		for _, cfg_token := range cfg.Tokens {
+			if cfg_token.Name == token.Name {
+				return fmt.Errorf("token '%s' already exists", token.Name)
+			}
+		}
+		if err := validateRole(token.Role, token.Operations); err != nil {
+			return err
+		}
+		cfg.Tokens = append(append([]Token{}, cfg.Tokens...), token)
+		return nil
 	}
 }
 
+// RemoveToken returns a change removing (revoking) a token.
+func RemoveToken(name string) Change {
+	return func(cfg *Config) error {
+		for i, cfg_token := range cfg.Tokens {
+			if cfg_token.Name == name {
+				cfg.Tokens = append(append([]Token{}, cfg.Tokens[:i]...), cfg.Tokens[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("token '%s' doesn't exist", name)
+	}
+}
+
+// getColorIndex returns the index of the configured color with the given name, or -1 if there is none.
+func getColorIndex(name string, cfg *Config) int {
+	for i, cfg_color := range cfg.Colors {
+		if cfg_color.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// validateName returns an error if the name can't be used for a color or state.
+func validateName(name string) error {
+	if name == "" || strings.ContainsAny(name, ": \t") {
+		return fmt.Errorf("name must be given without spaces or ':', not '%s'", name)
+	}
+	return nil
+}
+
+// validateRole returns an error if the role doesn't exist, or doesn't allow all the given operations.
+func validateRole(role string, operations []string) error {
+	allowed, ok := Roles[role]
+	if !ok {
+		return fmt.Errorf("role must be one of read, control or admin, not '%s'", role)
+	}
+	for _, operation := range operations {
+		found := false
+		for _, allowed_operation := range allowed {
+			found = found || allowed_operation == operation
+		}
+		if !found {
+			return fmt.Errorf("operation '%s' isn't allowed by role '%s' (allowed: %s)", operation, role, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// isColorValue returns true if the value is a valid red:green:blue value.
+func isColorValue(value string) bool {
+	rgb := strings.Split(value, ":")
+	if len(rgb) != 3 {
+		return false
+	}
+	for _, part := range rgb {
+		if n, err := strconv.Atoi(part); err != nil || n < 0 || n > 255 {
+			return false
+		}
+	}
+	return true
+}
+
 // getDefaults returns the default settings as a Config struct.
 func getDefaults() Config {
 	config := Config{
+		SchemaVersion: SchemaVersion,
 		Colors: []Color{
 			Color{"black", "0:0:0"},
 			Color{"white", "255:255:200"},
@@ -100,55 +408,97 @@ func getDefaults() Config {
 			Mode{"flash", 3},
 			Mode{"pulse", 4},
 		},
+		States: []State{
+			State{"available", "green", "solid"},
+			State{"busy", "red", "solid"},
+			State{"away", "yellow", "solid"},
+			State{"off", "black", "solid"},
+		},
 		BrightnessMin: 0,
 		BrightnessMax: 150,
 		Serial:        Serial{"/dev/ttyUSB0", 38400},
 		Network: Network{
-			Listen: false,
-			Server: "",
-			Port:   9292,
+			Listen:      false,
+			Address:     "",
+			Server:      "",
+			Port:        9292,
+			HttpListen:  false,
+			HttpAddress: "127.0.0.1",
+			HttpPort:    9293,
+			Timeout:     "5s",
+		},
+		Access: Access{
+			MaxFailures: 5,
+			BanTime:     "15m",
+		},
+		Socket: Socket{
+			Mode: "0660",
+			Role: "read",
+		},
+		Audit: Audit{
+			Enabled:  true,
+			MaxSize:  10,
+			MaxFiles: 5,
+		},
+		History: History{
+			Enabled: true,
+			Size:    50,
 		},
 		Password: "",
+		Focus: Focus{
+			Duration:       "25m",
+			Break:          "5m",
+			LongBreak:      "15m",
+			Cycles:         4,
+			FocusColor:     "red",
+			BreakColor:     "green",
+			LongBreakColor: "blue",
+			Flash:          true,
+		},
 	}
 	return config
 }
 
-// guaranteeConfigFile ensures that the config file exists.
-func guaranteeConfigFile() {
-	// Make sure directories exists
-
-	err1 := os.MkdirAll(buildPath(""), os.ModePerm)
-	if err1 != nil {
-		log.Fatal(err1)
+// GetState returns the configured state with the given name.
+func GetState(name string, cfg *Config) (State, bool) {
+	for _, cfg_state := range cfg.States {
+		if cfg_state.Name == name {
+			return cfg_state, true
+		}
 	}
+	return State{}, false
+}
 
-	// Make sure config file exists
-
-	_, err2 := os.OpenFile(buildPath("dsul.yml"), os.O_RDONLY|os.O_CREATE, 0644)
-	if err2 != nil {
-		log.Fatal(err2)
+// GetMode returns the configured mode with the given value.
+func GetMode(value int, cfg *Config) (Mode, bool) {
+	for _, cfg_mode := range cfg.Modes {
+		if cfg_mode.Value == value {
+			return cfg_mode, true
+		}
 	}
+	return Mode{}, false
 }
 
-// buildPath returns the path to the given file path.
-// The path is dependant on the OS.
-func buildPath(path string) string {
-	if runtime.GOOS == "windows" {
-		return fmt.Sprintf("%s\\%s\\%s", os.Getenv("APPDATA"),
-			applicationName,
-			path)
+// GetModeName returns the name of the configured mode with the given value, or the value if no mode has it.
+func GetModeName(value int, cfg *Config) string {
+	if cfg_mode, ok := GetMode(value, cfg); ok {
+		return cfg_mode.Name
 	}
+	return strconv.Itoa(value)
+}
 
-	var unixConfigDir string
-	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
-		unixConfigDir = xdg
-	} else {
-		unixConfigDir = os.Getenv("HOME") + "/.config"
+// GetBrightnessLimits returns the brightness limits allowed by both the configuration and the device, if it has reported its limits.
+func GetBrightnessLimits(cfg *Config, hardware Hardware) (int, int) {
+	brightness_min, brightness_max := cfg.BrightnessMin, cfg.BrightnessMax
+	if hardware.Brightness_max > 0 {
+		if hardware.Brightness_min > brightness_min {
+			brightness_min = hardware.Brightness_min
+		}
+		if hardware.Brightness_max < brightness_max {
+			brightness_max = hardware.Brightness_max
+		}
 	}
-
-	return fmt.Sprintf("%s/%s/%s", unixConfigDir,
-		applicationName,
-		path)
+	return brightness_min, brightness_max
 }
 
 // ParseHardwareInformation returns a Hardware struct containing the current hardware information.
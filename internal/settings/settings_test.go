@@ -1,7 +1,16 @@
 // DSUL - Disturb State USB Light : Settings module tests.
 package settings
 
-import "testing"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
 
 func TestSomething(t *testing.T) {
 	cases := []struct {
@@ -17,3 +26,408 @@ func TestSomething(t *testing.T) {
 		}
 	}
 }
+
+func TestApplyChange(t *testing.T) {
+	tests := []struct {
+		name   string
+		change Change
+		want   string // error, if the change isn't valid
+	}{
+		{"add color", AddColor("pink", "255:105:180"), ""},
+		{"add existing color", AddColor("red", "255:0:0"), "color 'red' already exists"},
+		{"add color with bad value", AddColor("pink", "255:105"), "color value must be given as red:green:blue (0-255), not '255:105'"},
+		{"add color with bad name", AddColor("light pink", "255:182:193"), "name must be given without spaces or ':', not 'light pink'"},
+		{"remove color", RemoveColor("cyan"), ""},
+		{"remove color used by state", RemoveColor("green"), "color 'green' is used by state 'available'"},
+		{"remove color used by focus timer", RemoveColor("blue"), "color 'blue' is used by the focus timer"},
+		{"remove unknown color", RemoveColor("pink"), "color 'pink' doesn't exist"},
+		{"rename color", RenameColor("red", "crimson"), ""},
+		{"rename to existing color", RenameColor("red", "green"), "color 'green' already exists"},
+		{"set state", SetState("meeting", "purple", "pulse"), ""},
+		{"set state with unknown mode", SetState("meeting", "purple", "strobe"), "mode 'strobe' doesn't exist"},
+		{"remove state", RemoveState("away"), ""},
+		{"remove unknown state", RemoveState("meeting"), "state 'meeting' doesn't exist"},
+		{"set brightness limits", SetBrightnessLimits(10, 100), ""},
+		{"set bad brightness limits", SetBrightnessLimits(100, 10), "brightness limits must be between 0 and 255, with min not above max (got 100-10)"},
+		{"add token", AddToken(Token{Name: "calendar", ID: "0a1b2c3d", Role: "control", Operations: []string{"set"}}), ""},
+		{"add token with unknown role", AddToken(Token{Name: "calendar", ID: "0a1b2c3d", Role: "owner"}), "role must be one of read, control or admin, not 'owner'"},
+		{"add token with operation outside role", AddToken(Token{Name: "dashboard", ID: "0a1b2c3d", Role: "read", Operations: []string{"set"}}), "operation 'set' isn't allowed by role 'read' (allowed: get, subscribe)"},
+		{"remove unknown token", RemoveToken("calendar"), "token 'calendar' doesn't exist"},
+	}
+
+	for _, test := range tests {
+		cfg := getDefaults()
+		defaults := getDefaults()
+		err := ApplyChange(&cfg, test.change)
+		out_value := ""
+		if err != nil {
+			out_value = err.Error()
+		}
+		if out_value != test.want {
+			t.Errorf("Wrong(%s) == %q, want %q", test.name, out_value, test.want)
+		}
+		if err != nil && fmt.Sprint(cfg) != fmt.Sprint(defaults) {
+			t.Errorf("Wrong(%s) changed the configuration, want it unchanged", test.name)
+		}
+	}
+
+	original := getDefaults()
+	cfg := original
+	if err := ApplyChange(&cfg, RenameColor("red", "crimson")); err != nil {
+		t.Fatal(err)
+	}
+	if cfg_state, _ := GetState("busy", &cfg); cfg_state.Color != "crimson" || cfg.Focus.FocusColor != "crimson" {
+		t.Errorf("Wrong(rename color) == %v, %s, want state and focus color renamed", cfg_state, cfg.Focus.FocusColor)
+	}
+	if original.Colors[3].Name != "red" || original.States[1].Color != "red" {
+		t.Errorf("Wrong(rename color) changed the copied configuration")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	cfg := getDefaults()
+	snapshot := Snapshot(&cfg)
+	err := Update(&cfg, func(changed *Config) error {
+		return ApplyChange(changed, AddColor("pink", "255:105:180"))
+	})
+	if err != nil || cfg.Colors[len(cfg.Colors)-1].Name != "pink" {
+		t.Errorf("Wrong(update) == %v, want pink added", err)
+	}
+	if len(snapshot.Colors) != len(cfg.Colors)-1 {
+		t.Errorf("Wrong(snapshot) == %d colors, want it unchanged", len(snapshot.Colors))
+	}
+	err = Update(&cfg, func(changed *Config) error {
+		changed.Password = "secret"
+		return fmt.Errorf("rejected")
+	})
+	if err == nil || cfg.Password != "" {
+		t.Errorf("Wrong(rejected update) == %v, %q, want the configuration unchanged", err, cfg.Password)
+	}
+}
+
+func TestGetModeName(t *testing.T) {
+	cfg := Config{Modes: []Mode{{Name: "solid", Value: 1}, {Name: "blink", Value: 2}}}
+	cases := []struct {
+		in   int
+		want string
+	}{
+		{1, "solid"},
+		{2, "blink"},
+		{5, "5"},
+	}
+	for _, c := range cases {
+		got := GetModeName(c.in, &cfg)
+		if got != c.want {
+			t.Errorf("Wrong(%d) == %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   string
+	}{
+		{"defaults", func(cfg *Config) {}, ""},
+		{"duplicate color", func(cfg *Config) { cfg.Colors = append(cfg.Colors, Color{"red", "200:0:0"}) }, "colors[11].name: color 'red' is configured more than once, first as colors[3]"},
+		{"bad color value", func(cfg *Config) { cfg.Colors[0].Value = "255:0" }, "colors[0].value: color 'black' must be given as red:green:blue (0-255), not '255:0'"},
+		{"bad mode value", func(cfg *Config) { cfg.Modes[0].Value = 9 }, "modes[0].value: mode 'solid' must have a value between 1 and 4, not 9"},
+		{"duplicate mode value", func(cfg *Config) { cfg.Modes[1].Value = 1 }, "modes[1].value: mode 'blink' has the same value (1) as mode 'solid'"},
+		{"state with unknown color", func(cfg *Config) { cfg.States[0].Color = "lime" }, "states[0].color: state 'available' uses color 'lime', which isn't configured"},
+		{"bad brightness limits", func(cfg *Config) { cfg.BrightnessMax = 300 }, "brightnessmax: brightness must be between 0 and 255, not 300"},
+		{"bad baudrate", func(cfg *Config) { cfg.Serial.Baudrate = 300 }, "serial.baudrate: serial baudrate must be between 9600 and 115200, not 300"},
+		{"http api without password", func(cfg *Config) { cfg.Network.HttpListen = true; cfg.Network.HttpAddress = "0.0.0.0" }, "network.httpaddress: a password or tokens must be set to serve the HTTP API on '0.0.0.0', it's reachable from other hosts"},
+		{"bad origin", func(cfg *Config) { cfg.Network.HttpOrigins = []string{"dashboard.example.com"} }, "network.httporigins[0]: origin must be given as scheme://host[:port] (e.g. https://dashboard.example.com), not 'dashboard.example.com'"},
+		{"bad timeout", func(cfg *Config) { cfg.Network.Timeout = "5" }, "network.timeout: duration must be given like 30s, 5m or 1h, not '5'"},
+		{"tls key without cert", func(cfg *Config) { cfg.Tls.Key = "server-key.pem" }, "tls.key: tls.cert and tls.key must be set together"},
+		{"tls without cert", func(cfg *Config) { cfg.Tls.Enabled = true; cfg.Network.Listen = true }, "tls.enabled: tls.cert and tls.key must be set to use TLS in network mode (see dsuld tls init)"},
+		{"bad token hash", func(cfg *Config) {
+			cfg.Tokens = []Token{{Name: "calendar", ID: "0a1b2c3d", Hash: "secret", Role: "control"}}
+		}, "tokens[0].hash: token 'calendar' must have a hash given as sha256:<64 hex digits> (see dsulc token create)"},
+		{"bad tls pin", func(cfg *Config) { cfg.Tls.Pin = "sha1:abc" }, "tls.pin: pin must be given as sha256:<64 hex digits> (see dsuld tls init), not 'sha1:abc'"},
+		{"bad address", func(cfg *Config) { cfg.Network.Address = "office" }, "network.address: address must be an IP address (of an interface to listen on), not 'office'"},
+		{"bad access entry", func(cfg *Config) { cfg.Access.Allow = []string{"192.168.1.0/24", "192.168.1.0/33"} }, "access.allow[1]: entry must be an IP or CIDR (e.g. 192.168.1.0/24), not '192.168.1.0/33'"},
+		{"relative socket path", func(cfg *Config) { cfg.Socket.Path = "dsul.sock" }, "socket.path: socket path must be absolute, not 'dsul.sock'"},
+		{"bad socket mode", func(cfg *Config) { cfg.Socket.Mode = "rw-rw----" }, "socket.mode: mode must be given in octal (e.g. 0660), not 'rw-rw----'"},
+		{"socket role with user and group", func(cfg *Config) {
+			cfg.Socket.Roles = []SocketRole{{Group: "dsul", Role: "control"}, {User: "alice", Group: "dsul", Role: "admin"}}
+		}, "socket.roles[1]: either user or group must be set"},
+		{"bad socket role", func(cfg *Config) { cfg.Socket.Role = "write" }, "socket.role: role must be one of none, read, control or admin, not 'write'"},
+		{"bad audit max size", func(cfg *Config) { cfg.Audit.MaxSize = -1 }, "audit.maxsize: max size must be at least 0 (0 disables rotation), not -1"},
+		{"bad history size", func(cfg *Config) { cfg.History.Size = 0 }, "history.size: size must be at least 1, not 0"},
+		{"bad ban time", func(cfg *Config) { cfg.Access.BanTime = "" }, "access.bantime: duration must be given like 30s, 5m or 1h, not ''"},
+		{"all problems", func(cfg *Config) { cfg.BrightnessMin = 200; cfg.Serial.Port = "" }, "brightnessmin: brightness min (200) must not be above max (150); serial.port: serial port must be set"},
+	}
+
+	for _, test := range tests {
+		cfg := getDefaults()
+		test.change(&cfg)
+		out_value := ""
+		if err := Validate(&cfg); err != nil {
+			out_value = err.Error()
+		}
+		if out_value != test.want {
+			t.Errorf("Wrong(%s) == %q, want %q", test.name, out_value, test.want)
+		}
+	}
+}
+
+func TestValidateLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dsul.yml")
+	SetConfigPath(path)
+	defer SetConfigPath("")
+	t.Setenv("DSUL_SERIAL_BAUDRATE", "300")
+
+	tests := []struct {
+		in_value string // config file
+		want     string // first problem
+	}{
+		{"schemaVersion: 1\nbrightnessmax: 100\n", "environment DSUL_SERIAL_BAUDRATE: serial.baudrate: serial baudrate must be between 9600 and 115200, not 300"},
+		{"colors:\n  - name: red\n    value: \"255:0\"\n", path + ":3: colors[0].value: color 'red' must be given as red:green:blue (0-255), not '255:0'"},
+		{"serial:\n  prot: /dev/dsul\n", path + ":2: serial.prot: unknown setting 'prot', did you mean 'port'?"},
+		{"brightnessmax: high\n", path + ":1: cannot unmarshal !!str `high` into int"},
+		{"serial:\n  port /dev/dsul\n  baudrate: 9600\n", path + ":3: mapping values are not allowed in this context"},
+		{"schemaVersion: 2\n", path + ":1: schemaVersion: schema version 2 is newer than supported (1), update DSUL to use this config file"},
+	}
+
+	for _, test := range tests {
+		if err := os.WriteFile(path, []byte(test.in_value), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, sources, err := LoadLayers()
+		problems := GetProblems(err)
+		if err == nil {
+			problems = ValidateLayers(&cfg, sources)
+		}
+		if out_value := problems[0].String(); out_value != test.want {
+			t.Errorf("Wrong(%q) == %q, want %q", test.in_value, out_value, test.want)
+		}
+	}
+}
+
+func TestLoadLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dsul.yml")
+	if err := os.WriteFile(path, []byte("serial:\n  port: /dev/dsul\nnetwork:\n  port: 9000\naccess:\n  allow: [192.168.1.0/24, 10.0.0.1]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetConfigPath(path)
+	defer SetConfigPath("")
+	t.Setenv("DSUL_NETWORK_PORT", "9100")
+	t.Setenv("DSUL_NETWORK_LISTEN", "true")
+
+	cfg, sources, err := LoadLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyArguments(&cfg, sources, func(cfg *Config) error { cfg.Password = "secret"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in_value string
+		want     string
+	}{
+		{"schemaVersion", "1 default"},
+		{"serial.port", "/dev/dsul " + path},
+		{"serial.baudrate", "38400 default"},
+		{"network.port", "9100 environment DSUL_NETWORK_PORT"},
+		{"network.listen", "true environment DSUL_NETWORK_LISTEN"},
+		{"password", "(hidden) arguments"},
+		{"access.allow", "192.168.1.0/24, 10.0.0.1 " + path},
+	}
+
+	dump := map[string]Setting{}
+	for _, setting := range Dump(&cfg, sources) {
+		dump[setting.Key] = setting
+	}
+	for _, test := range tests {
+		if out_value := dump[test.in_value].Value + " " + dump[test.in_value].Source; out_value != test.want {
+			t.Errorf("Wrong(%s) == %q, want %q", test.in_value, out_value, test.want)
+		}
+	}
+
+	SetConfigPath(filepath.Join(t.TempDir(), "missing.yml"))
+	if _, _, err := LoadLayers(); err == nil {
+		t.Errorf("Wrong(missing.yml) loaded without error, want config file given as argument to be required")
+	}
+}
+
+func TestSaveSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dsul", "dsul.yml")
+	SetConfigPath(path)
+	defer SetConfigPath("")
+	t.Setenv("DSUL_PASSWORD", "secret")
+
+	if err := SaveSettings(SetBrightnessLimits(10, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveSettings(AddColor("pink", "255:105:180")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &found); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if out_value := strings.Join(keys, " "); out_value != "brightnessmax brightnessmin colors schemaVersion" {
+		t.Errorf("Wrong() == %q, want only changed settings to be saved", out_value)
+	}
+}
+
+func TestSaveSettingsKeepsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dsul.yml")
+	SetConfigPath(path)
+	defer SetConfigPath("")
+	original := "# my light\nserial:\n  port: /dev/ttyUSB1 # the usb hub\nbrightnessmax: 120\n"
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SaveSettings(SetBrightnessLimits(10, 100)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# my light\nserial:\n  port: /dev/ttyUSB1 # the usb hub\nbrightnessmax: 100\nschemaVersion: 1\nbrightnessmin: 10\n"
+	if string(data) != want {
+		t.Errorf("Wrong(saved) == %q, want %q", data, want)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Wrong(mode) == %v (%v), want %v", info.Mode().Perm(), err, os.FileMode(0600))
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Wrong(files) == %d, want only the config file", len(entries))
+	}
+}
+
+func TestPasswordSources(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dsul.yml")
+	SetConfigPath(path)
+	defer SetConfigPath("")
+	password_file := filepath.Join(dir, "password")
+	if err := os.WriteFile(password_file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	credentials := filepath.Join(dir, "credentials")
+	if err := os.MkdirAll(credentials, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(credentials, "password"), []byte("from-credential"), 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		config_file string
+		env         map[string]string
+		want        string // password and where it came from
+	}{
+		{"config file", "password: plain\n", nil, "plain " + path},
+		{"password file", "password: plain\npasswordfile: " + password_file + "\n", nil, "from-file " + path},
+		{"systemd credential", "password: plain\n", map[string]string{"CREDENTIALS_DIRECTORY": credentials}, "from-credential credential password"},
+		{"environment", "", map[string]string{"CREDENTIALS_DIRECTORY": credentials, "DSUL_PASSWORD": "from-env"}, "from-env environment DSUL_PASSWORD"},
+		{"environment password file", "", map[string]string{"DSUL_PASSWORDFILE": password_file}, "from-file environment DSUL_PASSWORDFILE"},
+	}
+
+	for _, test := range tests {
+		if err := os.WriteFile(path, []byte(test.config_file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range test.env {
+			os.Setenv(name, value)
+		}
+		cfg, sources, err := LoadLayers()
+		for name := range test.env {
+			os.Unsetenv(name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out_value := cfg.Password + " " + sources["password"]; out_value != test.want {
+			t.Errorf("Wrong(%s) == %q, want %q", test.name, out_value, test.want)
+		}
+	}
+
+	if err := os.Chmod(password_file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPasswordFile(password_file); err == nil {
+		t.Errorf("Wrong(%s) read without error, want password files readable by others to be rejected", password_file)
+	}
+}
+
+func TestGetCredential(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	if err := os.MkdirAll(filepath.Dir(CredentialsPath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := "local:\n  password: local-secret\nlamp.example.com:\n  password: lamp-secret\nlamp.example.com:9300:\n  password: port-secret\n"
+	if err := os.WriteFile(CredentialsPath(), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		server string
+		port   int
+		want   string
+	}{
+		{"", 9292, "local-secret"},
+		{"lamp.example.com", 9292, "lamp-secret"},
+		{"lamp.example.com", 9300, "port-secret"},
+		{"other.example.com", 9292, ""},
+	}
+	for _, test := range tests {
+		credential, _, err := GetCredential(test.server, test.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credential.Password != test.want {
+			t.Errorf("Wrong(%s:%d) == %q, want %q", test.server, test.port, credential.Password, test.want)
+		}
+	}
+
+	if err := os.Chmod(CredentialsPath(), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := GetCredential("", 9292); err == nil {
+		t.Errorf("Wrong(0640) read without error, want credentials file to be only accessible by the user")
+	}
+}
+
+func TestSavePassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dsul.yml")
+	SetConfigPath(path)
+	defer SetConfigPath("")
+	if err := os.WriteFile(path, []byte("password: plain\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SaveSettings(SetBrightnessLimits(10, 100)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "plain") {
+		t.Errorf("Wrong() == %q, want password not to be saved in plaintext", string(data))
+	}
+	cfg, _, err := LoadLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Password != "plain" {
+		t.Errorf("Wrong() == %q, want password to be moved to a password file", cfg.Password)
+	}
+}
@@ -0,0 +1,451 @@
+// DSUL - Disturb State USB Light : Settings module, validation
+package settings
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a problem found in the settings, with where it was found.
+type Problem struct {
+	Location string // file and line (e.g. "/etc/dsul/dsul.yml:12"), or where the setting came from
+	Key      string // e.g. "colors[1].value"
+	Message  string
+}
+
+// String returns the problem as "location: key: message".
+func (p Problem) String() string {
+	parts := []string{}
+	for _, part := range []string{p.Location, p.Key, p.Message} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ": ")
+}
+
+// Problems are all problems found in the settings, they can be returned as an error.
+type Problems []Problem
+
+// Error returns all problems, separated by semicolons.
+func (problems Problems) Error() string {
+	lines := []string{}
+	for _, problem := range problems {
+		lines = append(lines, problem.String())
+	}
+	return strings.Join(lines, "; ")
+}
+
+// GetProblems returns the problems of an error from loading or validating settings.
+func GetProblems(err error) Problems {
+	if err == nil {
+		return nil
+	}
+	if problems, ok := err.(Problems); ok {
+		return problems
+	}
+	return Problems{{Message: err.Error()}}
+}
+
+// Validate returns all problems found in the configuration as an error, or nil if it's valid.
+func Validate(cfg *Config) error {
+	if problems := Check(cfg); len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// LoadValidSettings returns the settings from all layers, with the arguments applied (if given), or the problems found in them.
+func LoadValidSettings(arguments Change) (Config, error) {
+	cfg, sources, err := LoadLayers()
+	if err == nil && arguments != nil {
+		err = ApplyArguments(&cfg, sources, arguments)
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if problems := ValidateLayers(&cfg, sources); len(problems) > 0 {
+		return cfg, problems
+	}
+	return cfg, nil
+}
+
+// ValidateLayers returns all problems found in the settings, with the file and line (or other source) they came from.
+// Settings in the config files that aren't known (e.g. misspelled) are problems too.
+func ValidateLayers(cfg *Config, sources Sources) Problems {
+	files := map[string]*yaml.Node{}
+	problems := Problems{}
+	for _, path := range ConfigPaths() {
+		if root := readNode(path); root != nil {
+			files[path] = root
+			problems = append(problems, checkKeys(root, reflect.TypeOf(Config{}), "", path)...)
+		}
+	}
+
+	for _, problem := range Check(cfg) {
+		source := sources[strings.Split(problem.Key, "[")[0]]
+		if root, ok := files[source]; ok {
+			problem.Location = fmt.Sprintf("%s:%d", source, findLine(root, problem.Key))
+		} else {
+			problem.Location = source
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// Check returns all problems found in the configuration, by key.
+func Check(cfg *Config) Problems {
+	problems := Problems{}
+	add := func(key string, format string, a ...interface{}) {
+		problems = append(problems, Problem{Key: key, Message: fmt.Sprintf(format, a...)})
+	}
+
+	color_names := map[string]int{}
+	for i, cfg_color := range cfg.Colors {
+		key := fmt.Sprintf("colors[%d]", i)
+		if err := validateName(cfg_color.Name); err != nil {
+			add(key+".name", "color %s", err)
+		} else if first, ok := color_names[cfg_color.Name]; ok {
+			add(key+".name", "color '%s' is configured more than once, first as colors[%d]", cfg_color.Name, first)
+		} else {
+			color_names[cfg_color.Name] = i
+		}
+		if !isColorValue(cfg_color.Value) {
+			add(key+".value", "color '%s' must be given as red:green:blue (0-255), not '%s'", cfg_color.Name, cfg_color.Value)
+		}
+	}
+
+	mode_names := map[string]int{}
+	mode_values := map[int]string{}
+	for i, cfg_mode := range cfg.Modes {
+		key := fmt.Sprintf("modes[%d]", i)
+		if cfg_mode.Name == "" {
+			add(key+".name", "mode must have a name")
+		} else if first, ok := mode_names[cfg_mode.Name]; ok {
+			add(key+".name", "mode '%s' is configured more than once, first as modes[%d]", cfg_mode.Name, first)
+		} else {
+			mode_names[cfg_mode.Name] = i
+		}
+		if cfg_mode.Value < 1 || cfg_mode.Value > len(cfg.Modes) {
+			add(key+".value", "mode '%s' must have a value between 1 and %d, not %d", cfg_mode.Name, len(cfg.Modes), cfg_mode.Value)
+		} else if other, ok := mode_values[cfg_mode.Value]; ok {
+			add(key+".value", "mode '%s' has the same value (%d) as mode '%s'", cfg_mode.Name, cfg_mode.Value, other)
+		} else {
+			mode_values[cfg_mode.Value] = cfg_mode.Name
+		}
+	}
+
+	state_names := map[string]int{}
+	for i, cfg_state := range cfg.States {
+		key := fmt.Sprintf("states[%d]", i)
+		if err := validateName(cfg_state.Name); err != nil {
+			add(key+".name", "state %s", err)
+		} else if first, ok := state_names[cfg_state.Name]; ok {
+			add(key+".name", "state '%s' is configured more than once, first as states[%d]", cfg_state.Name, first)
+		} else {
+			state_names[cfg_state.Name] = i
+		}
+		if _, ok := color_names[cfg_state.Color]; !ok {
+			add(key+".color", "state '%s' uses color '%s', which isn't configured", cfg_state.Name, cfg_state.Color)
+		}
+		if _, ok := mode_names[cfg_state.Mode]; !ok {
+			add(key+".mode", "state '%s' uses mode '%s', which isn't configured", cfg_state.Name, cfg_state.Mode)
+		}
+	}
+
+	token_names := map[string]int{}
+	token_ids := map[string]int{}
+	for i, cfg_token := range cfg.Tokens {
+		key := fmt.Sprintf("tokens[%d]", i)
+		if err := validateName(cfg_token.Name); err != nil {
+			add(key+".name", "token %s", err)
+		} else if first, ok := token_names[cfg_token.Name]; ok {
+			add(key+".name", "token '%s' is configured more than once, first as tokens[%d]", cfg_token.Name, first)
+		} else {
+			token_names[cfg_token.Name] = i
+		}
+		if cfg_token.ID == "" {
+			add(key+".id", "token '%s' must have an ID", cfg_token.Name)
+		} else if first, ok := token_ids[cfg_token.ID]; ok {
+			add(key+".id", "token '%s' has the same ID as tokens[%d]", cfg_token.Name, first)
+		} else {
+			token_ids[cfg_token.ID] = i
+		}
+		if !regexp.MustCompile(`^sha256:[0-9a-f]{64}$`).MatchString(cfg_token.Hash) {
+			add(key+".hash", "token '%s' must have a hash given as sha256:<64 hex digits> (see dsulc token create)", cfg_token.Name)
+		}
+		if err := validateRole(cfg_token.Role, cfg_token.Operations); err != nil {
+			add(key+".role", "token '%s' %s", cfg_token.Name, err)
+		}
+	}
+
+	if cfg.BrightnessMin < 0 || cfg.BrightnessMin > 255 {
+		add("brightnessmin", "brightness must be between 0 and 255, not %d", cfg.BrightnessMin)
+	}
+	if cfg.BrightnessMax < 0 || cfg.BrightnessMax > 255 {
+		add("brightnessmax", "brightness must be between 0 and 255, not %d", cfg.BrightnessMax)
+	}
+	if cfg.BrightnessMin > cfg.BrightnessMax {
+		add("brightnessmin", "brightness min (%d) must not be above max (%d)", cfg.BrightnessMin, cfg.BrightnessMax)
+	}
+
+	if cfg.Serial.Port == "" {
+		add("serial.port", "serial port must be set")
+	}
+	if cfg.Serial.Baudrate < 9600 || cfg.Serial.Baudrate > 115200 {
+		add("serial.baudrate", "serial baudrate must be between 9600 and 115200, not %d", cfg.Serial.Baudrate)
+	}
+
+	if (cfg.Tls.Cert == "") != (cfg.Tls.Key == "") {
+		add("tls.key", "tls.cert and tls.key must be set together")
+	} else if cfg.Tls.Enabled && cfg.Network.Listen && cfg.Tls.Cert == "" {
+		add("tls.enabled", "tls.cert and tls.key must be set to use TLS in network mode (see dsuld tls init)")
+	}
+	if cfg.Tls.Pin != "" && !regexp.MustCompile(`^sha256:[0-9a-fA-F]{64}$`).MatchString(cfg.Tls.Pin) {
+		add("tls.pin", "pin must be given as sha256:<64 hex digits> (see dsuld tls init), not '%s'", cfg.Tls.Pin)
+	}
+	if cfg.Network.Address != "" && net.ParseIP(cfg.Network.Address) == nil {
+		add("network.address", "address must be an IP address (of an interface to listen on), not '%s'", cfg.Network.Address)
+	}
+	access_lists := []struct {
+		key  string
+		list []string
+	}{
+		{"access.allow", cfg.Access.Allow},
+		{"access.deny", cfg.Access.Deny},
+	}
+	for _, access_list := range access_lists {
+		for i, entry := range access_list.list {
+			if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+				add(fmt.Sprintf("%s[%d]", access_list.key, i), "entry must be an IP or CIDR (e.g. 192.168.1.0/24), not '%s'", entry)
+			}
+		}
+	}
+	if cfg.Socket.Path != "" && !filepath.IsAbs(cfg.Socket.Path) {
+		add("socket.path", "socket path must be absolute, not '%s'", cfg.Socket.Path)
+	}
+	if !regexp.MustCompile(`^0?[0-7]{3}$`).MatchString(cfg.Socket.Mode) {
+		add("socket.mode", "mode must be given in octal (e.g. 0660), not '%s'", cfg.Socket.Mode)
+	}
+	if _, ok := Roles[cfg.Socket.Role]; !ok && cfg.Socket.Role != "none" {
+		add("socket.role", "role must be one of none, read, control or admin, not '%s'", cfg.Socket.Role)
+	}
+	for i, socket_role := range cfg.Socket.Roles {
+		key := fmt.Sprintf("socket.roles[%d]", i)
+		if (socket_role.User == "") == (socket_role.Group == "") {
+			add(key, "either user or group must be set")
+		}
+		if err := validateRole(socket_role.Role, nil); err != nil {
+			add(key+".role", "%s", err)
+		}
+	}
+	if cfg.Access.MaxFailures < 0 {
+		add("access.maxfailures", "max failures must be at least 0 (0 disables bans), not %d", cfg.Access.MaxFailures)
+	}
+	if cfg.Audit.MaxSize < 0 {
+		add("audit.maxsize", "max size must be at least 0 (0 disables rotation), not %d", cfg.Audit.MaxSize)
+	}
+	if cfg.Audit.MaxFiles < 0 {
+		add("audit.maxfiles", "max files must be at least 0, not %d", cfg.Audit.MaxFiles)
+	}
+	if cfg.History.Size < 1 {
+		add("history.size", "size must be at least 1, not %d", cfg.History.Size)
+	}
+	ports := []struct {
+		key   string
+		value int
+	}{
+		{"network.port", cfg.Network.Port},
+		{"network.httpport", cfg.Network.HttpPort},
+	}
+	for _, port := range ports {
+		if port.value < 1 || port.value > 65535 {
+			add(port.key, "port must be between 1 and 65535, not %d", port.value)
+		}
+	}
+	if cfg.Network.HttpListen && !isLoopback(cfg.Network.HttpAddress) && cfg.Password == "" && len(cfg.Tokens) == 0 {
+		add("network.httpaddress", "a password or tokens must be set to serve the HTTP API on '%s', it's reachable from other hosts", cfg.Network.HttpAddress)
+	}
+	for i, origin := range cfg.Network.HttpOrigins {
+		if parsed, err := url.Parse(origin); err != nil || parsed.Scheme == "" || parsed.Host == "" || strings.Trim(parsed.Path, "/") != "" {
+			add(fmt.Sprintf("network.httporigins[%d]", i), "origin must be given as scheme://host[:port] (e.g. https://dashboard.example.com), not '%s'", origin)
+		}
+	}
+	durations := []struct{ key, value string }{
+		{"network.timeout", cfg.Network.Timeout},
+		{"access.bantime", cfg.Access.BanTime},
+		{"focus.duration", cfg.Focus.Duration},
+		{"focus.break", cfg.Focus.Break},
+		{"focus.longbreak", cfg.Focus.LongBreak},
+	}
+	for _, duration := range durations {
+		if d, err := time.ParseDuration(duration.value); err != nil || d <= 0 {
+			add(duration.key, "duration must be given like 30s, 5m or 1h, not '%s'", duration.value)
+		}
+	}
+	if cfg.Focus.Cycles < 1 {
+		add("focus.cycles", "focus cycles must be at least 1, not %d", cfg.Focus.Cycles)
+	}
+	focus_colors := []struct{ key, value string }{
+		{"focus.focuscolor", cfg.Focus.FocusColor},
+		{"focus.breakcolor", cfg.Focus.BreakColor},
+		{"focus.longbreakcolor", cfg.Focus.LongBreakColor},
+	}
+	for _, focus_color := range focus_colors {
+		if _, ok := color_names[focus_color.value]; !ok {
+			add(focus_color.key, "color '%s' isn't configured", focus_color.value)
+		}
+	}
+
+	return problems
+}
+
+// checkKeys returns problems for settings in a config file that aren't known, suggesting the setting that was probably meant.
+func checkKeys(node *yaml.Node, settings_type reflect.Type, prefix string, path string) Problems {
+	problems := Problems{}
+	if node.Kind == yaml.DocumentNode {
+		for _, content := range node.Content {
+			problems = append(problems, checkKeys(content, settings_type, prefix, path)...)
+		}
+		return problems
+	}
+
+	switch {
+	case node.Kind == yaml.MappingNode && settings_type.Kind() == reflect.Struct:
+		known := map[string]reflect.Type{}
+		names := []string{}
+		for i := 0; i < settings_type.NumField(); i++ {
+			name := getKeyName(settings_type.Field(i))
+			known[name] = settings_type.Field(i).Type
+			names = append(names, name)
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i].Value
+			key := name
+			if prefix != "" {
+				key = prefix + "." + name
+			}
+			field_type, ok := known[name]
+			if !ok {
+				message := fmt.Sprintf("unknown setting '%s'", name)
+				if suggestion := getSuggestion(name, names); suggestion != "" {
+					message += fmt.Sprintf(", did you mean '%s'?", suggestion)
+				}
+				problems = append(problems, Problem{Location: fmt.Sprintf("%s:%d", path, node.Content[i].Line), Key: key, Message: message})
+				continue
+			}
+			problems = append(problems, checkKeys(node.Content[i+1], field_type, key, path)...)
+		}
+	case node.Kind == yaml.SequenceNode && settings_type.Kind() == reflect.Slice:
+		for i, item := range node.Content {
+			problems = append(problems, checkKeys(item, settings_type.Elem(), fmt.Sprintf("%s[%d]", prefix, i), path)...)
+		}
+	}
+	return problems
+}
+
+// findLine returns the line of the setting with the given key (e.g. "colors[1].value") in the config file.
+// If the setting isn't in the file, the line of the closest section (or list item) is returned.
+func findLine(root *yaml.Node, key string) int {
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return 1
+	}
+	node := root.Content[0]
+	line := node.Line
+	for _, part := range regexp.MustCompile(`[^.\[\]]+`).FindAllString(key, -1) {
+		var next *yaml.Node
+		if index, err := strconv.Atoi(part); err == nil && node.Kind == yaml.SequenceNode {
+			if index < len(node.Content) {
+				next = node.Content[index]
+				line = next.Line
+			}
+		} else if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					next = node.Content[i+1]
+					line = node.Content[i].Line
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return line
+}
+
+// readNode returns the parsed config file, or nil if it doesn't exist or can't be parsed.
+func readNode(path string) *yaml.Node {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	root := yaml.Node{}
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil
+	}
+	return &root
+}
+
+// getSuggestion returns the known name closest to the given one, if it's probably a misspelling of it.
+func getSuggestion(name string, known []string) string {
+	suggestion := ""
+	best := 3 // at most two edits
+	for _, known_name := range known {
+		if distance := getDistance(strings.ToLower(name), strings.ToLower(known_name)); distance < best {
+			suggestion = known_name
+			best = distance
+		}
+	}
+	return suggestion
+}
+
+// getDistance returns the number of edits (insertions, deletions or substitutions) needed to turn a into b.
+func getDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// minInt returns the smallest of two numbers.
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// isLoopback returns true if the address is only reachable from this host (e.g. 127.0.0.1, ::1 or localhost).
+func isLoopback(address string) bool {
+	if address == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,146 @@
+// DSUL - Disturb State USB Light : Tokens module
+package tokens
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+// Tokens are given as "dsul_<id>_<secret>". Only a hash is kept in the daemon's config file, so the token can't be read from it.
+// Clients prove they have the token without sending it (like SCRAM): the client key is derived from the token and the hash
+// is the SHA-256 of the client key. A proof is the client key XOR'ed with a HMAC of the message, keyed with the hash.
+// The server recovers the client key from the proof and checks that it matches the hash.
+// HTTP clients send the token itself (as a bearer token), so the HTTP API should only be used locally or behind TLS.
+
+const (
+	prefix     = "dsul_"
+	hashPrefix = "sha256:"
+	keyContext = "dsul client key"
+)
+
+var tokenPattern = regexp.MustCompile(`^dsul_([0-9a-f]{8})_[0-9a-f]{64}$`)
+
+// New returns a new token with the given name, role and allowed operations, and the token's configuration (to save).
+func New(name string, role string, operations []string) (string, settings.Token, error) {
+	random := make([]byte, 36)
+	if _, err := rand.Read(random); err != nil {
+		return "", settings.Token{}, err
+	}
+	id := hex.EncodeToString(random[:4])
+	token := prefix + id + "_" + hex.EncodeToString(random[4:])
+	cfg_token := settings.Token{
+		Name:       name,
+		ID:         id,
+		Hash:       getHash(getKey(token)),
+		Role:       role,
+		Operations: operations,
+		Created:    time.Now().UTC().Format(time.RFC3339),
+	}
+	return token, cfg_token, nil
+}
+
+// Parse returns the ID of the token, if it's given as a token.
+func Parse(token string) (string, bool) {
+	match := tokenPattern.FindStringSubmatch(token)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// Find returns the configured token with the given ID.
+func Find(cfg *settings.Config, id string) (settings.Token, bool) {
+	for _, cfg_token := range cfg.Tokens {
+		if cfg_token.ID == id {
+			return cfg_token, true
+		}
+	}
+	return settings.Token{}, false
+}
+
+// Verify returns the configured token matching the given token, e.g. a bearer token.
+func Verify(cfg *settings.Config, token string) (settings.Token, error) {
+	id, ok := Parse(token)
+	if !ok {
+		return settings.Token{}, errors.New("not a token")
+	}
+	cfg_token, ok := Find(cfg, id)
+	if !ok {
+		return settings.Token{}, errors.New("unknown token")
+	}
+	if subtle.ConstantTimeCompare([]byte(getHash(getKey(token))), []byte(cfg_token.Hash)) != 1 {
+		return settings.Token{}, errors.New("invalid token")
+	}
+	return cfg_token, nil
+}
+
+// Prove returns the proof (hex encoded) that the client has the token, for the given message.
+func Prove(token string, message []byte) string {
+	key := getKey(token)
+	signature := getSignature(getHash(key), message)
+	proof := make([]byte, len(key))
+	for i := range key {
+		proof[i] = key[i] ^ signature[i]
+	}
+	return hex.EncodeToString(proof)
+}
+
+// CheckProof returns true if the proof, for the given message, was made with the token.
+func CheckProof(cfg_token settings.Token, message []byte, proof string) bool {
+	data, err := hex.DecodeString(proof)
+	if err != nil || len(data) != sha256.Size {
+		return false
+	}
+	signature := getSignature(cfg_token.Hash, message)
+	key := make([]byte, len(data))
+	for i := range data {
+		key[i] = data[i] ^ signature[i]
+	}
+	return subtle.ConstantTimeCompare([]byte(getHash(key)), []byte(cfg_token.Hash)) == 1
+}
+
+// Allows returns true if the token is allowed to perform the operation, by its role and allowed operations.
+func Allows(cfg_token settings.Token, operation string) bool {
+	if !contains(settings.Roles[cfg_token.Role], operation) {
+		return false
+	}
+	return len(cfg_token.Operations) == 0 || contains(cfg_token.Operations, operation)
+}
+
+// getKey returns the client key of the token.
+func getKey(token string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(keyContext))
+	return mac.Sum(nil)
+}
+
+// getHash returns the hash of the client key, as it's stored in the config file.
+func getHash(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// getSignature returns the HMAC-SHA256 of the message, keyed with the hash.
+func getSignature(hash string, message []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(hash))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// contains returns true if the list contains the value.
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
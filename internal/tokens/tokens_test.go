@@ -0,0 +1,102 @@
+// DSUL - Disturb State USB Light : Tokens module tests.
+package tokens
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestNew(t *testing.T) {
+	token, cfg_token, err := New("dashboard", "read", nil)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	id, ok := Parse(token)
+	if !ok || id != cfg_token.ID {
+		t.Errorf("Wrong(Parse(%q)) == %q, want %q", token, id, cfg_token.ID)
+	}
+	if strings.Contains(cfg_token.Hash, token) || strings.Contains(cfg_token.Hash, strings.Split(token, "_")[2]) {
+		t.Errorf("Wrong(%q) == %q, want a hash that doesn't contain the token", token, cfg_token.Hash)
+	}
+	if other, _, _ := New("dashboard", "read", nil); other == token {
+		t.Errorf("Wrong(New()) == %q twice, want different tokens", token)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	token, cfg_token, _ := New("dashboard", "read", nil)
+	other, _, _ := New("other", "read", nil)
+	cfg := settings.Config{Tokens: []settings.Token{cfg_token}}
+	tests := []struct {
+		name  string
+		token string
+		want  string // error
+	}{
+		{"token", token, ""},
+		{"unknown token", other, "unknown token"},
+		{"wrong secret", prefix + cfg_token.ID + "_" + strings.Repeat("0", 64), "invalid token"},
+		{"password", "secret", "not a token"},
+		{"empty", "", "not a token"},
+	}
+	for _, test := range tests {
+		got := ""
+		if _, err := Verify(&cfg, test.token); err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("Wrong(%s) == %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestProof(t *testing.T) {
+	token, cfg_token, _ := New("calendar", "control", nil)
+	other, _, _ := New("other", "control", nil)
+	message := []byte("nonce\n1\n1\nset\n{}")
+	proof := Prove(token, message)
+
+	tests := []struct {
+		name    string
+		message []byte
+		proof   string
+		want    bool
+	}{
+		{"proof", message, proof, true},
+		{"other message", []byte("nonce\n2\n1\nset\n{}"), proof, false},
+		{"other token", message, Prove(other, message), false},
+		{"hash as proof", message, strings.TrimPrefix(cfg_token.Hash, "sha256:"), false},
+		{"not hex", message, "proof", false},
+	}
+	for _, test := range tests {
+		if got := CheckProof(cfg_token, test.message, test.proof); got != test.want {
+			t.Errorf("Wrong(%s) == %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		role       string
+		operations []string
+		operation  string
+		want       bool
+	}{
+		{"read", nil, "get", true},
+		{"read", nil, "subscribe", true},
+		{"read", nil, "set", false},
+		{"control", nil, "set", true},
+		{"control", nil, "config", false},
+		{"control", []string{"set"}, "set", true},
+		{"control", []string{"set"}, "notify", false},
+		{"admin", nil, "token", true},
+		{"unknown", nil, "get", false},
+	}
+	for _, test := range tests {
+		cfg_token := settings.Token{Name: "test", Role: test.role, Operations: test.operations}
+		if got := Allows(cfg_token, test.operation); got != test.want {
+			t.Errorf("Wrong(%s %v, %s) == %v, want %v", test.role, test.operations, test.operation, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+// DSUL - Disturb State USB Light : TUI module, terminal handling (linux)
+package tui
+
+import "golang.org/x/sys/unix"
+
+const (
+	ioctlReadTermios  = unix.TCGETS
+	ioctlWriteTermios = unix.TCSETS
+)
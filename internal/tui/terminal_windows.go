@@ -0,0 +1,44 @@
+// DSUL - Disturb State USB Light : TUI module, terminal handling (windows)
+package tui
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// openTerminal puts the console in raw (virtual terminal) mode and returns a function that restores it.
+func openTerminal() (func(), error) {
+	in_handle := windows.Handle(os.Stdin.Fd())
+	out_handle := windows.Handle(os.Stdout.Fd())
+	var in_mode, out_mode uint32
+	if err := windows.GetConsoleMode(in_handle, &in_mode); err != nil {
+		return nil, ErrNoTerminal
+	}
+	if err := windows.GetConsoleMode(out_handle, &out_mode); err != nil {
+		return nil, ErrNoTerminal
+	}
+
+	raw_mode := in_mode &^ (windows.ENABLE_ECHO_INPUT | windows.ENABLE_PROCESSED_INPUT | windows.ENABLE_LINE_INPUT)
+	if err := windows.SetConsoleMode(in_handle, raw_mode|windows.ENABLE_VIRTUAL_TERMINAL_INPUT); err != nil {
+		return nil, err
+	}
+	if err := windows.SetConsoleMode(out_handle, out_mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+		_ = windows.SetConsoleMode(in_handle, in_mode)
+		return nil, err
+	}
+
+	return func() {
+		_ = windows.SetConsoleMode(in_handle, in_mode)
+		_ = windows.SetConsoleMode(out_handle, out_mode)
+	}, nil
+}
+
+// terminalWidth returns the width of the console, or the default width if it's unknown.
+func terminalWidth() int {
+	info := windows.ConsoleScreenBufferInfo{}
+	if err := windows.GetConsoleScreenBufferInfo(windows.Handle(os.Stdout.Fd()), &info); err != nil {
+		return defaultWidth
+	}
+	return int(info.Window.Right-info.Window.Left) + 1
+}
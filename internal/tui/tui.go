@@ -0,0 +1,448 @@
+// DSUL - Disturb State USB Light : TUI module
+package tui
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hymnis/dsul-go/internal/events"
+	"github.com/hymnis/dsul-go/internal/ipc"
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+var (
+	verbose bool = false
+	debug   bool = false
+)
+
+// ErrNoTerminal is returned if the UI isn't run in a terminal.
+var ErrNoTerminal = errors.New("not a terminal, the UI needs an interactive terminal")
+
+const (
+	defaultWidth     = 80 // used if the terminal width is unknown
+	brightnessStep   = 5  // brightness change for arrow keys
+	brightnessJump   = 25 // brightness change for page up/down
+	swatchWidth      = 14
+	brightnessBarLen = 20
+)
+
+// view holds the values shown in the UI.
+type view struct {
+	palette    ipc.Palette
+	connected  bool
+	color      string // red:green:blue
+	brightness int
+	mode       string
+	dim        bool
+	picker     bool // state picker is open
+	selected   int  // selected state in the picker
+	message    string
+}
+
+// ui handles requests, responses and key presses.
+type ui struct {
+	cfg         *settings.Config
+	view        view
+	ipc_request chan ipc.Request
+	pending     map[uint64]string // sent requests (what was requested), by ID
+	last_id     uint64
+}
+
+// Runner parts //
+
+// Runner runs the terminal UI until the user quits (nil is returned) or the connection fails (the error is returned).
+// Requests are sent to ipc_request, that should be buffered, and responses (including events) are read from ipc_response.
+func Runner(cfg *settings.Config, output_handling struct {
+	Verbose bool
+	Debug   bool
+}, ipc_request chan ipc.Request, ipc_response chan ipc.Response, ipc_error chan error) error {
+	verbose = output_handling.Verbose
+	debug = output_handling.Debug
+
+	restore, err := openTerminal()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	fmt.Print("\x1b[?1049h\x1b[?25l")       // use alternate screen and hide cursor
+	defer fmt.Print("\x1b[?25h\x1b[?1049l") // show cursor and return to normal screen
+
+	u := ui{
+		cfg:         cfg,
+		view:        view{palette: ipc.NewPalette(cfg), connected: true, message: "Connecting..."},
+		ipc_request: ipc_request,
+		pending:     make(map[uint64]string),
+	}
+	u.send("palette", ipc.OpGet, ipc.GetPayload{Key: "palette"})
+	u.send("state", ipc.OpGet, ipc.GetPayload{Key: "state"})
+	u.send("subscribe", ipc.OpSubscribe, ipc.SubscribePayload{Topic: "events"})
+
+	key_channel := make(chan string)
+	go readKeys(key_channel)
+
+	for {
+		fmt.Print(render(u.view, terminalWidth()))
+		select {
+		case key, ok := <-key_channel:
+			if !ok || !u.handleKey(key) {
+				return nil
+			}
+		case response := <-ipc_response:
+			u.handleResponse(response)
+		case err := <-ipc_error:
+			return err
+		}
+	}
+}
+
+// readKeys reads from stdin and sends the key presses to key_channel, until stdin is closed.
+func readKeys(key_channel chan string) {
+	buff := make([]byte, 64)
+	for {
+		n, err := os.Stdin.Read(buff)
+		if err != nil {
+			close(key_channel)
+			return
+		}
+		for _, key := range parseKeys(buff[:n]) {
+			key_channel <- key
+		}
+	}
+}
+
+// parseKeys returns the names of the keys in the given input, e.g. "up", "tab" or "a".
+func parseKeys(input []byte) []string {
+	sequences := map[string]string{
+		"\x1b[A": "up", "\x1b[B": "down", "\x1b[C": "right", "\x1b[D": "left",
+		"\x1b[5~": "pgup", "\x1b[6~": "pgdown", "\x1b[Z": "backtab",
+	}
+	keys := []string{}
+	for len(input) > 0 {
+		matched := false
+		for sequence, key := range sequences {
+			if strings.HasPrefix(string(input), sequence) {
+				keys = append(keys, key)
+				input = input[len(sequence):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+
+		switch input[0] {
+		case 0x1b:
+			keys = append(keys, "esc")
+		case 0x03:
+			keys = append(keys, "ctrl-c")
+		case '\t':
+			keys = append(keys, "tab")
+		case '\r', '\n':
+			keys = append(keys, "enter")
+		default:
+			keys = append(keys, string(input[0]))
+		}
+		input = input[1:]
+	}
+	return keys
+}
+
+// send sends a request, without waiting for the connection, and remembers what was requested.
+func (u *ui) send(what string, op string, payload interface{}) {
+	u.last_id += 1
+	request, err := ipc.NewRequest(u.last_id, op, ipc.GetSecret(u.cfg), payload)
+	if err != nil {
+		u.view.message = "Unable to create request: " + err.Error()
+		return
+	}
+	select {
+	case u.ipc_request <- request:
+		u.pending[request.ID] = what
+	default:
+		u.view.message = "Too many requests, waiting for the daemon"
+	}
+}
+
+// set sends a set request for the given key and value.
+func (u *ui) set(key string, value string) {
+	if debug {
+		log.Printf("[tui] Set %s: %s\n", key, value)
+	}
+	u.send("set "+key, ipc.OpSet, ipc.SetPayload{Key: key, Value: value})
+}
+
+// handleKey handles a key press and returns false if the UI should quit.
+func (u *ui) handleKey(key string) bool {
+	if u.view.picker {
+		switch key {
+		case "up":
+			if u.view.selected > 0 {
+				u.view.selected -= 1
+			}
+		case "down":
+			if u.view.selected < len(u.view.palette.States)-1 {
+				u.view.selected += 1
+			}
+		case "enter":
+			u.set("state", u.view.palette.States[u.view.selected].Name)
+			u.view.picker = false
+		case "esc", "s", "q":
+			u.view.picker = false
+		case "ctrl-c":
+			return false
+		}
+		return true
+	}
+
+	switch key {
+	case "q", "esc", "ctrl-c":
+		return false
+	case "up", "right":
+		u.setBrightness(u.view.brightness + brightnessStep)
+	case "down", "left":
+		u.setBrightness(u.view.brightness - brightnessStep)
+	case "pgup":
+		u.setBrightness(u.view.brightness + brightnessJump)
+	case "pgdown":
+		u.setBrightness(u.view.brightness - brightnessJump)
+	case "tab":
+		u.stepMode(1)
+	case "backtab":
+		u.stepMode(-1)
+	case "d":
+		u.set("dim", strconv.FormatBool(!u.view.dim))
+	case "s":
+		if len(u.view.palette.States) > 0 {
+			u.view.picker = true
+			u.view.selected = 0
+		} else {
+			u.view.message = "No states are configured"
+		}
+	case "r":
+		u.send("state", ipc.OpGet, ipc.GetPayload{Key: "state"})
+	default:
+		if index, err := strconv.Atoi(key); err == nil && len(key) == 1 {
+			if index == 0 {
+				index = 10 // 0 is the tenth color
+			}
+			if index <= len(u.view.palette.Colors) {
+				u.set("color", u.view.palette.Colors[index-1].Name)
+			}
+		}
+	}
+	return true
+}
+
+// setBrightness sets the brightness, limited to the brightness limits.
+// The view is updated directly, so repeated key presses aren't based on an old value.
+func (u *ui) setBrightness(brightness int) {
+	if brightness < u.view.palette.BrightnessMin {
+		brightness = u.view.palette.BrightnessMin
+	}
+	if brightness > u.view.palette.BrightnessMax {
+		brightness = u.view.palette.BrightnessMax
+	}
+	if brightness == u.view.brightness {
+		return
+	}
+	u.view.brightness = brightness
+	u.set("brightness", strconv.Itoa(brightness))
+}
+
+// stepMode sets the next (or previous) mode.
+func (u *ui) stepMode(step int) {
+	modes := u.view.palette.Modes
+	if len(modes) == 0 {
+		return
+	}
+	index := 0
+	for i, mode := range modes {
+		if mode == u.view.mode {
+			index = (i + step + len(modes)) % len(modes)
+		}
+	}
+	u.set("mode", modes[index])
+}
+
+// handleResponse updates the view from a response or event.
+func (u *ui) handleResponse(response ipc.Response) {
+	if response.Op == ipc.OpEvent {
+		e := events.Event{}
+		if err := response.Decode(&e); err == nil {
+			u.handleEvent(e)
+		}
+		return
+	}
+
+	what, ok := u.pending[response.ID]
+	if !ok {
+		return
+	}
+	delete(u.pending, response.ID)
+
+	if response.Error != nil {
+		u.view.message = fmt.Sprintf("%s: failed, %s", what, response.Error.Message)
+		if response.Error.Code == ipc.ErrDeviceOffline {
+			u.view.connected = false
+		}
+		if what == "set brightness" {
+			u.send("state", ipc.OpGet, ipc.GetPayload{Key: "state"}) // brightness was changed in the view, get the actual value
+		}
+		return
+	}
+
+	switch what {
+	case "palette":
+		palette := ipc.Palette{}
+		if err := response.Decode(&palette); err == nil {
+			u.view.palette = palette
+		}
+	case "state":
+		hardware_state := settings.Hardware{}
+		if err := response.Decode(&hardware_state); err == nil {
+			u.view.connected = true
+			u.view.color = hardware_state.Current_color
+			u.view.brightness = hardware_state.Current_brightness
+			u.view.mode = settings.GetModeName(hardware_state.Current_mode, u.cfg)
+			u.view.dim = hardware_state.Current_dim == 1
+			u.view.message = ""
+		}
+	}
+}
+
+// handleEvent updates the view from an event.
+func (u *ui) handleEvent(e events.Event) {
+	switch e.Type {
+	case "state":
+		switch e.Key {
+		case "color":
+			u.view.color = e.New
+		case "brightness":
+			u.view.brightness, _ = strconv.Atoi(e.New)
+		case "mode":
+			u.view.mode = e.New
+		case "dim":
+			u.view.dim = e.New == "true"
+		}
+	case "device":
+		u.view.connected = e.New == "connected"
+		if u.view.connected {
+			u.send("state", ipc.OpGet, ipc.GetPayload{Key: "state"})
+		} else {
+			u.view.message = "Device disconnected"
+		}
+	}
+}
+
+// getColorName returns the name of the color with the given value, if there is one.
+func getColorName(value string, palette ipc.Palette) string {
+	for _, color := range palette.Colors {
+		if color.Value == value {
+			return color.Name
+		}
+	}
+	return ""
+}
+
+// render returns the screen contents for the view, fitted to the given width.
+func render(v view, width int) string {
+	lines := []string{"", " DSUL - Disturb State USB Light", ""}
+
+	swatch := strings.Repeat(" ", swatchWidth)
+	if rgb := strings.Split(v.color, ":"); len(rgb) == 3 && v.connected {
+		swatch = fmt.Sprintf("\x1b[48;2;%s;%s;%sm%s\x1b[0m", rgb[0], rgb[1], rgb[2], swatch)
+	}
+	color := v.color
+	if name := getColorName(v.color, v.palette); name != "" {
+		color = fmt.Sprintf("%s (%s)", name, v.color)
+	}
+	dim := "off"
+	if v.dim {
+		dim = "on"
+	}
+	device := "connected"
+	if !v.connected {
+		device = "offline"
+	}
+	details := []string{
+		"color       " + color,
+		"mode        " + v.mode,
+		fmt.Sprintf("brightness  %-3d %s %d-%d", v.brightness, brightnessBar(v), v.palette.BrightnessMin, v.palette.BrightnessMax),
+		"dim         " + dim,
+		"device      " + device,
+	}
+	for _, detail := range details {
+		lines = append(lines, fmt.Sprintf(" %s   %s", swatch, detail))
+	}
+	lines = append(lines, "")
+
+	if v.picker {
+		lines = append(lines, " states (up/down select, enter set, esc cancel)")
+		for i, state := range v.palette.States {
+			marker := " "
+			if i == v.selected {
+				marker = ">"
+			}
+			lines = append(lines, fmt.Sprintf(" %s %-12s %s %s", marker, state.Name, state.Color, state.Mode))
+		}
+	} else {
+		colors := []string{}
+		for i, color := range v.palette.Colors {
+			if i < 10 {
+				colors = append(colors, fmt.Sprintf("%d %s", (i+1)%10, color.Name))
+			}
+		}
+		lines = append(lines, wrap(" colors  ", colors, width)...)
+		modes := []string{}
+		for _, mode := range v.palette.Modes {
+			if mode == v.mode {
+				mode = "[" + mode + "]"
+			}
+			modes = append(modes, mode)
+		}
+		lines = append(lines, wrap(" modes   ", modes, width)...)
+	}
+
+	lines = append(lines, "")
+	lines = append(lines, wrap(" ", []string{"arrows brightness", "1-9,0 color", "tab mode", "d dim", "s states", "r refresh", "q quit"}, width)...)
+	lines = append(lines, "", " "+v.message)
+
+	return "\x1b[H\x1b[2J" + strings.Join(lines, "\r\n")
+}
+
+// brightnessBar returns a bar showing the brightness within the brightness limits.
+func brightnessBar(v view) string {
+	filled := 0
+	if limits := v.palette.BrightnessMax - v.palette.BrightnessMin; limits > 0 {
+		filled = (v.brightness - v.palette.BrightnessMin) * brightnessBarLen / limits
+	}
+	if filled < 0 {
+		filled = 0
+	}
+	if filled > brightnessBarLen {
+		filled = brightnessBarLen
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", brightnessBarLen-filled) + "]"
+}
+
+// wrap joins the items after the prefix, on as many lines as needed to fit the width.
+func wrap(prefix string, items []string, width int) []string {
+	lines := []string{}
+	line := prefix
+	for _, item := range items {
+		if len(line) > len(prefix) && len(line)+2+len(item) > width {
+			lines = append(lines, line)
+			line = strings.Repeat(" ", len(prefix))
+		}
+		if len(line) > len(prefix) {
+			line += "  "
+		}
+		line += item
+	}
+	return append(lines, line)
+}
@@ -0,0 +1,118 @@
+// DSUL - Disturb State USB Light : TUI module tests.
+package tui
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hymnis/dsul-go/internal/events"
+	"github.com/hymnis/dsul-go/internal/ipc"
+	"github.com/hymnis/dsul-go/internal/settings"
+)
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		in_value string
+		want     string
+	}{
+		{"\x1b[A\x1b[B\x1b[C\x1b[D", "up down right left"},
+		{"\t\x1b[Z", "tab backtab"},
+		{"4d\r", "4 d enter"},
+		{"\x1b", "esc"},
+		{"\x03", "ctrl-c"},
+		{"\x1b[6~q", "pgdown q"},
+	}
+
+	for _, test := range tests {
+		if out_value := strings.Join(parseKeys([]byte(test.in_value)), " "); out_value != test.want {
+			t.Errorf("Wrong(%q) == %q, want %q", test.in_value, out_value, test.want)
+		}
+	}
+}
+
+func TestHandleKey(t *testing.T) {
+	cfg := &settings.Config{}
+	palette := ipc.Palette{
+		Colors:        []ipc.PaletteColor{{Name: "red", Value: "255:0:0"}, {Name: "green", Value: "0:255:0"}},
+		Modes:         []string{"solid", "blink"},
+		States:        []ipc.PaletteState{{Name: "busy", Color: "red", Mode: "solid"}},
+		BrightnessMin: 0,
+		BrightnessMax: 150,
+	}
+	tests := []struct {
+		in_value []string
+		want     ipc.SetPayload
+	}{
+		{[]string{"2"}, ipc.SetPayload{Key: "color", Value: "green"}},
+		{[]string{"up"}, ipc.SetPayload{Key: "brightness", Value: "105"}},
+		{[]string{"pgdown"}, ipc.SetPayload{Key: "brightness", Value: "75"}},
+		{[]string{"tab"}, ipc.SetPayload{Key: "mode", Value: "blink"}},
+		{[]string{"backtab"}, ipc.SetPayload{Key: "mode", Value: "blink"}},
+		{[]string{"d"}, ipc.SetPayload{Key: "dim", Value: "true"}},
+		{[]string{"s", "enter"}, ipc.SetPayload{Key: "state", Value: "busy"}},
+	}
+
+	for _, test := range tests {
+		u := ui{
+			cfg:         cfg,
+			view:        view{palette: palette, brightness: 100, mode: "solid"},
+			ipc_request: make(chan ipc.Request, 1),
+			pending:     make(map[uint64]string),
+		}
+		for _, key := range test.in_value {
+			if !u.handleKey(key) {
+				t.Fatalf("Wrong(%v) quit the UI", test.in_value)
+			}
+		}
+		payload := ipc.SetPayload{}
+		if err := (<-u.ipc_request).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload != test.want {
+			t.Errorf("Wrong(%v) == %+v, want %+v", test.in_value, payload, test.want)
+		}
+	}
+
+	u := ui{view: view{palette: palette}}
+	if u.handleKey("q") {
+		t.Errorf("Wrong(q) didn't quit the UI")
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	u := ui{view: view{connected: true}}
+	u.handleEvent(events.Event{Type: "state", Key: "color", New: "0:0:255"})
+	u.handleEvent(events.Event{Type: "state", Key: "brightness", New: "80"})
+	u.handleEvent(events.Event{Type: "state", Key: "dim", New: "true"})
+	u.handleEvent(events.Event{Type: "device", New: "disconnected"})
+	want := view{color: "0:0:255", brightness: 80, dim: true, message: "Device disconnected"}
+
+	if u.view.color != want.color || u.view.brightness != want.brightness || u.view.dim != want.dim || u.view.connected || u.view.message != want.message {
+		t.Errorf("Wrong() == %+v, want %+v", u.view, want)
+	}
+}
+
+func TestRender(t *testing.T) {
+	v := view{
+		palette:    ipc.Palette{Colors: []ipc.PaletteColor{{Name: "red", Value: "255:0:0"}}, Modes: []string{"solid"}, BrightnessMax: 100},
+		connected:  true,
+		color:      "255:0:0",
+		brightness: 50,
+		mode:       "solid",
+	}
+	screen := render(v, defaultWidth)
+	for _, want := range []string{"\x1b[48;2;255;0;0m", "red (255:0:0)", "[##########----------]", "[solid]", "1 red"} {
+		if !strings.Contains(screen, want) {
+			t.Errorf("Wrong() == %q, want it to contain %q", screen, want)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	out_value := wrap(" x ", []string{"aaaa", "bbbb", "cccc"}, 12)
+	want := []string{" x aaaa", "   bbbb", "   cccc"}
+
+	if strings.Join(out_value, "|") != strings.Join(want, "|") {
+		t.Errorf("Wrong() == %q, want %q", out_value, want)
+	}
+}
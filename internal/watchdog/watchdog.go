@@ -7,8 +7,11 @@ import (
 
 // Watchdog holds a timer and an interval.
 type Watchdog struct {
-	interval time.Duration
-	timer    *time.Timer
+	interval  time.Duration
+	timer     *time.Timer
+	deadline  time.Time
+	remaining time.Duration
+	paused    bool
 }
 
 // NewCallbackTimer creates a new watchdog that calls a callback function when the timer expires.
@@ -16,6 +19,7 @@ func NewCallbackTimer(interval time.Duration, callback func()) *Watchdog {
 	w := Watchdog{
 		interval: interval,
 		timer:    time.AfterFunc(interval, callback),
+		deadline: time.Now().Add(interval),
 	}
 	return &w
 }
@@ -25,6 +29,7 @@ func NewChannelTimer(interval time.Duration) *Watchdog {
 	w := Watchdog{
 		interval: interval,
 		timer:    time.NewTimer(interval),
+		deadline: time.Now().Add(interval),
 	}
 	return &w
 }
@@ -38,6 +43,45 @@ func (w *Watchdog) Stop() {
 func (w *Watchdog) Kick() {
 	w.timer.Stop()
 	w.timer.Reset(w.interval)
+	w.deadline = time.Now().Add(w.interval)
+	w.paused = false
+}
+
+// Pause stops the watchdog timer and keeps the remaining time until it's resumed.
+func (w *Watchdog) Pause() {
+	if w.paused {
+		return
+	}
+	w.timer.Stop()
+	w.remaining = w.Remaining()
+	w.paused = true
+}
+
+// Resume restarts a paused watchdog timer with the time that remained when it was paused.
+func (w *Watchdog) Resume() {
+	if !w.paused {
+		return
+	}
+	w.timer.Reset(w.remaining)
+	w.deadline = time.Now().Add(w.remaining)
+	w.paused = false
+}
+
+// Paused returns true if the watchdog timer is paused.
+func (w *Watchdog) Paused() bool {
+	return w.paused
+}
+
+// Remaining returns the time left until the watchdog timer expires.
+func (w *Watchdog) Remaining() time.Duration {
+	if w.paused {
+		return w.remaining
+	}
+	remaining := time.Until(w.deadline)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
 }
 
 // Channel returns the channel that the watchdog timer sends on.
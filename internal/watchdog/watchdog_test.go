@@ -1,7 +1,10 @@
 // DSUL - Disturb State USB Light : Watchdog module tests.
 package watchdog
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestSomething(t *testing.T) {
 	cases := []struct {
@@ -17,3 +20,33 @@ func TestSomething(t *testing.T) {
 		}
 	}
 }
+
+func TestPauseResume(t *testing.T) {
+	w := NewChannelTimer(time.Hour)
+	w.Pause()
+	remaining := w.Remaining()
+
+	if !w.Paused() || remaining > time.Hour || remaining < time.Minute*59 {
+		t.Errorf("Wrong remaining time after pause: %v", remaining)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if w.Remaining() != remaining {
+		t.Errorf("Remaining time changed while paused: %v, want %v", w.Remaining(), remaining)
+	}
+
+	w.Resume()
+	if w.Paused() || w.Remaining() > remaining {
+		t.Errorf("Wrong remaining time after resume: %v", w.Remaining())
+	}
+	w.Stop()
+}
+
+func TestRemaining(t *testing.T) {
+	fired := make(chan bool, 1)
+	w := NewCallbackTimer(time.Millisecond*10, func() { fired <- true })
+	<-fired
+
+	if w.Remaining() != 0 {
+		t.Errorf("Wrong remaining time after expiry: %v, want 0", w.Remaining())
+	}
+}